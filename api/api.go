@@ -18,11 +18,16 @@ const (
 	activeConnectionsPath = "/api/v1/sftp_connection"
 	quotaScanPath         = "/api/v1/quota_scan"
 	userPath              = "/api/v1/user"
+	hostKeysPath          = "/api/v1/host_keys"
+	defenderHostsPath     = "/api/v1/defender/hosts"
+	connectionsStatsPath  = "/api/v1/connection_stats"
+	reloadConfigPath      = "/api/v1/config/reload"
 )
 
 var (
-	router       *chi.Mux
-	dataProvider dataprovider.Provider
+	router         *chi.Mux
+	dataProvider   dataprovider.Provider
+	configReloader func() error
 )
 
 // HTTPDConf httpd daemon configuration
@@ -48,6 +53,24 @@ func SetDataProvider(provider dataprovider.Provider) {
 	dataProvider = provider
 }
 
+// SetConfigReloader sets the function to use to reload the configuration, the reload API is disabled if not set
+func SetConfigReloader(reloader func() error) {
+	configReloader = reloader
+}
+
+func reloadConfig(w http.ResponseWriter, r *http.Request) {
+	if configReloader == nil {
+		sendAPIResponse(w, r, nil, "Configuration reload is not available", http.StatusNotImplemented)
+		return
+	}
+	if err := configReloader(); err != nil {
+		sendAPIResponse(w, r, err, "Configuration reload rejected, the current configuration is kept",
+			http.StatusInternalServerError)
+		return
+	}
+	sendAPIResponse(w, r, nil, "Configuration reloaded", http.StatusOK)
+}
+
 func sendAPIResponse(w http.ResponseWriter, r *http.Request, err error, message string, code int) {
 	var errorString string
 	if err != nil {
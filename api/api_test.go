@@ -3,6 +3,7 @@ package api_test
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,22 +21,30 @@ import (
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/drakkan/sftpgo/api"
 	"github.com/drakkan/sftpgo/config"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 const (
 	defaultUsername       = "test_user"
 	defaultPassword       = "test_password"
 	testPubKey            = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQC03jj0D+djk7pxIf/0OhrxrchJTRZklofJ1NoIu4752Sq02mdXmarMVsqJ1cAjV5LBVy3D1F5U6XW4rppkXeVtd04Pxb09ehtH0pRRPaoHHlALiJt8CoMpbKYMA8b3KXPPriGxgGomvtU2T2RMURSwOZbMtpsugfjYSWenyYX+VORYhylWnSXL961LTyC21ehd6d6QnW9G7E5hYMITMY9TuQZz3bROYzXiTsgN0+g6Hn7exFQp50p45StUMfV/SftCMdCxlxuyGny2CrN/vfjO7xxOo2uv7q1qm10Q46KPWJQv+pgZ/OfL+EDjy07n5QVSKHlbx+2nT4Q0EgOSQaCTYwn3YjtABfIxWwgAFdyj6YlPulCL22qU4MYhDcA6PSBwDdf8hvxBfvsiHdM+JcSHvv8/VeJhk6CmnZxGY0fxBupov27z3yEO8nAg8k+6PaUiW1MSUfuGMF/ktB8LOstXsEPXSszuyXiOv4DaryOXUiSn7bmRqKcEFlJusO6aZP0= nicola@p1"
+	testPubKey1           = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDKajsM9YLfm4I/Wi3KZhs/R8aMzhWIv/+ScFhtJutf3 test key"
 	logSender             = "APITesting"
 	userPath              = "/api/v1/user"
 	activeConnectionsPath = "/api/v1/sftp_connection"
 	quotaScanPath         = "/api/v1/quota_scan"
+	hostKeysPath          = "/api/v1/host_keys"
+	defenderHostsPath     = "/api/v1/defender/hosts"
+	connectionsStatsPath  = "/api/v1/connection_stats"
+	reloadConfigPath      = "/api/v1/config/reload"
 )
 
 var (
@@ -56,6 +66,7 @@ func TestMain(m *testing.M) {
 	configFilePath := filepath.Join(configDir, confName)
 	config.LoadConfig(configFilePath)
 	providerConf := config.GetProviderConf()
+	providerConf.SecretsEncryptionKey = "test secrets encryption key"
 
 	err := dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
@@ -126,7 +137,7 @@ func TestBasicUserHandling(t *testing.T) {
 func TestAddUserNoCredentials(t *testing.T) {
 	u := getTestUser()
 	u.Password = ""
-	u.PublicKey = ""
+	u.PublicKeys = nil
 	_, err := api.AddUser(u, http.StatusBadRequest)
 	if err != nil {
 		t.Errorf("unexpected error adding user with no credentials: %v", err)
@@ -192,24 +203,478 @@ func TestUpdateUser(t *testing.T) {
 	user.Permissions = []string{dataprovider.PermCreateDirs, dataprovider.PermDelete, dataprovider.PermDownload}
 	user.UploadBandwidth = 1024
 	user.DownloadBandwidth = 512
+	user.Filters.RequiredAuthMethods = []string{"publickey,password", "password"}
+	user.Filters.MaxUploadFileSize = 1048576
+	user.Filters.AllowedIP = []string{"192.168.1.0/24", "10.0.0.0/8"}
+	user.Filters.DeniedIP = []string{"192.168.1.5/32"}
+	user.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		dataprovider.PatternsFilter{
+			Path:            "/incoming/",
+			AllowedPatterns: []string{"*.JPG", " *.png"},
+			DeniedPatterns:  []string{"*.exe"},
+			HideDenied:      true,
+		},
+	}
+	user.DirPermissions = map[string][]string{
+		"/incoming":     []string{dataprovider.PermUpload, dataprovider.PermListItems},
+		"/outgoing/sub": []string{dataprovider.PermAny},
+	}
+	user.FsConfig.Provider = dataprovider.MemoryFilesystemProvider
+	user.VirtualFolders = []dataprovider.VirtualFolder{
+		dataprovider.VirtualFolder{
+			VirtualPath:      "/shared/vdir",
+			MappedPath:       filepath.Join(os.TempDir(), "vdir"),
+			Permissions:      []string{dataprovider.PermListItems, dataprovider.PermDownload},
+			ExcludeFromQuota: true,
+		},
+	}
 	user, err = api.UpdateUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to update user: %v", err)
 	}
+	// the removed directory permissions must be revoked
+	delete(user.DirPermissions, "/outgoing/sub")
+	user, err = api.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove a directory permission: %v", err)
+	}
+	if _, ok := user.DirPermissions["/outgoing/sub"]; ok {
+		t.Errorf("directory permission for /outgoing/sub not revoked")
+	}
+	// the last virtual folder must be removable
+	user.VirtualFolders = nil
+	user, err = api.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove the virtual folders: %v", err)
+	}
+	if len(user.VirtualFolders) != 0 {
+		t.Errorf("virtual folders not removed: %+v", user.VirtualFolders)
+	}
 	err = api.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove: %v", err)
 	}
 }
 
+func TestAddUserInvalidDirPerms(t *testing.T) {
+	u := getTestUser()
+	u.DirPermissions = map[string][]string{"relative": []string{dataprovider.PermAny}}
+	_, err := api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with relative dir permissions path: %v", err)
+	}
+	u.DirPermissions = map[string][]string{"/": []string{dataprovider.PermAny}}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with root dir permissions: %v", err)
+	}
+	u.DirPermissions = map[string][]string{"/dir": []string{"invalidPerm"}}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid dir permissions: %v", err)
+	}
+	u.DirPermissions = map[string][]string{"/dir": []string{}}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with empty dir permissions: %v", err)
+	}
+	u.DirPermissions = map[string][]string{"/dir": []string{dataprovider.PermAny}, "/dir/": []string{dataprovider.PermAny}}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with duplicated dir permissions: %v", err)
+	}
+}
+
+func TestAddUserInvalidVirtualFolders(t *testing.T) {
+	u := getTestUser()
+	mappedPath := filepath.Join(os.TempDir(), "vdir")
+	invalidFolders := [][]dataprovider.VirtualFolder{
+		[]dataprovider.VirtualFolder{dataprovider.VirtualFolder{VirtualPath: "vdir", MappedPath: mappedPath}},
+		[]dataprovider.VirtualFolder{dataprovider.VirtualFolder{VirtualPath: "/", MappedPath: mappedPath}},
+		[]dataprovider.VirtualFolder{dataprovider.VirtualFolder{VirtualPath: "/vdir", MappedPath: "relative"}},
+		[]dataprovider.VirtualFolder{dataprovider.VirtualFolder{VirtualPath: "/vdir", MappedPath: u.HomeDir}},
+		[]dataprovider.VirtualFolder{dataprovider.VirtualFolder{VirtualPath: "/vdir", MappedPath: filepath.Join(u.HomeDir, "sub")}},
+		[]dataprovider.VirtualFolder{dataprovider.VirtualFolder{VirtualPath: "/vdir", MappedPath: filepath.Dir(u.HomeDir)}},
+		[]dataprovider.VirtualFolder{
+			dataprovider.VirtualFolder{VirtualPath: "/vdir", MappedPath: mappedPath},
+			dataprovider.VirtualFolder{VirtualPath: "/vdir/sub", MappedPath: mappedPath + "1"},
+		},
+		[]dataprovider.VirtualFolder{
+			dataprovider.VirtualFolder{VirtualPath: "/vdir", MappedPath: mappedPath},
+			dataprovider.VirtualFolder{VirtualPath: "/vdir1", MappedPath: filepath.Join(mappedPath, "sub")},
+		},
+		[]dataprovider.VirtualFolder{
+			dataprovider.VirtualFolder{VirtualPath: "/vdir", MappedPath: mappedPath, Permissions: []string{"invalidPerm"}},
+		},
+	}
+	for _, folders := range invalidFolders {
+		u.VirtualFolders = folders
+		_, err := api.AddUser(u, http.StatusBadRequest)
+		if err != nil {
+			t.Errorf("unexpected error adding user with invalid virtual folders %+v: %v", folders, err)
+		}
+	}
+}
+
+func TestAddUserInvalidFsProvider(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.Provider = "invalid"
+	_, err := api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid filesystem provider: %v", err)
+	}
+}
+
+func TestAddUserInvalidS3Config(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.Provider = dataprovider.S3FilesystemProvider
+	u.FsConfig.S3Config = vfs.S3FsConfig{
+		Region:       "us-east-1",
+		AccessKey:    "access-key",
+		AccessSecret: "access-secret",
+	}
+	_, err := api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with empty S3 bucket: %v", err)
+	}
+	u.FsConfig.S3Config.Bucket = "bucket"
+	u.FsConfig.S3Config.Region = ""
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with empty S3 region: %v", err)
+	}
+	u.FsConfig.S3Config.Region = "us-east-1"
+	u.FsConfig.S3Config.AccessSecret = ""
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with S3 access key and without access secret: %v", err)
+	}
+	u.FsConfig.S3Config.AccessSecret = "access-secret"
+	u.FsConfig.S3Config.UploadPartSize = 1
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid S3 upload part size: %v", err)
+	}
+	u.FsConfig.S3Config.UploadPartSize = 0
+	u.FsConfig.S3Config.KeyPrefix = "../prefix"
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid S3 key prefix: %v", err)
+	}
+	u.FsConfig.S3Config.KeyPrefix = ""
+	u.VirtualFolders = []dataprovider.VirtualFolder{
+		dataprovider.VirtualFolder{
+			VirtualPath: "/vdir",
+			MappedPath:  filepath.Join(os.TempDir(), "vdir"),
+		},
+	}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding S3 user with virtual folders: %v", err)
+	}
+}
+
+func TestS3UserSecret(t *testing.T) {
+	u := getTestUser()
+	u.FsConfig.Provider = dataprovider.S3FilesystemProvider
+	u.FsConfig.S3Config = vfs.S3FsConfig{
+		Bucket:         "bucket",
+		KeyPrefix:      "/users/test",
+		Region:         "us-east-1",
+		AccessKey:      "access-key",
+		AccessSecret:   "access-secret",
+		Endpoint:       "http://127.0.0.1:9000",
+		UploadPartSize: 10,
+	}
+	user, err := api.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add S3 user: %v", err)
+	}
+	if user.FsConfig.S3Config.KeyPrefix != "users/test/" {
+		t.Errorf("the S3 key prefix must be normalized: %#v", user.FsConfig.S3Config.KeyPrefix)
+	}
+	dbUser, err := dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil {
+		t.Errorf("unable to get user from the data provider: %v", err)
+	}
+	storedSecret := dbUser.FsConfig.S3Config.AccessSecret
+	if !strings.HasPrefix(storedSecret, "$aesgcm$") || strings.Contains(storedSecret, "access-secret") {
+		t.Errorf("the S3 access secret must be stored encrypted: %#v", storedSecret)
+	}
+	user.FsConfig.S3Config.StorageClass = "STANDARD_IA"
+	user, err = api.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update S3 user: %v", err)
+	}
+	dbUser, err = dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil || dbUser.FsConfig.S3Config.AccessSecret != storedSecret {
+		t.Errorf("the S3 access secret must be preserved if not included in the update, err: %v", err)
+	}
+	if _, err = dbUser.GetFilesystem(); err != nil {
+		t.Errorf("unable to get the filesystem using the encrypted S3 access secret: %v", err)
+	}
+	dbUser.FsConfig.S3Config.AccessSecret = "$aesgcm$invalid"
+	if _, err = dbUser.GetFilesystem(); err == nil {
+		t.Errorf("getting the filesystem with an invalid encrypted S3 access secret must fail")
+	}
+	err = api.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+}
+
+func TestAddUserInvalidAuthMethods(t *testing.T) {
+	u := getTestUser()
+	u.Filters.RequiredAuthMethods = []string{"password,invalid"}
+	_, err := api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid auth methods: %v", err)
+	}
+	u.Filters.RequiredAuthMethods = []string{"password,password"}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with duplicated auth methods: %v", err)
+	}
+	u.Filters.RequiredAuthMethods = []string{""}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with empty auth methods: %v", err)
+	}
+}
+
+func TestAddUserInvalidMaxUploadFileSize(t *testing.T) {
+	u := getTestUser()
+	u.Filters.MaxUploadFileSize = -1
+	_, err := api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid max upload file size: %v", err)
+	}
+}
+
+func TestAddUserInvalidFilePatterns(t *testing.T) {
+	u := getTestUser()
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		dataprovider.PatternsFilter{
+			Path:            "relative",
+			AllowedPatterns: []string{"*.jpg"},
+		},
+	}
+	_, err := api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with file patterns for a relative path: %v", err)
+	}
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		dataprovider.PatternsFilter{
+			Path:            "/dir",
+			AllowedPatterns: []string{"*.jpg"},
+		},
+		dataprovider.PatternsFilter{
+			Path:           "/dir/",
+			DeniedPatterns: []string{"*.exe"},
+		},
+	}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with duplicated file patterns: %v", err)
+	}
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		dataprovider.PatternsFilter{
+			Path: "/dir",
+		},
+	}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with empty file patterns: %v", err)
+	}
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		dataprovider.PatternsFilter{
+			Path:            "/dir",
+			AllowedPatterns: []string{"[a-"},
+		},
+	}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with an invalid file pattern: %v", err)
+	}
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		dataprovider.PatternsFilter{
+			Path:           "/dir",
+			DeniedPatterns: []string{"sub/*.exe"},
+		},
+	}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with a file pattern containing a path separator: %v", err)
+	}
+}
+
+func TestAddUserInvalidIPFilters(t *testing.T) {
+	u := getTestUser()
+	u.Filters.AllowedIP = []string{"192.168.1.0/24", "192.168.2.0"}
+	_, err := api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid allowed IP: %v", err)
+	}
+	u.Filters.AllowedIP = []string{}
+	u.Filters.DeniedIP = []string{"invalid"}
+	_, err = api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid denied IP: %v", err)
+	}
+}
+
+func TestAddUserInvalidPubKey(t *testing.T) {
+	u := getTestUser()
+	u.PublicKeys = []string{testPubKey, "invalid"}
+	_, err := api.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid public key: %v", err)
+	}
+}
+
+func TestUserPublicKeys(t *testing.T) {
+	u := getTestUser()
+	u.PublicKeys = []string{testPubKey}
+	user, err := api.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	err = api.AddUserPublicKey(user, testPubKey1, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add public key: %v", err)
+	}
+	err = api.AddUserPublicKey(user, testPubKey1, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding a duplicate public key: %v", err)
+	}
+	err = api.AddUserPublicKey(user, "invalid key", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding an invalid public key: %v", err)
+	}
+	pubKey, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(testPubKey))
+	err = api.RemoveUserPublicKey(user, ssh.FingerprintSHA256(pubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove public key: %v", err)
+	}
+	err = api.RemoveUserPublicKey(user, ssh.FingerprintSHA256(pubKey), http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error removing a missing public key: %v", err)
+	}
+	err = api.RemoveUserPublicKey(user, "", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error removing a public key without fingerprint: %v", err)
+	}
+	err = api.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	err = api.AddUserPublicKey(user, testPubKey, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error adding a public key to a missing user: %v", err)
+	}
+	err = api.RemoveUserPublicKey(user, ssh.FingerprintSHA256(pubKey), http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error removing a public key from a missing user: %v", err)
+	}
+}
+
+func TestUserTOTP(t *testing.T) {
+	now := time.Now()
+	dataprovider.SetTOTPClock(func() time.Time {
+		return now
+	})
+	defer dataprovider.SetTOTPClock(nil)
+	user, err := api.AddUser(getTestUser(), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	err = api.VerifyUserTOTP(user, "123456", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error verifying TOTP for a not enrolled user: %v", err)
+	}
+	secret, err := api.EnrollUserTOTP(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to enroll TOTP: %v", err)
+	}
+	code, err := utils.GetTOTPCode(secret, now)
+	if err != nil {
+		t.Errorf("unable to generate TOTP code: %v", err)
+	}
+	invalidCode, _ := utils.GetTOTPCode(secret, now.Add(-10*time.Minute))
+	if invalidCode != code {
+		err = api.VerifyUserTOTP(user, invalidCode, http.StatusBadRequest)
+		if err != nil {
+			t.Errorf("unexpected error verifying an invalid TOTP code: %v", err)
+		}
+	}
+	user, err = api.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if user.TOTPConfig.Enabled || len(user.TOTPConfig.Secret) > 0 {
+		t.Errorf("TOTP must be disabled before verification and the secret must not be visible")
+	}
+	err = api.VerifyUserTOTP(user, code, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to verify TOTP: %v", err)
+	}
+	user, err = api.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if !user.TOTPConfig.Enabled {
+		t.Errorf("TOTP must be enabled after verification")
+	}
+	// TOTP configuration cannot be changed updating the user
+	user.TOTPConfig.Enabled = false
+	_, err = api.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	user, err = api.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if !user.TOTPConfig.Enabled {
+		t.Errorf("TOTP must not be disabled updating the user")
+	}
+	err = api.ResetUserTOTP(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to reset TOTP: %v", err)
+	}
+	user, err = api.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if user.TOTPConfig.Enabled {
+		t.Errorf("TOTP must be disabled after reset")
+	}
+	err = api.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	_, err = api.EnrollUserTOTP(user, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error enrolling TOTP for a missing user: %v", err)
+	}
+	err = api.VerifyUserTOTP(user, code, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error verifying TOTP for a missing user: %v", err)
+	}
+	err = api.ResetUserTOTP(user, http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error resetting TOTP for a missing user: %v", err)
+	}
+}
+
 func TestUpdateUserNoCredentials(t *testing.T) {
 	user, err := api.AddUser(getTestUser(), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
 	user.Password = ""
-	user.PublicKey = ""
-	// password and public key will be omitted from json serialization if empty and so they will remain unchanged
+	user.PublicKeys = nil
+	// password and public keys will be omitted from json serialization if empty and so they will remain unchanged
 	// and no validation error will be raised
 	_, err = api.UpdateUser(user, http.StatusOK)
 	if err != nil {
@@ -338,6 +803,41 @@ func TestGetQuotaScans(t *testing.T) {
 	}
 }
 
+func TestGetHostKeys(t *testing.T) {
+	_, err := api.GetHostKeys(http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get host keys: %v", err)
+	}
+}
+
+func TestGetConnectionsStats(t *testing.T) {
+	stats, err := api.GetConnectionsStats(http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get connections stats: %v", err)
+	}
+	if stats.OpenConnections < 0 || stats.RejectedConnections != 0 || stats.RejectedConnectionsPerIP != 0 {
+		t.Errorf("unexpected connections stats: %+v", stats)
+	}
+}
+
+func TestDefenderHosts(t *testing.T) {
+	hosts, err := api.GetBannedHosts(http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get banned hosts: %v", err)
+	}
+	if len(hosts) != 0 {
+		t.Errorf("no host can be banned with the defender disabled: %+v", hosts)
+	}
+	err = api.UnbanHost("127.0.0.1", http.StatusNotFound)
+	if err != nil {
+		t.Errorf("unexpected error unbanning a not banned host: %v", err)
+	}
+	err = api.UnbanHost("invalid ip", http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error unbanning an invalid ip: %v", err)
+	}
+}
+
 func TestStartQuotaScan(t *testing.T) {
 	user, err := api.AddUser(getTestUser(), http.StatusOK)
 	if err != nil {
@@ -485,6 +985,33 @@ func TestUpdateUserInvalidParamsMock(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, rr.Code)
 }
 
+func TestUserPublicKeysInvalidParamsMock(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, userPath+"/a/public_keys", bytes.NewBuffer([]byte("{}")))
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodPost, userPath+"/1/public_keys", bytes.NewBuffer([]byte("invalid json")))
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodDelete, userPath+"/a/public_keys?fingerprint=SHA256:abc", nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestUserTOTPInvalidParamsMock(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, userPath+"/a/totp/enroll", nil)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodPost, userPath+"/a/totp/verify", bytes.NewBuffer([]byte("{}")))
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodPost, userPath+"/1/totp/verify", bytes.NewBuffer([]byte("invalid json")))
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+	req, _ = http.NewRequest(http.MethodDelete, userPath+"/a/totp", nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, rr.Code)
+}
+
 func TestGetUsersMock(t *testing.T) {
 	user := getTestUser()
 	userAsJSON := getUserAsJSON(t, user)
@@ -614,6 +1141,51 @@ func TestDeleteActiveConnectionMock(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, rr.Code)
 }
 
+func TestGetHostKeysMock(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, hostKeysPath, nil)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+}
+
+func TestGetConnectionsStatsMock(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, connectionsStatsPath, nil)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+}
+
+func TestReloadConfig(t *testing.T) {
+	err := api.ReloadConfig(http.StatusNotImplemented)
+	if err != nil {
+		t.Errorf("unexpected error reloading the configuration: %v", err)
+	}
+}
+
+func TestReloadConfigMock(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, reloadConfigPath, nil)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusNotImplemented, rr.Code)
+	api.SetConfigReloader(func() error {
+		return errors.New("invalid configuration")
+	})
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusInternalServerError, rr.Code)
+	api.SetConfigReloader(func() error {
+		return nil
+	})
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	api.SetConfigReloader(nil)
+}
+
+func TestDefenderHostsMock(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, defenderHostsPath, nil)
+	rr := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rr.Code)
+	req, _ = http.NewRequest(http.MethodDelete, defenderHostsPath+"/::1", nil)
+	rr = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, rr.Code)
+}
+
 func TestNotFoundMock(t *testing.T) {
 	req, _ := http.NewRequest(http.MethodGet, "/non/existing/path", nil)
 	rr := executeRequest(req)
@@ -8,12 +8,15 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 	"github.com/go-chi/render"
 )
 
@@ -150,6 +153,91 @@ func GetUsers(limit int64, offset int64, username string, expectedStatusCode int
 	return users, err
 }
 
+// AddUserPublicKey adds a public key to an existing user and checks the received HTTP Status code against expectedStatusCode.
+func AddUserPublicKey(user dataprovider.User, publicKey string, expectedStatusCode int) error {
+	reqAsJSON, err := json.Marshal(map[string]string{"public_key": publicKey})
+	if err != nil {
+		return err
+	}
+	resp, err := getHTTPClient().Post(httpBaseURL+userPath+"/"+strconv.FormatInt(user.ID, 10)+"/public_keys",
+		"application/json", bytes.NewBuffer(reqAsJSON))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp.StatusCode, expectedStatusCode, resp)
+}
+
+// RemoveUserPublicKey removes the public key with the given SHA256 fingerprint from an existing user and checks
+// the received HTTP Status code against expectedStatusCode.
+func RemoveUserPublicKey(user dataprovider.User, fingerprint string, expectedStatusCode int) error {
+	url, err := url.Parse(httpBaseURL + userPath + "/" + strconv.FormatInt(user.ID, 10) + "/public_keys")
+	if err != nil {
+		return err
+	}
+	q := url.Query()
+	q.Add("fingerprint", fingerprint)
+	url.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodDelete, url.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := getHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp.StatusCode, expectedStatusCode, resp)
+}
+
+// EnrollUserTOTP generates a new TOTP secret for an existing user and checks the received HTTP Status code
+// against expectedStatusCode. The returned secret is base32 encoded
+func EnrollUserTOTP(user dataprovider.User, expectedStatusCode int) (string, error) {
+	var enrollment totpEnrollResponse
+	resp, err := getHTTPClient().Post(httpBaseURL+userPath+"/"+strconv.FormatInt(user.ID, 10)+"/totp/enroll",
+		"application/json", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode, resp)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &enrollment)
+	}
+	return enrollment.Secret, err
+}
+
+// VerifyUserTOTP verifies the enrolled TOTP secret for an existing user using the given code and checks
+// the received HTTP Status code against expectedStatusCode.
+func VerifyUserTOTP(user dataprovider.User, code string, expectedStatusCode int) error {
+	reqAsJSON, err := json.Marshal(map[string]string{"code": code})
+	if err != nil {
+		return err
+	}
+	resp, err := getHTTPClient().Post(httpBaseURL+userPath+"/"+strconv.FormatInt(user.ID, 10)+"/totp/verify",
+		"application/json", bytes.NewBuffer(reqAsJSON))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp.StatusCode, expectedStatusCode, resp)
+}
+
+// ResetUserTOTP removes the TOTP configuration for an existing user and checks the received HTTP Status code
+// against expectedStatusCode.
+func ResetUserTOTP(user dataprovider.User, expectedStatusCode int) error {
+	req, err := http.NewRequest(http.MethodDelete, httpBaseURL+userPath+"/"+strconv.FormatInt(user.ID, 10)+"/totp", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := getHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp.StatusCode, expectedStatusCode, resp)
+}
+
 // GetQuotaScans gets active quota scans and checks the received HTTP Status code against expectedStatusCode.
 func GetQuotaScans(expectedStatusCode int) ([]sftpd.ActiveQuotaScan, error) {
 	var quotaScans []sftpd.ActiveQuotaScan
@@ -179,6 +267,75 @@ func StartQuotaScan(user dataprovider.User, expectedStatusCode int) error {
 	return checkResponse(resp.StatusCode, expectedStatusCode, resp)
 }
 
+// GetHostKeys gets the host keys used by the SFTP server and checks the received HTTP Status code against expectedStatusCode.
+func GetHostKeys(expectedStatusCode int) ([]sftpd.HostKey, error) {
+	var hostKeys []sftpd.HostKey
+	resp, err := getHTTPClient().Get(httpBaseURL + hostKeysPath)
+	if err != nil {
+		return hostKeys, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode, resp)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &hostKeys)
+	}
+	return hostKeys, err
+}
+
+// GetConnectionsStats returns the network connections counters and checks the received HTTP Status code against expectedStatusCode.
+func GetConnectionsStats(expectedStatusCode int) (sftpd.NetConnectionsStats, error) {
+	var stats sftpd.NetConnectionsStats
+	resp, err := getHTTPClient().Get(httpBaseURL + connectionsStatsPath)
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode, resp)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &stats)
+	}
+	return stats, err
+}
+
+// ReloadConfig asks the server to reload its configuration and checks the received HTTP Status code against expectedStatusCode.
+func ReloadConfig(expectedStatusCode int) error {
+	resp, err := getHTTPClient().Post(httpBaseURL+reloadConfigPath, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp.StatusCode, expectedStatusCode, resp)
+}
+
+// GetBannedHosts returns the hosts banned by the defender and checks the received HTTP Status code against expectedStatusCode.
+func GetBannedHosts(expectedStatusCode int) ([]sftpd.BannedHost, error) {
+	var hosts []sftpd.BannedHost
+	resp, err := getHTTPClient().Get(httpBaseURL + defenderHostsPath)
+	if err != nil {
+		return hosts, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode, resp)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &hosts)
+	}
+	return hosts, err
+}
+
+// UnbanHost removes the ban for the given IP and checks the received HTTP Status code against expectedStatusCode.
+func UnbanHost(ip string, expectedStatusCode int) error {
+	req, err := http.NewRequest(http.MethodDelete, httpBaseURL+defenderHostsPath+"/"+url.PathEscape(ip), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := getHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp.StatusCode, expectedStatusCode, resp)
+}
+
 func checkResponse(actual int, expected int, resp *http.Response) error {
 	if expected != actual {
 		return fmt.Errorf("wrong status code: got %v want %v", actual, expected)
@@ -196,8 +353,14 @@ func checkUser(expected dataprovider.User, actual dataprovider.User) error {
 	if len(actual.Password) > 0 {
 		return errors.New("User password must not be visible")
 	}
-	if len(actual.PublicKey) > 0 {
-		return errors.New("User public key must not be visible")
+	if len(actual.PublicKeys) > 0 {
+		return errors.New("User public keys must not be visible")
+	}
+	if len(actual.TOTPConfig.Secret) > 0 {
+		return errors.New("User TOTP secret must not be visible")
+	}
+	if len(actual.FsConfig.S3Config.AccessSecret) > 0 {
+		return errors.New("User S3 access secret must not be visible")
 	}
 	if expected.ID <= 0 {
 		if actual.ID <= 0 {
@@ -213,9 +376,52 @@ func checkUser(expected dataprovider.User, actual dataprovider.User) error {
 			return errors.New("Permissions contents mismatch")
 		}
 	}
+	if len(expected.DirPermissions) != len(actual.DirPermissions) {
+		return errors.New("Directory permissions mismatch")
+	}
+	if expected.FsConfig.Provider != actual.FsConfig.Provider {
+		return errors.New("Filesystem provider mismatch")
+	}
+	if err := compareS3Config(expected.FsConfig.S3Config, actual.FsConfig.S3Config); err != nil {
+		return err
+	}
+	if len(expected.VirtualFolders) != len(actual.VirtualFolders) {
+		return errors.New("Virtual folders mismatch")
+	}
+	for i, folder := range expected.VirtualFolders {
+		actualFolder := actual.VirtualFolders[i]
+		if folder.VirtualPath != actualFolder.VirtualPath || folder.MappedPath != actualFolder.MappedPath ||
+			folder.ExcludeFromQuota != actualFolder.ExcludeFromQuota || len(folder.Permissions) != len(actualFolder.Permissions) {
+			return errors.New("Virtual folders mismatch")
+		}
+	}
+	for dir, perms := range expected.DirPermissions {
+		actualPerms, ok := actual.DirPermissions[dir]
+		if !ok || len(perms) != len(actualPerms) {
+			return errors.New("Directory permissions mismatch")
+		}
+		for _, v := range perms {
+			if !utils.IsStringInSlice(v, actualPerms) {
+				return errors.New("Directory permissions contents mismatch")
+			}
+		}
+	}
 	return compareEqualsUserFields(expected, actual)
 }
 
+func compareS3Config(expected vfs.S3FsConfig, actual vfs.S3FsConfig) error {
+	if expected.Bucket != actual.Bucket || expected.Region != actual.Region || expected.AccessKey != actual.AccessKey ||
+		expected.Endpoint != actual.Endpoint || expected.StorageClass != actual.StorageClass ||
+		expected.UploadPartSize != actual.UploadPartSize {
+		return errors.New("S3 config mismatch")
+	}
+	// the key prefix is normalized
+	if strings.Trim(expected.KeyPrefix, "/") != strings.Trim(actual.KeyPrefix, "/") {
+		return errors.New("S3 key prefix mismatch")
+	}
+	return nil
+}
+
 func compareEqualsUserFields(expected dataprovider.User, actual dataprovider.User) error {
 	if expected.Username != actual.Username {
 		return errors.New("Username mismatch")
@@ -247,5 +453,65 @@ func compareEqualsUserFields(expected dataprovider.User, actual dataprovider.Use
 	if expected.DownloadBandwidth != actual.DownloadBandwidth {
 		return errors.New("DownloadBandwidth mismatch")
 	}
+	if len(expected.Filters.RequiredAuthMethods) != len(actual.Filters.RequiredAuthMethods) {
+		return errors.New("RequiredAuthMethods mismatch")
+	}
+	for _, v := range expected.Filters.RequiredAuthMethods {
+		if !utils.IsStringInSlice(v, actual.Filters.RequiredAuthMethods) {
+			return errors.New("RequiredAuthMethods contents mismatch")
+		}
+	}
+	if expected.Filters.MaxUploadFileSize != actual.Filters.MaxUploadFileSize {
+		return errors.New("MaxUploadFileSize mismatch")
+	}
+	if len(expected.Filters.AllowedIP) != len(actual.Filters.AllowedIP) {
+		return errors.New("AllowedIP mismatch")
+	}
+	for _, v := range expected.Filters.AllowedIP {
+		if !utils.IsStringInSlice(v, actual.Filters.AllowedIP) {
+			return errors.New("AllowedIP contents mismatch")
+		}
+	}
+	if len(expected.Filters.DeniedIP) != len(actual.Filters.DeniedIP) {
+		return errors.New("DeniedIP mismatch")
+	}
+	for _, v := range expected.Filters.DeniedIP {
+		if !utils.IsStringInSlice(v, actual.Filters.DeniedIP) {
+			return errors.New("DeniedIP contents mismatch")
+		}
+	}
+	return compareUserFilePatterns(expected, actual)
+}
+
+func compareUserFilePatterns(expected dataprovider.User, actual dataprovider.User) error {
+	if len(expected.Filters.FilePatterns) != len(actual.Filters.FilePatterns) {
+		return errors.New("FilePatterns mismatch")
+	}
+	for _, f := range expected.Filters.FilePatterns {
+		found := false
+		for _, f1 := range actual.Filters.FilePatterns {
+			if path.Clean(f.Path) != f1.Path {
+				continue
+			}
+			if len(f.AllowedPatterns) != len(f1.AllowedPatterns) || len(f.DeniedPatterns) != len(f1.DeniedPatterns) ||
+				f.HideDenied != f1.HideDenied {
+				return errors.New("FilePatterns contents mismatch")
+			}
+			for _, p := range f.AllowedPatterns {
+				if !utils.IsStringInSlice(strings.ToLower(strings.TrimSpace(p)), f1.AllowedPatterns) {
+					return errors.New("FilePatterns allowed patterns mismatch")
+				}
+			}
+			for _, p := range f.DeniedPatterns {
+				if !utils.IsStringInSlice(strings.ToLower(strings.TrimSpace(p)), f1.DeniedPatterns) {
+					return errors.New("FilePatterns denied patterns mismatch")
+				}
+			}
+			found = true
+		}
+		if !found {
+			return errors.New("FilePatterns path mismatch")
+		}
+	}
 	return nil
 }
@@ -6,7 +6,7 @@ import (
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
-	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 	"github.com/go-chi/render"
 )
 
@@ -29,16 +29,39 @@ func startQuotaScan(w http.ResponseWriter, r *http.Request) {
 	if sftpd.AddQuotaScan(user.Username) {
 		sendAPIResponse(w, r, err, "Scan started", http.StatusCreated)
 		go func() {
-			numFiles, size, _, err := utils.ScanDirContents(user.HomeDir)
-			if err != nil {
-				logger.Warn(logSender, "error scanning user home dir %v: %v", user.HomeDir, err)
-			} else {
-				err := dataprovider.UpdateUserQuota(dataProvider, user, numFiles, size, true)
-				logger.Debug(logSender, "user dir scanned, user: %v, dir: %v, error: %v", user.Username, user.HomeDir, err)
-			}
+			doQuotaScan(user)
 			sftpd.RemoveQuotaScan(user.Username)
 		}()
 	} else {
 		sendAPIResponse(w, r, err, "Another scan is already in progress", http.StatusConflict)
 	}
 }
+
+// doQuotaScan scans the user home dir and the virtual folders included in the user quota
+func doQuotaScan(user dataprovider.User) {
+	fs, err := user.GetFilesystem()
+	if err != nil {
+		logger.Warn(logSender, "unable to create the filesystem for user %v: %v", user.Username, err)
+		return
+	}
+	numFiles, size, _, err := vfs.ScanDirContents(fs, user.HomeDir)
+	if err != nil {
+		logger.Warn(logSender, "error scanning user home dir %v: %v", user.HomeDir, err)
+		return
+	}
+	for _, folder := range user.VirtualFolders {
+		if folder.ExcludeFromQuota {
+			continue
+		}
+		folderFiles, folderSize, _, err := vfs.ScanDirContents(fs, folder.MappedPath)
+		if err != nil {
+			logger.Warn(logSender, "error scanning virtual folder %v, mapped path: %v: %v", folder.VirtualPath,
+				folder.MappedPath, err)
+			return
+		}
+		numFiles += folderFiles
+		size += folderSize
+	}
+	err = dataprovider.UpdateUserQuota(dataProvider, user, numFiles, size, true)
+	logger.Debug(logSender, "user dir scanned, user: %v, dir: %v, error: %v", user.Username, user.HomeDir, err)
+}
@@ -1,6 +1,8 @@
 package api
 
 import (
+	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/drakkan/sftpgo/logger"
@@ -47,6 +49,35 @@ func initializeRouter() {
 		}
 	})
 
+	router.Get(connectionsStatsPath, func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, sftpd.GetNetConnectionsStats())
+	})
+
+	router.Get(hostKeysPath, func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, sftpd.GetHostKeys())
+	})
+
+	router.Get(defenderHostsPath, func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, sftpd.GetBannedHosts())
+	})
+
+	router.Delete(defenderHostsPath+"/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		ip := chi.URLParam(r, "ip")
+		if net.ParseIP(ip) == nil {
+			sendAPIResponse(w, r, nil, fmt.Sprintf("Invalid IP address: %#v", ip), http.StatusBadRequest)
+			return
+		}
+		if sftpd.UnbanHost(ip) {
+			sendAPIResponse(w, r, nil, "Host unbanned", http.StatusOK)
+		} else {
+			sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		}
+	})
+
+	router.Post(reloadConfigPath, func(w http.ResponseWriter, r *http.Request) {
+		reloadConfig(w, r)
+	})
+
 	router.Get(quotaScanPath, func(w http.ResponseWriter, r *http.Request) {
 		getQuotaScans(w, r)
 	})
@@ -74,4 +105,24 @@ func initializeRouter() {
 	router.Delete(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
 		deleteUser(w, r)
 	})
+
+	router.Post(userPath+"/{userID}/public_keys", func(w http.ResponseWriter, r *http.Request) {
+		addUserPublicKey(w, r)
+	})
+
+	router.Delete(userPath+"/{userID}/public_keys", func(w http.ResponseWriter, r *http.Request) {
+		removeUserPublicKey(w, r)
+	})
+
+	router.Post(userPath+"/{userID}/totp/enroll", func(w http.ResponseWriter, r *http.Request) {
+		enrollUserTOTP(w, r)
+	})
+
+	router.Post(userPath+"/{userID}/totp/verify", func(w http.ResponseWriter, r *http.Request) {
+		verifyUserTOTP(w, r)
+	})
+
+	router.Delete(userPath+"/{userID}/totp", func(w http.ResponseWriter, r *http.Request) {
+		resetUserTOTP(w, r)
+	})
 }
@@ -9,8 +9,22 @@ import (
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
+	"golang.org/x/crypto/ssh"
 )
 
+type publicKeyRequest struct {
+	PublicKey string `json:"public_key"`
+}
+
+type totpEnrollResponse struct {
+	Secret string `json:"secret"`
+	URL    string `json:"url"`
+}
+
+type totpVerifyRequest struct {
+	Code string `json:"code"`
+}
+
 func getUsers(w http.ResponseWriter, r *http.Request) {
 	limit := 100
 	offset := 0
@@ -65,7 +79,9 @@ func getUserByID(w http.ResponseWriter, r *http.Request) {
 	user, err := dataprovider.GetUserByID(dataProvider, userID)
 	if err == nil {
 		user.Password = ""
-		user.PublicKey = ""
+		user.PublicKeys = nil
+		user.TOTPConfig.Secret = ""
+		user.FsConfig.S3Config.AccessSecret = ""
 		render.JSON(w, r, user)
 	} else if err == sql.ErrNoRows {
 		sendAPIResponse(w, r, err, "", http.StatusNotFound)
@@ -81,12 +97,16 @@ func addUser(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
+	// TOTP can only be configured using the dedicated API
+	user.TOTPConfig = dataprovider.UserTOTPConfig{}
 	err = dataprovider.AddUser(dataProvider, user)
 	if err == nil {
 		user, err = dataprovider.UserExists(dataProvider, user.Username)
 		if err == nil {
 			user.Password = ""
-			user.PublicKey = ""
+			user.PublicKeys = nil
+			user.TOTPConfig.Secret = ""
+			user.FsConfig.S3Config.AccessSecret = ""
 			render.JSON(w, r, user)
 		} else {
 			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
@@ -111,11 +131,25 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
 		return
 	}
+	totpConfig := user.TOTPConfig
+	// the directory permissions are replaced as a whole, decoding into the existing map would merge
+	// the entries and a permission could never be revoked
+	user.DirPermissions = nil
+	// the virtual folders are omitted from the request if empty, so they must be reset or the last
+	// one could never be removed
+	user.VirtualFolders = nil
+	// the filters are replaced as a whole, otherwise the omitted empty lists, for example
+	// an empty allowed_ip, would keep their previous values
+	user.Filters = dataprovider.UserFilters{}
+	// the S3 access secret is not returned to the clients, the request is decoded into the stored
+	// user so the existing one is preserved if the request does not include it
 	err = render.DecodeJSON(r.Body, &user)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
+	// TOTP can only be configured using the dedicated API
+	user.TOTPConfig = totpConfig
 	if user.ID != userID {
 		sendAPIResponse(w, r, err, "user ID in request body does not match user ID in path parameter", http.StatusBadRequest)
 		return
@@ -150,3 +184,165 @@ func deleteUser(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "User deleted", http.StatusOK)
 	}
 }
+
+func addUserPublicKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	var req publicKeyRequest
+	err = render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		sendAPIResponse(w, r, err, "Invalid public key", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(dataProvider, userID)
+	if err == sql.ErrNoRows {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	if getPublicKeyIndex(user, ssh.FingerprintSHA256(pubKey)) >= 0 {
+		sendAPIResponse(w, r, errors.New("Public key already exists"), "", http.StatusBadRequest)
+		return
+	}
+	user.PublicKeys = append(user.PublicKeys, req.PublicKey)
+	err = dataprovider.UpdateUser(dataProvider, user)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Public key added", http.StatusOK)
+	}
+}
+
+func removeUserPublicKey(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	fingerprint := r.URL.Query().Get("fingerprint")
+	if len(fingerprint) == 0 {
+		sendAPIResponse(w, r, errors.New("fingerprint is mandatory"), "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(dataProvider, userID)
+	if err == sql.ErrNoRows {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	idx := getPublicKeyIndex(user, fingerprint)
+	if idx < 0 {
+		sendAPIResponse(w, r, errors.New("Public key not found"), "", http.StatusNotFound)
+		return
+	}
+	user.PublicKeys = append(user.PublicKeys[:idx], user.PublicKeys[idx+1:]...)
+	err = dataprovider.UpdateUser(dataProvider, user)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Public key removed", http.StatusOK)
+	}
+}
+
+func enrollUserTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(dataProvider, userID)
+	if err == sql.ErrNoRows {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	secret, url, err := dataprovider.EnrollUserTOTP(dataProvider, user)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	render.JSON(w, r, totpEnrollResponse{
+		Secret: secret,
+		URL:    url,
+	})
+}
+
+func verifyUserTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	var req totpVerifyRequest
+	err = render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(dataProvider, userID)
+	if err == sql.ErrNoRows {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	err = dataprovider.VerifyUserTOTP(dataProvider, user, req.Code)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "TOTP enabled", http.StatusOK)
+	}
+}
+
+func resetUserTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid userID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	user, err := dataprovider.GetUserByID(dataProvider, userID)
+	if err == sql.ErrNoRows {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	err = dataprovider.ResetUserTOTP(dataProvider, user)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "TOTP reset", http.StatusOK)
+	}
+}
+
+// getPublicKeyIndex returns the index of the user's public key with the given SHA256 fingerprint or -1 if not found
+func getPublicKeyIndex(user dataprovider.User, fingerprint string) int {
+	for i, k := range user.PublicKeys {
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err == nil && ssh.FingerprintSHA256(pubKey) == fingerprint {
+			return i
+		}
+	}
+	return -1
+}
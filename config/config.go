@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/drakkan/sftpgo/api"
 	"github.com/drakkan/sftpgo/dataprovider"
@@ -23,6 +24,9 @@ const (
 
 var (
 	globalConf globalConfig
+	confMutex  sync.RWMutex
+	// serializes the configuration reloads
+	reloadMutex sync.Mutex
 )
 
 type globalConfig struct {
@@ -33,7 +37,11 @@ type globalConfig struct {
 
 func init() {
 	// create a default configuration to use if no config file is provided
-	globalConf = globalConfig{
+	globalConf = getDefaultConfig()
+}
+
+func getDefaultConfig() globalConfig {
+	return globalConfig{
 		SFTPD: sftpd.Configuration{
 			Banner:       defaultBanner,
 			BindPort:     2022,
@@ -46,19 +54,45 @@ func init() {
 				Command:             "",
 				HTTPNotificationURL: "",
 			},
+			EnableSCP:               false,
+			EnabledSSHCommands:      []string{},
+			HostKeys:                []string{},
+			TrustedUserCAKeys:       []string{},
+			RevokedUserCertsFile:    "",
+			UploadMode:              0,
+			PartialUploadPolicy:     0,
+			MaxListEntries:          0,
+			HidePatterns:            []string{},
+			MaxConnections:          0,
+			MaxConnectionsPerIP:     0,
+			GracefulShutdownTimeout: 30,
+			Defender: sftpd.DefenderConfig{
+				Enabled:         false,
+				BanTime:         30,
+				ObservationTime: 30,
+				Threshold:       15,
+				ScoreInvalid:    2,
+				ScoreValid:      1,
+				ScoreHandshake:  1,
+				BanListFile:     "",
+			},
 		},
 		ProviderConf: dataprovider.Config{
-			Driver:           "sqlite",
-			Name:             "sftpgo.db",
-			Host:             "",
-			Port:             5432,
-			Username:         "",
-			Password:         "",
-			ConnectionString: "",
-			UsersTable:       "users",
-			ManageUsers:      1,
-			SSLMode:          0,
-			TrackQuota:       1,
+			Driver:                "sqlite",
+			Name:                  "sftpgo.db",
+			Host:                  "",
+			Port:                  5432,
+			Username:              "",
+			Password:              "",
+			ConnectionString:      "",
+			UsersTable:            "users",
+			ManageUsers:           1,
+			SSLMode:               0,
+			TrackQuota:            1,
+			SecretsEncryptionKey:  "",
+			ExternalAuthHook:      "",
+			ExternalAuthScope:     0,
+			ExternalAuthSyncUsers: 0,
 		},
 		HTTPDConfig: api.HTTPDConf{
 			BindPort:    8080,
@@ -69,36 +103,82 @@ func init() {
 
 // GetSFTPDConfig returns the configuration for the SFTP server
 func GetSFTPDConfig() sftpd.Configuration {
+	confMutex.RLock()
+	defer confMutex.RUnlock()
 	return globalConf.SFTPD
 }
 
 // GetHTTPDConfig returns the configuration for the HTTP server
 func GetHTTPDConfig() api.HTTPDConf {
+	confMutex.RLock()
+	defer confMutex.RUnlock()
 	return globalConf.HTTPDConfig
 }
 
 //GetProviderConf returns the configuration for the data provider
 func GetProviderConf() dataprovider.Config {
+	confMutex.RLock()
+	defer confMutex.RUnlock()
 	return globalConf.ProviderConf
 }
 
 // LoadConfig loads the configuration from sftpgo.conf or use the default configuration.
+// The settings missing in the file get their default values. If the file cannot be read or
+// parsed the current configuration is kept
 func LoadConfig(configPath string) error {
 	logger.Debug(logSender, "load config from path: %v", configPath)
 	file, err := os.Open(configPath)
 	if err != nil {
-		logger.Warn(logSender, "error loading configuration file: %v. Default configuration will be used: %+v", err, globalConf)
+		logger.Warn(logSender, "error loading configuration file: %v. The current configuration will be used: %+v",
+			err, getGlobalConfig())
 		return err
 	}
 	defer file.Close()
-	err = json.NewDecoder(file).Decode(&globalConf)
+	conf := getDefaultConfig()
+	err = json.NewDecoder(file).Decode(&conf)
 	if err != nil {
-		logger.Warn(logSender, "error parsing config file: %v. Default configuration will be used: %+v", err, globalConf)
+		logger.Warn(logSender, "error parsing config file: %v. The current configuration will be used: %+v",
+			err, getGlobalConfig())
 		return err
 	}
-	if strings.TrimSpace(globalConf.SFTPD.Banner) == "" {
-		globalConf.SFTPD.Banner = defaultBanner
+	if strings.TrimSpace(conf.SFTPD.Banner) == "" {
+		conf.SFTPD.Banner = defaultBanner
 	}
-	logger.Debug(logSender, "config loaded: %+v", globalConf)
+	setGlobalConfig(conf)
+	logger.Debug(logSender, "config loaded: %+v", conf)
 	return err
 }
+
+// ReloadConfig loads the configuration from the given file and applies it to the running SFTP server.
+// The data provider and HTTP server settings require a restart. If the new configuration is not valid
+// the error is returned and the current configuration is kept
+func ReloadConfig(configPath string, configDir string) error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	previous := getGlobalConfig()
+	if err := LoadConfig(configPath); err != nil {
+		logger.Warn(logSender, "configuration reload rejected: %v", err)
+		return err
+	}
+	current := getGlobalConfig()
+	if current.ProviderConf != previous.ProviderConf || current.HTTPDConfig != previous.HTTPDConfig {
+		logger.Warn(logSender, "data provider and HTTP server configuration changes require a restart")
+	}
+	if err := current.SFTPD.Reload(configDir); err != nil {
+		setGlobalConfig(previous)
+		return err
+	}
+	return nil
+}
+
+func getGlobalConfig() globalConfig {
+	confMutex.RLock()
+	defer confMutex.RUnlock()
+	return globalConf
+}
+
+func setGlobalConfig(conf globalConfig) {
+	confMutex.Lock()
+	defer confMutex.Unlock()
+	globalConf = conf
+}
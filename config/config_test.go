@@ -48,6 +48,30 @@ func TestLoadConfigTest(t *testing.T) {
 	os.Remove(configFilePath)
 }
 
+func TestReloadConfig(t *testing.T) {
+	configDir := ".."
+	configFilePath := filepath.Join(configDir, "sftpgo.conf")
+	err := config.LoadConfig(configFilePath)
+	if err != nil {
+		t.Errorf("error loading config: %v", err)
+	}
+	sftpdConf := config.GetSFTPDConfig()
+	configFilePath = filepath.Join(configDir, "temp_reload.conf")
+	ioutil.WriteFile(configFilePath, []byte("{invalid json}"), 0666)
+	err = config.ReloadConfig(configFilePath, configDir)
+	if err == nil {
+		t.Errorf("reloading an invalid config file must fail")
+	}
+	if config.GetSFTPDConfig().BindPort != sftpdConf.BindPort || config.GetSFTPDConfig().Banner != sftpdConf.Banner {
+		t.Errorf("the current configuration must be kept if the new one is not valid")
+	}
+	os.Remove(configFilePath)
+	err = config.ReloadConfig(configFilePath, configDir)
+	if err == nil {
+		t.Errorf("reloading a missing config file must fail")
+	}
+}
+
 func TestEmptyBanner(t *testing.T) {
 	configDir := ".."
 	confName := "temp.conf"
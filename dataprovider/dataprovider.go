@@ -5,7 +5,10 @@ package dataprovider
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"net"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -13,6 +16,7 @@ import (
 	"golang.org/x/crypto/ssh"
 
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 const (
@@ -38,7 +42,9 @@ var (
 	provider           Provider
 	sqlPlaceholders    []string
 	validPerms         = []string{PermAny, PermListItems, PermDownload, PermUpload, PermDelete, PermRename,
-		PermCreateDirs, PermCreateSymlinks}
+		PermCreateDirs, PermCreateSymlinks, PermChmod, PermChown, PermChtimes}
+	validSSHLoginMethods     = []string{SSHLoginMethodPublicKey, SSHLoginMethodPassword, SSHLoginMethodKeyboardInteractive}
+	validFilesystemProviders = []string{LocalFilesystemProvider, MemoryFilesystemProvider, S3FilesystemProvider}
 )
 
 // Config provider configuration
@@ -75,6 +81,20 @@ type Config struct {
 	//    With this configuration the "quota scan" REST API can still be used to periodically update space usage
 	//    for users without quota restrictions
 	TrackQuota int `json:"track_quota"`
+	// Passphrase used to encrypt the users TOTP secrets and S3 access secrets. TOTP enrollment and S3 users
+	// with an access secret are disabled if empty. Changing this value makes the existing secrets unusable
+	SecretsEncryptionKey string `json:"secrets_encryption_key"`
+	// Absolute path to an external program or an HTTP URL to use to authenticate users.
+	// The hook returns the user to login as JSON, leave empty to authenticate users using the data provider
+	ExternalAuthHook string `json:"external_auth_hook"`
+	// Authentication methods that use the external hook:
+	// 0, all the supported methods.
+	// 1, password and keyboard interactive.
+	// 2, public key.
+	ExternalAuthScope int `json:"external_auth_scope"`
+	// Set to 1 to create or update the users returned by the external hook inside the data provider,
+	// this way quota tracking works for them too. 0 means that users are not stored
+	ExternalAuthSyncUsers int `json:"external_auth_sync_users"`
 }
 
 // ValidationError raised if input data is not valid
@@ -123,6 +143,9 @@ type Provider interface {
 func Initialize(cnf Config, basePath string) error {
 	config = cnf
 	sqlPlaceholders = getSQLPlaceholders()
+	if err := validateExternalAuthConfig(); err != nil {
+		return err
+	}
 	if config.Driver == SQLiteDataProviderName {
 		provider = SQLiteProvider{}
 		return initializeSQLiteProvider(basePath)
@@ -136,13 +159,29 @@ func Initialize(cnf Config, basePath string) error {
 	return fmt.Errorf("Unsupported data provider: %v", config.Driver)
 }
 
-// CheckUserAndPass retrieves the SFTP user with the given username and password if a match is found or an error
-func CheckUserAndPass(p Provider, username string, password string) (User, error) {
+// CheckUserAndPass retrieves the SFTP user with the given username and password if a match is found or an error.
+// If an external authentication hook is configured for passwords it is used instead of the data provider
+func CheckUserAndPass(p Provider, username string, password string, ip string) (User, error) {
+	if isExternalAuthEnabled(ExternalAuthScopePassword) {
+		if len(password) == 0 {
+			return User{}, errors.New("Credentials cannot be null or empty")
+		}
+		return doExternalAuth(p, username, password, "", ip)
+	}
 	return p.validateUserAndPass(username, password)
 }
 
-// CheckUserAndPubKey retrieves the SFTP user with the given username and public key if a match is found or an error
-func CheckUserAndPubKey(p Provider, username string, pubKey string) (User, error) {
+// CheckUserAndPubKey retrieves the SFTP user with the given username and public key if a match is found or an error.
+// The public key must be in SSH wire format.
+// If an external authentication hook is configured for public keys it is used instead of the data provider
+func CheckUserAndPubKey(p Provider, username string, pubKey string, ip string) (User, error) {
+	if isExternalAuthEnabled(ExternalAuthScopePublicKey) {
+		authorizedKey, err := getAuthorizedKey(pubKey)
+		if err != nil {
+			return User{}, err
+		}
+		return doExternalAuth(p, username, "", authorizedKey, ip)
+	}
 	return p.validateUserAndPubKey(username, pubKey)
 }
 
@@ -212,8 +251,8 @@ func validateUser(user *User) error {
 	if len(user.Username) == 0 || len(user.HomeDir) == 0 {
 		return &ValidationError{err: "Mandatory parameters missing"}
 	}
-	if len(user.Password) == 0 && len(user.PublicKey) == 0 {
-		return &ValidationError{err: "Please set password or public_key"}
+	if len(user.Password) == 0 && len(user.PublicKeys) == 0 {
+		return &ValidationError{err: "Please set password or at least a public key"}
 	}
 	if len(user.Permissions) == 0 {
 		return &ValidationError{err: "Please grant some permissions to this user"}
@@ -226,6 +265,18 @@ func validateUser(user *User) error {
 			return &ValidationError{err: fmt.Sprintf("Invalid permission: %v", p)}
 		}
 	}
+	if err := validateDirPermissions(user); err != nil {
+		return err
+	}
+	if err := validateVirtualFolders(user); err != nil {
+		return err
+	}
+	if err := validateFilesystem(user); err != nil {
+		return err
+	}
+	if err := encryptS3Secret(user); err != nil {
+		return err
+	}
 	if !strings.HasPrefix(user.Password, argonPwdPrefix) {
 		pwd, err := argon2id.CreateHash(user.Password, argon2id.DefaultParams)
 		if err != nil {
@@ -233,10 +284,257 @@ func validateUser(user *User) error {
 		}
 		user.Password = pwd
 	}
-	if len(user.PublicKey) > 0 {
-		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(user.PublicKey))
+	for i, k := range user.PublicKeys {
+		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
 		if err != nil {
-			return err
+			return &ValidationError{err: fmt.Sprintf("Could not parse key nr. %d: %v", i+1, err)}
+		}
+	}
+	if user.TOTPConfig.Enabled && len(user.TOTPConfig.Secret) == 0 {
+		return &ValidationError{err: "TOTP cannot be enabled without an enrolled secret"}
+	}
+	return validateFilters(user)
+}
+
+// validateDirPermissions checks the permissions for specific directories and normalizes their paths
+func validateDirPermissions(user *User) error {
+	if len(user.DirPermissions) == 0 {
+		return nil
+	}
+	dirPermissions := make(map[string][]string)
+	for dir, perms := range user.DirPermissions {
+		cleanedDir := path.Clean(dir)
+		if !path.IsAbs(cleanedDir) {
+			return &ValidationError{err: fmt.Sprintf("Cannot set permissions for non absolute path: %#v", dir)}
+		}
+		if cleanedDir == "/" {
+			return &ValidationError{err: "Cannot set directory permissions for the root path, please use permissions"}
+		}
+		if _, ok := dirPermissions[cleanedDir]; ok {
+			return &ValidationError{err: fmt.Sprintf("Duplicated directory permissions for path: %#v", dir)}
+		}
+		if len(perms) == 0 {
+			return &ValidationError{err: fmt.Sprintf("Please grant some permissions for path: %#v", dir)}
+		}
+		for _, p := range perms {
+			if !utils.IsStringInSlice(p, validPerms) {
+				return &ValidationError{err: fmt.Sprintf("Invalid permission %v for path: %#v", p, dir)}
+			}
+		}
+		dirPermissions[cleanedDir] = perms
+	}
+	user.DirPermissions = dirPermissions
+	return nil
+}
+
+// validateVirtualFolders checks the virtual folders and normalizes their paths.
+// Virtual folders cannot be nested and they cannot overlap with the home dir or with each other
+func validateVirtualFolders(user *User) error {
+	if len(user.VirtualFolders) == 0 {
+		return nil
+	}
+	homeDir := filepath.Clean(user.HomeDir)
+	var virtualFolders []VirtualFolder
+	for _, folder := range user.VirtualFolders {
+		cleanedVPath := path.Clean(folder.VirtualPath)
+		if !path.IsAbs(cleanedVPath) || cleanedVPath == "/" {
+			return &ValidationError{err: fmt.Sprintf("Invalid virtual folder path: %#v", folder.VirtualPath)}
+		}
+		cleanedMPath := filepath.Clean(folder.MappedPath)
+		if !filepath.IsAbs(cleanedMPath) {
+			return &ValidationError{err: fmt.Sprintf("Invalid mapped path for virtual folder %#v: %#v, it must be "+
+				"an absolute path", folder.VirtualPath, folder.MappedPath)}
+		}
+		if isOverlappedPath(cleanedMPath, homeDir, string(filepath.Separator)) {
+			return &ValidationError{err: fmt.Sprintf("Mapped path %#v overlaps with the home dir %#v",
+				folder.MappedPath, user.HomeDir)}
+		}
+		for _, v := range virtualFolders {
+			if isOverlappedPath(cleanedVPath, v.VirtualPath, "/") {
+				return &ValidationError{err: fmt.Sprintf("Virtual folder %#v overlaps with %#v", folder.VirtualPath,
+					v.VirtualPath)}
+			}
+			if isOverlappedPath(cleanedMPath, v.MappedPath, string(filepath.Separator)) {
+				return &ValidationError{err: fmt.Sprintf("Mapped path %#v overlaps with %#v", folder.MappedPath,
+					v.MappedPath)}
+			}
+		}
+		for _, p := range folder.Permissions {
+			if !utils.IsStringInSlice(p, validPerms) {
+				return &ValidationError{err: fmt.Sprintf("Invalid permission %v for virtual folder: %#v", p,
+					folder.VirtualPath)}
+			}
+		}
+		virtualFolders = append(virtualFolders, VirtualFolder{
+			VirtualPath:      cleanedVPath,
+			MappedPath:       cleanedMPath,
+			Permissions:      folder.Permissions,
+			ExcludeFromQuota: folder.ExcludeFromQuota,
+		})
+	}
+	user.VirtualFolders = virtualFolders
+	return nil
+}
+
+func validateFilesystem(user *User) error {
+	if len(user.FsConfig.Provider) == 0 {
+		return nil
+	}
+	if !utils.IsStringInSlice(user.FsConfig.Provider, validFilesystemProviders) {
+		return &ValidationError{err: fmt.Sprintf("Invalid filesystem provider: %#v", user.FsConfig.Provider)}
+	}
+	if user.FsConfig.Provider == S3FilesystemProvider {
+		return validateS3Config(user)
+	}
+	user.FsConfig.S3Config = vfs.S3FsConfig{}
+	return nil
+}
+
+// encryptS3Secret encrypts the S3 access secret before storing the user, an existing secret preserved
+// on update is already encrypted
+func encryptS3Secret(user *User) error {
+	secret := user.FsConfig.S3Config.AccessSecret
+	if len(secret) == 0 || isSecretEncrypted(secret) {
+		return nil
+	}
+	encrypted, err := encryptSecret(secret)
+	if err == errEncryptionKeyMissing {
+		return &ValidationError{err: "please set secrets_encryption_key in sftpgo.conf to store S3 access secrets"}
+	}
+	if err != nil {
+		return err
+	}
+	user.FsConfig.S3Config.AccessSecret = encrypted
+	return nil
+}
+
+func validateS3Config(user *User) error {
+	config := &user.FsConfig.S3Config
+	if len(config.Bucket) == 0 {
+		return &ValidationError{err: "S3 bucket cannot be empty"}
+	}
+	if len(config.Region) == 0 {
+		return &ValidationError{err: "S3 region cannot be empty"}
+	}
+	if len(config.AccessKey) == 0 && len(config.AccessSecret) > 0 {
+		return &ValidationError{err: "S3 access key cannot be empty if the access secret is set"}
+	}
+	if len(config.AccessKey) > 0 && len(config.AccessSecret) == 0 {
+		return &ValidationError{err: "S3 access secret cannot be empty if the access key is set"}
+	}
+	if config.UploadPartSize != 0 && config.UploadPartSize < 5 {
+		return &ValidationError{err: fmt.Sprintf("Invalid S3 upload part size: %v, the minimum is 5 MB",
+			config.UploadPartSize)}
+	}
+	if len(config.KeyPrefix) > 0 {
+		keyPrefix := strings.TrimPrefix(path.Clean(config.KeyPrefix), "/")
+		if keyPrefix == "." || keyPrefix == "" || strings.HasPrefix(keyPrefix, "..") {
+			return &ValidationError{err: fmt.Sprintf("Invalid S3 key prefix: %#v", config.KeyPrefix)}
+		}
+		config.KeyPrefix = keyPrefix + "/"
+	}
+	if len(user.VirtualFolders) > 0 {
+		return &ValidationError{err: "Virtual folders are not supported for S3 users"}
+	}
+	return nil
+}
+
+// isOverlappedPath returns true if the given cleaned paths are equal or one is inside the other
+func isOverlappedPath(path1, path2, separator string) bool {
+	if path1 == path2 {
+		return true
+	}
+	return strings.HasPrefix(path1, strings.TrimSuffix(path2, separator)+separator) ||
+		strings.HasPrefix(path2, strings.TrimSuffix(path1, separator)+separator)
+}
+
+// validateFilePatterns checks the file patterns filters and normalizes their paths and patterns
+func validateFilePatterns(user *User) error {
+	var filters []PatternsFilter
+	var filterPaths []string
+	for _, filter := range user.Filters.FilePatterns {
+		cleanedPath := path.Clean(filter.Path)
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{err: fmt.Sprintf("Cannot set file patterns for non absolute path: %#v", filter.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filterPaths) {
+			return &ValidationError{err: fmt.Sprintf("Duplicated file patterns for path: %#v", filter.Path)}
+		}
+		if len(filter.AllowedPatterns) == 0 && len(filter.DeniedPatterns) == 0 {
+			return &ValidationError{err: fmt.Sprintf("Please set some allowed or denied patterns for path: %#v", filter.Path)}
+		}
+		filter.Path = cleanedPath
+		filter.AllowedPatterns = normalizePatterns(filter.AllowedPatterns)
+		filter.DeniedPatterns = normalizePatterns(filter.DeniedPatterns)
+		for _, pattern := range append(filter.AllowedPatterns, filter.DeniedPatterns...) {
+			if _, err := path.Match(pattern, "abc"); err != nil || pattern == "" || strings.Contains(pattern, "/") {
+				return &ValidationError{err: fmt.Sprintf("Invalid file pattern %#v for path: %#v", pattern, filter.Path)}
+			}
+		}
+		filterPaths = append(filterPaths, cleanedPath)
+		filters = append(filters, filter)
+	}
+	user.Filters.FilePatterns = filters
+	return nil
+}
+
+func normalizePatterns(patterns []string) []string {
+	var result []string
+	for _, pattern := range patterns {
+		result = append(result, strings.ToLower(strings.TrimSpace(pattern)))
+	}
+	return result
+}
+
+func validateIPFilters(user *User) error {
+	var err error
+	user.Filters.AllowedIP, err = normalizeNetworks(user.Filters.AllowedIP)
+	if err != nil {
+		return &ValidationError{err: fmt.Sprintf("Invalid allowed IP network: %v", err)}
+	}
+	user.Filters.DeniedIP, err = normalizeNetworks(user.Filters.DeniedIP)
+	if err != nil {
+		return &ValidationError{err: fmt.Sprintf("Invalid denied IP network: %v", err)}
+	}
+	return nil
+}
+
+// normalizeNetworks checks the given CIDR networks and returns them without duplicates, for example
+// "192.168.1.5/24" is returned as "192.168.1.0/24"
+func normalizeNetworks(networks []string) ([]string, error) {
+	var result []string
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(network))
+		if err != nil {
+			return result, err
+		}
+		if !utils.IsStringInSlice(ipNet.String(), result) {
+			result = append(result, ipNet.String())
+		}
+	}
+	return result, nil
+}
+
+func validateFilters(user *User) error {
+	if user.Filters.MaxUploadFileSize < 0 {
+		return &ValidationError{err: fmt.Sprintf("Invalid max upload file size: %v", user.Filters.MaxUploadFileSize)}
+	}
+	if err := validateFilePatterns(user); err != nil {
+		return err
+	}
+	if err := validateIPFilters(user); err != nil {
+		return err
+	}
+	for _, combination := range user.Filters.RequiredAuthMethods {
+		var methods []string
+		for _, m := range strings.Split(combination, ",") {
+			if !utils.IsStringInSlice(m, validSSHLoginMethods) {
+				return &ValidationError{err: fmt.Sprintf("Invalid authentication method %#v in %#v", m, combination)}
+			}
+			if utils.IsStringInSlice(m, methods) {
+				return &ValidationError{err: fmt.Sprintf("Duplicated authentication method %#v in %#v", m, combination)}
+			}
+			methods = append(methods, m)
 		}
 	}
 	return nil
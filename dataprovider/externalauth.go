@@ -0,0 +1,211 @@
+package dataprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	externalAuthTimeout = 15 * time.Second
+	// ExternalAuthScopeAll the external authentication hook is used for all the supported methods
+	ExternalAuthScopeAll = 0
+	// ExternalAuthScopePassword the external authentication hook is used for password and
+	// keyboard interactive authentication
+	ExternalAuthScopePassword = 1
+	// ExternalAuthScopePublicKey the external authentication hook is used for public key authentication
+	ExternalAuthScopePublicKey = 2
+)
+
+type externalAuthRequest struct {
+	Username  string `json:"username"`
+	Password  string `json:"password,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+	IP        string `json:"ip"`
+}
+
+func isExternalAuthEnabled(scope int) bool {
+	if len(config.ExternalAuthHook) == 0 {
+		return false
+	}
+	return config.ExternalAuthScope == ExternalAuthScopeAll || config.ExternalAuthScope == scope
+}
+
+func validateExternalAuthConfig() error {
+	if config.ExternalAuthScope < ExternalAuthScopeAll || config.ExternalAuthScope > ExternalAuthScopePublicKey {
+		return fmt.Errorf("invalid external_auth_scope: %v", config.ExternalAuthScope)
+	}
+	if len(config.ExternalAuthHook) == 0 || strings.HasPrefix(config.ExternalAuthHook, "http://") ||
+		strings.HasPrefix(config.ExternalAuthHook, "https://") {
+		return nil
+	}
+	if !filepath.IsAbs(config.ExternalAuthHook) {
+		return fmt.Errorf("invalid external_auth_hook %#v, it must be an absolute path or an HTTP URL",
+			config.ExternalAuthHook)
+	}
+	return nil
+}
+
+// doExternalAuth asks the configured hook to authenticate the given credentials. pubKey must be in
+// authorized_keys format. The user returned by the hook is used to login and, if configured, it is
+// created or updated inside the data provider
+func doExternalAuth(p Provider, username, password, pubKey, ip string) (User, error) {
+	var user User
+	req := externalAuthRequest{
+		Username:  username,
+		Password:  password,
+		PublicKey: pubKey,
+		IP:        ip,
+	}
+	var out []byte
+	var err error
+	if strings.HasPrefix(config.ExternalAuthHook, "http://") || strings.HasPrefix(config.ExternalAuthHook, "https://") {
+		out, err = getExternalAuthHTTPResponse(req)
+	} else {
+		out, err = getExternalAuthProgramResponse(req)
+	}
+	if err != nil {
+		logger.Warn(logSender, "external authentication failed for user %#v, ip %v: %v", username, ip, err)
+		return user, err
+	}
+	err = json.Unmarshal(out, &user)
+	if err != nil {
+		logger.Warn(logSender, "invalid external authentication response for user %#v: %v", username, err)
+		return user, err
+	}
+	if len(user.Username) == 0 {
+		logger.Debug(logSender, "external authentication rejected for user %#v, ip %v", username, ip)
+		return user, errors.New("external authentication rejected")
+	}
+	if user.Username != username {
+		logger.Warn(logSender, "external authentication returned username %#v for user %#v, login rejected",
+			user.Username, username)
+		return user, errors.New("external authentication returned a different username")
+	}
+	// the TOTP configuration is managed by SFTPGo only
+	user.TOTPConfig = UserTOTPConfig{}
+	if config.ExternalAuthSyncUsers == 0 {
+		user.ID = 0
+		return user, validateExternalUser(&user)
+	}
+	return syncExternalUser(p, user, password, pubKey)
+}
+
+func getExternalAuthHTTPResponse(req externalAuthRequest) ([]byte, error) {
+	reqAsJSON, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{
+		Timeout: externalAuthTimeout,
+	}
+	resp, err := httpClient.Post(config.ExternalAuthHook, "application/json", bytes.NewBuffer(reqAsJSON))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("external authentication rejected, status code: %v", resp.StatusCode)
+	}
+	var b bytes.Buffer
+	_, err = b.ReadFrom(resp.Body)
+	return b.Bytes(), err
+}
+
+func getExternalAuthProgramResponse(req externalAuthRequest) ([]byte, error) {
+	if !filepath.IsAbs(config.ExternalAuthHook) {
+		return nil, fmt.Errorf("invalid external authentication program %#v, it must be an absolute path",
+			config.ExternalAuthHook)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), externalAuthTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, config.ExternalAuthHook)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SFTPGO_AUTHD_USERNAME=%v", req.Username),
+		fmt.Sprintf("SFTPGO_AUTHD_PASSWORD=%v", req.Password),
+		fmt.Sprintf("SFTPGO_AUTHD_PUBLIC_KEY=%v", req.PublicKey),
+		fmt.Sprintf("SFTPGO_AUTHD_IP=%v", req.IP))
+	return cmd.Output()
+}
+
+// validateExternalUser checks the fields needed to login a user that is not stored inside the data provider
+func validateExternalUser(user *User) error {
+	if len(user.HomeDir) == 0 || !filepath.IsAbs(user.HomeDir) {
+		return &ValidationError{err: fmt.Sprintf("home_dir must be an absolute path, actual value: %v", user.HomeDir)}
+	}
+	if len(user.Permissions) == 0 {
+		return &ValidationError{err: "Please grant some permissions to this user"}
+	}
+	for _, p := range user.Permissions {
+		if !utils.IsStringInSlice(p, validPerms) {
+			return &ValidationError{err: fmt.Sprintf("Invalid permission: %v", p)}
+		}
+	}
+	if err := validateDirPermissions(user); err != nil {
+		return err
+	}
+	if err := validateVirtualFolders(user); err != nil {
+		return err
+	}
+	if err := validateFilesystem(user); err != nil {
+		return err
+	}
+	return validateFilters(user)
+}
+
+// syncExternalUser creates or updates the user returned by the external authentication hook.
+// The credentials and the TOTP configuration already stored are preserved if the hook returns no
+// credentials, a new user is created using the credentials used to login
+func syncExternalUser(p Provider, user User, password, pubKey string) (User, error) {
+	if config.ManageUsers == 0 {
+		return user, &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	existingUser, err := p.userExists(user.Username)
+	if err == nil {
+		user.ID = existingUser.ID
+		user.TOTPConfig = existingUser.TOTPConfig
+		if len(user.Password) == 0 && len(user.PublicKeys) == 0 {
+			user.Password = existingUser.Password
+			user.PublicKeys = existingUser.PublicKeys
+		}
+	}
+	if len(user.Password) == 0 && len(user.PublicKeys) == 0 {
+		if len(password) > 0 {
+			user.Password = password
+		} else {
+			user.PublicKeys = []string{pubKey}
+		}
+	}
+	if user.ID > 0 {
+		err = p.updateUser(user)
+	} else {
+		err = p.addUser(user)
+	}
+	if err != nil {
+		logger.Warn(logSender, "unable to sync external user %#v: %v", user.Username, err)
+		return user, err
+	}
+	return p.userExists(user.Username)
+}
+
+// getAuthorizedKey converts a public key in wire format to the authorized_keys format
+func getAuthorizedKey(pubKey string) (string, error) {
+	key, err := ssh.ParsePublicKey([]byte(pubKey))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), nil
+}
@@ -0,0 +1,70 @@
+package dataprovider
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	encryptedSecretPrefix = "$aesgcm$"
+)
+
+var errEncryptionKeyMissing = errors.New("the encryption key is not set")
+
+// getSecretsCipher returns the AES-GCM cipher used to encrypt the TOTP and the S3 secrets stored inside the
+// data provider, the key is derived from the configured secrets_encryption_key
+func getSecretsCipher() (cipher.AEAD, error) {
+	if len(config.SecretsEncryptionKey) == 0 {
+		return nil, errEncryptionKeyMissing
+	}
+	key := sha256.Sum256([]byte(config.SecretsEncryptionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func isSecretEncrypted(secret string) bool {
+	return strings.HasPrefix(secret, encryptedSecretPrefix)
+}
+
+func encryptSecret(secret string) (string, error) {
+	gcm, err := getSecretsCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(encrypted string) (string, error) {
+	if !isSecretEncrypted(encrypted) {
+		return "", errors.New("invalid encrypted secret")
+	}
+	gcm, err := getSecretsCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encrypted, encryptedSecretPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("invalid encrypted secret")
+	}
+	secret, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
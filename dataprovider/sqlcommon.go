@@ -73,20 +73,17 @@ func sqlCommonValidateUserAndPubKey(username string, pubKey string) (User, error
 		logger.Warn(logSender, "error authenticating user: %v, error: %v", username, err)
 		return user, err
 	}
-	if len(user.PublicKey) > 0 {
-		storedPubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(user.PublicKey))
+	for i, k := range user.PublicKeys {
+		storedPubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
 		if err != nil {
-			logger.Warn(logSender, "error parsing stored public key for user %v: %v", username, err)
+			logger.Warn(logSender, "error parsing stored public key %d for user %v: %v", i, username, err)
 			return user, err
 		}
-		if string(storedPubKey.Marshal()) != pubKey {
-			err = errors.New("Invalid credentials")
-			return user, err
+		if string(storedPubKey.Marshal()) == pubKey {
+			return user, nil
 		}
-	} else {
-		err = errors.New("Invalid credentials")
 	}
-	return user, err
+	return user, errors.New("Invalid credentials")
 }
 
 func sqlCommonGetUserByID(ID int64) (User, error) {
@@ -169,8 +166,33 @@ func sqlCommonAddUser(user User) error {
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(user.Username, user.Password, user.PublicKey, user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
-		user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth)
+	publicKeys, err := user.GetPublicKeysAsJSON()
+	if err != nil {
+		return err
+	}
+	filters, err := user.GetFiltersAsJSON()
+	if err != nil {
+		return err
+	}
+	totpConfig, err := user.GetTOTPConfigAsJSON()
+	if err != nil {
+		return err
+	}
+	dirPermissions, err := user.GetDirPermissionsAsJSON()
+	if err != nil {
+		return err
+	}
+	virtualFolders, err := user.GetVirtualFoldersAsJSON()
+	if err != nil {
+		return err
+	}
+	fsConfig, err := user.GetFilesystemAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(user.Username, user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
+		user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, string(filters), string(totpConfig),
+		string(dirPermissions), string(virtualFolders), string(fsConfig))
 	return err
 }
 
@@ -190,8 +212,33 @@ func sqlCommonUpdateUser(user User) error {
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(user.Password, user.PublicKey, user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
-		user.QuotaFiles, permissions, user.UploadBandwidth, user.DownloadBandwidth, user.ID)
+	publicKeys, err := user.GetPublicKeysAsJSON()
+	if err != nil {
+		return err
+	}
+	filters, err := user.GetFiltersAsJSON()
+	if err != nil {
+		return err
+	}
+	totpConfig, err := user.GetTOTPConfigAsJSON()
+	if err != nil {
+		return err
+	}
+	dirPermissions, err := user.GetDirPermissionsAsJSON()
+	if err != nil {
+		return err
+	}
+	virtualFolders, err := user.GetVirtualFoldersAsJSON()
+	if err != nil {
+		return err
+	}
+	fsConfig, err := user.GetFilesystemAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
+		user.QuotaFiles, permissions, user.UploadBandwidth, user.DownloadBandwidth, string(filters), string(totpConfig),
+		string(dirPermissions), string(virtualFolders), string(fsConfig), user.ID)
 	return err
 }
 
@@ -226,9 +273,11 @@ func sqlCommonGetUsers(limit int, offset int, order string, username string) ([]
 		defer rows.Close()
 		for rows.Next() {
 			u, err := getUserFromDbRow(nil, rows)
-			// hide password and public key
+			// hide password, public keys, TOTP and S3 secrets
 			u.Password = ""
-			u.PublicKey = ""
+			u.PublicKeys = nil
+			u.TOTPConfig.Secret = ""
+			u.FsConfig.S3Config.AccessSecret = ""
 			if err == nil {
 				users = append(users, u)
 			} else {
@@ -244,17 +293,24 @@ func getUserFromDbRow(row *sql.Row, rows *sql.Rows) (User, error) {
 	var user User
 	var permissions sql.NullString
 	var password sql.NullString
-	var publicKey sql.NullString
+	var publicKeys sql.NullString
+	var filters sql.NullString
+	var totpConfig sql.NullString
+	var dirPermissions sql.NullString
+	var virtualFolders sql.NullString
+	var fsConfig sql.NullString
 	var err error
 	if row != nil {
-		err = row.Scan(&user.ID, &user.Username, &password, &publicKey, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
+		err = row.Scan(&user.ID, &user.Username, &password, &publicKeys, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
 			&user.QuotaSize, &user.QuotaFiles, &permissions, &user.UsedQuotaSize, &user.UsedQuotaFiles, &user.LastQuotaUpdate,
-			&user.UploadBandwidth, &user.DownloadBandwidth)
+			&user.UploadBandwidth, &user.DownloadBandwidth, &filters, &totpConfig, &dirPermissions,
+			&virtualFolders, &fsConfig)
 
 	} else {
-		err = rows.Scan(&user.ID, &user.Username, &password, &publicKey, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
+		err = rows.Scan(&user.ID, &user.Username, &password, &publicKeys, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
 			&user.QuotaSize, &user.QuotaFiles, &permissions, &user.UsedQuotaSize, &user.UsedQuotaFiles, &user.LastQuotaUpdate,
-			&user.UploadBandwidth, &user.DownloadBandwidth)
+			&user.UploadBandwidth, &user.DownloadBandwidth, &filters, &totpConfig, &dirPermissions,
+			&virtualFolders, &fsConfig)
 	}
 	if err != nil {
 		return user, err
@@ -262,8 +318,53 @@ func getUserFromDbRow(row *sql.Row, rows *sql.Rows) (User, error) {
 	if password.Valid {
 		user.Password = password.String
 	}
-	if publicKey.Valid {
-		user.PublicKey = publicKey.String
+	if publicKeys.Valid && len(publicKeys.String) > 0 {
+		var list []string
+		err = json.Unmarshal([]byte(publicKeys.String), &list)
+		if err != nil {
+			return user, err
+		}
+		user.PublicKeys = list
+	}
+	if filters.Valid && len(filters.String) > 0 {
+		var userFilters UserFilters
+		err = json.Unmarshal([]byte(filters.String), &userFilters)
+		if err != nil {
+			return user, err
+		}
+		user.Filters = userFilters
+	}
+	if totpConfig.Valid && len(totpConfig.String) > 0 {
+		var userTOTPConfig UserTOTPConfig
+		err = json.Unmarshal([]byte(totpConfig.String), &userTOTPConfig)
+		if err != nil {
+			return user, err
+		}
+		user.TOTPConfig = userTOTPConfig
+	}
+	if dirPermissions.Valid && len(dirPermissions.String) > 0 {
+		var perms map[string][]string
+		err = json.Unmarshal([]byte(dirPermissions.String), &perms)
+		if err != nil {
+			return user, err
+		}
+		user.DirPermissions = perms
+	}
+	if virtualFolders.Valid && len(virtualFolders.String) > 0 {
+		var folders []VirtualFolder
+		err = json.Unmarshal([]byte(virtualFolders.String), &folders)
+		if err != nil {
+			return user, err
+		}
+		user.VirtualFolders = folders
+	}
+	if fsConfig.Valid && len(fsConfig.String) > 0 {
+		var filesystem Filesystem
+		err = json.Unmarshal([]byte(fsConfig.String), &filesystem)
+		if err != nil {
+			return user, err
+		}
+		user.FsConfig = filesystem
 	}
 	if permissions.Valid {
 		var list []string
@@ -0,0 +1,92 @@
+package dataprovider
+
+import (
+	"time"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	totpDisabledError    = "please set secrets_encryption_key in sftpgo.conf to enable this method"
+	totpIssuer           = "SFTPGo"
+	totpNotEnrolledError = "TOTP is not enrolled for this user"
+)
+
+var totpClock = time.Now
+
+// SetTOTPClock sets the function used to get the current time while validating TOTP codes.
+// This is useful for testing, a nil function restores the system clock
+func SetTOTPClock(clock func() time.Time) {
+	if clock == nil {
+		clock = time.Now
+	}
+	totpClock = clock
+}
+
+// EnrollUserTOTP generates a new TOTP secret for the given user and returns it in plain text together with
+// the otpauth URL. The secret is stored encrypted and the second factor is enabled only after a successful
+// verification, any previous TOTP configuration is replaced.
+// ManageUsers configuration must be set to 1 and SecretsEncryptionKey must be set to enable this method
+func EnrollUserTOTP(p Provider, user User) (string, string, error) {
+	if config.ManageUsers == 0 {
+		return "", "", &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	if len(config.SecretsEncryptionKey) == 0 {
+		return "", "", &MethodDisabledError{err: totpDisabledError}
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	encrypted, err := encryptSecret(secret)
+	if err != nil {
+		return "", "", err
+	}
+	user.TOTPConfig = UserTOTPConfig{
+		Enabled: false,
+		Secret:  encrypted,
+	}
+	return secret, utils.GetTOTPURL(totpIssuer, user.Username, secret), p.updateUser(user)
+}
+
+// VerifyUserTOTP checks the given code against the enrolled TOTP secret and enables the second factor
+// for the given user if the code is valid.
+// ManageUsers configuration must be set to 1 to enable this method
+func VerifyUserTOTP(p Provider, user User, code string) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	if err := CheckUserTOTPCode(user, code); err != nil {
+		return err
+	}
+	user.TOTPConfig.Enabled = true
+	return p.updateUser(user)
+}
+
+// ResetUserTOTP removes the TOTP configuration for the given user.
+// ManageUsers configuration must be set to 1 to enable this method
+func ResetUserTOTP(p Provider, user User) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	user.TOTPConfig = UserTOTPConfig{}
+	return p.updateUser(user)
+}
+
+// CheckUserTOTPCode returns an error if the given code is not valid for the TOTP secret enrolled by the user
+func CheckUserTOTPCode(user User, code string) error {
+	if len(user.TOTPConfig.Secret) == 0 {
+		return &ValidationError{err: totpNotEnrolledError}
+	}
+	secret, err := decryptSecret(user.TOTPConfig.Secret)
+	if err == errEncryptionKeyMissing {
+		return &MethodDisabledError{err: totpDisabledError}
+	}
+	if err != nil {
+		return err
+	}
+	if !utils.ValidateTOTPCode(secret, code, totpClock()) {
+		return &ValidationError{err: "Invalid TOTP code"}
+	}
+	return nil
+}
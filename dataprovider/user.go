@@ -2,9 +2,14 @@ package dataprovider
 
 import (
 	"encoding/json"
+	"errors"
+	"net"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 // Available permissions for SFTP users
@@ -25,8 +30,117 @@ const (
 	PermCreateDirs = "create_dirs"
 	// create symbolic links is allowed
 	PermCreateSymlinks = "create_symlinks"
+	// changing file or directory permissions is allowed
+	PermChmod = "chmod"
+	// changing file or directory owner and group is allowed. The owner and group can only be set to
+	// the user's UID and GID
+	PermChown = "chown"
+	// changing file or directory access and modification times is allowed
+	PermChtimes = "chtimes"
 )
 
+// Available SSH authentication methods
+const (
+	// public key authentication, certificates are included
+	SSHLoginMethodPublicKey = "publickey"
+	// password authentication
+	SSHLoginMethodPassword = "password"
+	// keyboard interactive authentication, the user is asked for the password and for
+	// the TOTP code if the second factor is enabled
+	SSHLoginMethodKeyboardInteractive = "keyboard-interactive"
+)
+
+// Available filesystem providers
+const (
+	// local filesystem, this is the default
+	LocalFilesystemProvider = "local"
+	// in memory filesystem, the contents are shared between the user connections and they are lost on restart
+	MemoryFilesystemProvider = "memory"
+	// S3 compatible object storage, the objects are stored in the configured bucket
+	S3FilesystemProvider = "s3"
+)
+
+// Filesystem defines the storage backend for a user
+type Filesystem struct {
+	// Storage backend, empty means local filesystem
+	Provider string `json:"provider"`
+	// S3Config is required if the provider is S3
+	S3Config vfs.S3FsConfig `json:"s3config"`
+}
+
+// PatternsFilter defines the allowed and denied shell like patterns, for example "*.csv", for the names
+// of the files inside a directory
+type PatternsFilter struct {
+	// Absolute virtual path, the filter applies to the files inside this directory and inside its sub
+	// directories without a more specific filter
+	Path string `json:"path"`
+	// Only the files matching one of these patterns are allowed. Empty means that any file not explicitly
+	// denied is allowed
+	AllowedPatterns []string `json:"allowed_patterns,omitempty"`
+	// The files matching one of these patterns are denied, denied patterns take precedence over allowed ones
+	DeniedPatterns []string `json:"denied_patterns,omitempty"`
+	// If true the files that are not allowed are not included in directory listings
+	HideDenied bool `json:"hide_denied,omitempty"`
+}
+
+// IsNameAllowed returns true if the given file name is allowed by this filter.
+// The patterns are matched case insensitive
+func (f *PatternsFilter) IsNameAllowed(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range f.DeniedPatterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return false
+		}
+	}
+	if len(f.AllowedPatterns) == 0 {
+		return true
+	}
+	for _, pattern := range f.AllowedPatterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// UserFilters defines additional restrictions for a user
+type UserFilters struct {
+	// Combinations of authentication methods required to login. Each combination is a comma separated
+	// list of methods, for example "publickey,password", and the user can login completing all the
+	// methods of any combination. Empty means that any single authentication method is enough
+	RequiredAuthMethods []string `json:"required_auth_methods,omitempty"`
+	// Maximum allowed size, as bytes, for a single file upload. The upload fails as soon as the file
+	// exceeds this size. 0 means unlimited
+	MaxUploadFileSize int64 `json:"max_upload_file_size,omitempty"`
+	// Allowed and denied file name patterns for specific directories. They are enforced for uploads, downloads
+	// and rename targets
+	FilePatterns []PatternsFilter `json:"file_patterns,omitempty"`
+	// Source networks, in CIDR notation, allowed to login, for example "192.168.1.0/24". Empty means any network
+	AllowedIP []string `json:"allowed_ip,omitempty"`
+	// Source networks, in CIDR notation, denied to login. They take precedence over the allowed ones
+	DeniedIP []string `json:"denied_ip,omitempty"`
+}
+
+// UserTOTPConfig defines the TOTP second factor configuration for a user
+type UserTOTPConfig struct {
+	// The second factor is enabled after verifying the enrolled secret with a valid code
+	Enabled bool `json:"enabled"`
+	// TOTP secret encrypted using the configured encryption key, it is never returned by the REST API
+	Secret string `json:"secret,omitempty"`
+}
+
+// VirtualFolder defines a mapping between a virtual path and a filesystem path outside the user home dir
+type VirtualFolder struct {
+	// Absolute path as seen by the user, for example "/shared/reports"
+	VirtualPath string `json:"virtual_path"`
+	// Absolute filesystem path, for example "/srv/reports"
+	MappedPath string `json:"mapped_path"`
+	// Permissions granted inside the folder. Empty means that the permissions of the parent directory are inherited
+	Permissions []string `json:"permissions,omitempty"`
+	// If true the folder contents are not included in the user quota
+	ExcludeFromQuota bool `json:"exclude_from_quota"`
+}
+
 // User defines an SFTP user
 type User struct {
 	// Database unique identifier
@@ -39,8 +153,8 @@ type User struct {
 	// Currently, as fallback, there is a clear text password checking but you should not store passwords
 	// as clear text and this support could be removed at any time, so please don't depend on it.
 	Password string `json:"password,omitempty"`
-	// PublicKey used for public key authentication. At least one between password and public key is mandatory
-	PublicKey string `json:"public_key,omitempty"`
+	// PublicKeys used for public key authentication. At least one between password and public key is mandatory
+	PublicKeys []string `json:"public_keys,omitempty"`
 	// The user cannot upload or download files outside this directory. Must be an absolute path
 	HomeDir string `json:"home_dir"`
 	// If sftpgo runs as root system user then the created files and directories will be assigned to this system UID
@@ -53,8 +167,13 @@ type User struct {
 	QuotaSize int64 `json:"quota_size"`
 	// Maximum number of files allowed. 0 means unlimited
 	QuotaFiles int `json:"quota_files"`
-	// List of the granted permissions
+	// List of the granted permissions for the root directory and for the directories without specific permissions
 	Permissions []string `json:"permissions"`
+	// Permissions for specific directories keyed by virtual path, for example "/incoming".
+	// Sub directories inherit the permissions of the closest parent directory with specific permissions
+	DirPermissions map[string][]string `json:"dir_permissions,omitempty"`
+	// Directories outside the home dir mapped inside the user tree
+	VirtualFolders []VirtualFolder `json:"virtual_folders,omitempty"`
 	// Used quota as bytes
 	UsedQuotaSize int64 `json:"used_quota_size"`
 	// Used quota as number of files
@@ -65,14 +184,151 @@ type User struct {
 	UploadBandwidth int64 `json:"upload_bandwidth"`
 	// Maximum download bandwidth as KB/s, 0 means unlimited
 	DownloadBandwidth int64 `json:"download_bandwidth"`
+	// Additional restrictions
+	Filters UserFilters `json:"filters"`
+	// TOTP second factor, it can be managed using the dedicated REST API
+	TOTPConfig UserTOTPConfig `json:"totp_config"`
+	// Storage backend for the user files
+	FsConfig Filesystem `json:"filesystem"`
+}
+
+// GetPermissionsForPath returns the permissions granted for the given virtual path.
+// The permissions of the closest parent directory or virtual folder with specific permissions are inherited,
+// the global permissions are returned if no parent directory has specific permissions
+func (u *User) GetPermissionsForPath(p string) []string {
+	if len(u.DirPermissions) > 0 || len(u.VirtualFolders) > 0 {
+		dir := path.Clean("/" + p)
+		for {
+			if perms, ok := u.DirPermissions[dir]; ok {
+				return perms
+			}
+			if folder, err := u.GetVirtualFolderForPath(dir); err == nil && folder.VirtualPath == dir &&
+				len(folder.Permissions) > 0 {
+				return folder.Permissions
+			}
+			if dir == "/" {
+				break
+			}
+			dir = path.Dir(dir)
+		}
+	}
+	return u.Permissions
 }
 
-// HasPerm returns true if the user has the given permission or any permission
-func (u *User) HasPerm(permission string) bool {
-	if utils.IsStringInSlice(PermAny, u.Permissions) {
+// HasPerm returns true if the user has the given permission or any permission for the given virtual path
+func (u *User) HasPerm(permission, path string) bool {
+	perms := u.GetPermissionsForPath(path)
+	if utils.IsStringInSlice(PermAny, perms) {
 		return true
 	}
-	return utils.IsStringInSlice(permission, u.Permissions)
+	return utils.IsStringInSlice(permission, perms)
+}
+
+// GetPatternsFilterForDir returns the file patterns filter for the given virtual directory.
+// The filter of the closest parent directory with a filter is inherited, false is returned if no filter applies
+func (u *User) GetPatternsFilterForDir(virtualDir string) (PatternsFilter, bool) {
+	if len(u.Filters.FilePatterns) > 0 {
+		dir := path.Clean("/" + virtualDir)
+		for {
+			for _, filter := range u.Filters.FilePatterns {
+				if filter.Path == dir {
+					return filter, true
+				}
+			}
+			if dir == "/" {
+				break
+			}
+			dir = path.Dir(dir)
+		}
+	}
+	return PatternsFilter{}, false
+}
+
+// IsFileAllowed returns true if the file name for the given virtual path is allowed by the file
+// patterns filter for its directory
+func (u *User) IsFileAllowed(virtualPath string) bool {
+	p := path.Clean("/" + virtualPath)
+	filter, ok := u.GetPatternsFilterForDir(path.Dir(p))
+	if !ok {
+		return true
+	}
+	return filter.IsNameAllowed(path.Base(p))
+}
+
+// GetVirtualFolderForPath returns the virtual folder containing the given virtual path, the folder
+// itself is returned if the path is its virtual path
+func (u *User) GetVirtualFolderForPath(virtualPath string) (VirtualFolder, error) {
+	p := path.Clean("/" + virtualPath)
+	for _, folder := range u.VirtualFolders {
+		if p == folder.VirtualPath || strings.HasPrefix(p, folder.VirtualPath+"/") {
+			return folder, nil
+		}
+	}
+	return VirtualFolder{}, errors.New("no virtual folder found for the given path")
+}
+
+// IsVirtualFolder returns true if the given virtual path is the root of a virtual folder
+func (u *User) IsVirtualFolder(virtualPath string) bool {
+	p := path.Clean("/" + virtualPath)
+	for _, folder := range u.VirtualFolders {
+		if p == folder.VirtualPath {
+			return true
+		}
+	}
+	return false
+}
+
+// HasVirtualFoldersInside returns true if at least a virtual folder is inside the given virtual path
+func (u *User) HasVirtualFoldersInside(virtualPath string) bool {
+	p := path.Clean("/" + virtualPath)
+	for _, folder := range u.VirtualFolders {
+		if p == "/" || strings.HasPrefix(folder.VirtualPath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetVirtualFoldersInDir returns the virtual folders whose virtual path is a direct child of the given directory
+func (u *User) GetVirtualFoldersInDir(virtualPath string) []VirtualFolder {
+	var folders []VirtualFolder
+	p := path.Clean("/" + virtualPath)
+	for _, folder := range u.VirtualFolders {
+		if path.Dir(folder.VirtualPath) == p {
+			folders = append(folders, folder)
+		}
+	}
+	return folders
+}
+
+// IsFileExcludedFromQuota returns true if the given virtual path is inside a virtual folder excluded from quota
+func (u *User) IsFileExcludedFromQuota(virtualPath string) bool {
+	folder, err := u.GetVirtualFolderForPath(virtualPath)
+	if err != nil {
+		return false
+	}
+	return folder.ExcludeFromQuota
+}
+
+// GetFilesystem returns the storage backend configured for this user
+func (u *User) GetFilesystem() (vfs.Fs, error) {
+	switch u.FsConfig.Provider {
+	case MemoryFilesystemProvider:
+		return vfs.GetMemoryFs(u.Username), nil
+	case S3FilesystemProvider:
+		s3Config := u.FsConfig.S3Config
+		// secrets stored before they were encrypted, or returned by the external auth hook, are in plain text
+		if isSecretEncrypted(s3Config.AccessSecret) {
+			secret, err := decryptSecret(s3Config.AccessSecret)
+			if err != nil {
+				return nil, err
+			}
+			s3Config.AccessSecret = secret
+		}
+		return vfs.NewS3Fs(u.HomeDir, s3Config)
+	default:
+		return vfs.NewOsFs(), nil
+	}
 }
 
 // GetPermissionsAsJSON returns the permissions as json byte array
@@ -80,6 +336,96 @@ func (u *User) GetPermissionsAsJSON() ([]byte, error) {
 	return json.Marshal(u.Permissions)
 }
 
+// GetDirPermissionsAsJSON returns the permissions for specific directories as json byte array
+func (u *User) GetDirPermissionsAsJSON() ([]byte, error) {
+	return json.Marshal(u.DirPermissions)
+}
+
+// GetVirtualFoldersAsJSON returns the virtual folders as json byte array
+func (u *User) GetVirtualFoldersAsJSON() ([]byte, error) {
+	return json.Marshal(u.VirtualFolders)
+}
+
+// GetFilesystemAsJSON returns the filesystem configuration as json byte array
+func (u *User) GetFilesystemAsJSON() ([]byte, error) {
+	return json.Marshal(u.FsConfig)
+}
+
+// GetPublicKeysAsJSON returns the public keys as json byte array
+func (u *User) GetPublicKeysAsJSON() ([]byte, error) {
+	return json.Marshal(u.PublicKeys)
+}
+
+// GetFiltersAsJSON returns the filters as json byte array
+func (u *User) GetFiltersAsJSON() ([]byte, error) {
+	return json.Marshal(u.Filters)
+}
+
+// GetTOTPConfigAsJSON returns the TOTP configuration as json byte array
+func (u *User) GetTOTPConfigAsJSON() ([]byte, error) {
+	return json.Marshal(u.TOTPConfig)
+}
+
+// GetNextAuthMethods returns the authentication methods that the user can use after completing the given ones
+// and true if the completed methods are enough to login
+func (u *User) GetNextAuthMethods(completed []string) ([]string, bool) {
+	var nextMethods []string
+	if len(u.Filters.RequiredAuthMethods) == 0 {
+		return nextMethods, len(completed) > 0
+	}
+	for _, combination := range u.Filters.RequiredAuthMethods {
+		methods := strings.Split(combination, ",")
+		isSubset := true
+		for _, m := range completed {
+			if !utils.IsStringInSlice(m, methods) {
+				isSubset = false
+				break
+			}
+		}
+		if !isSubset {
+			continue
+		}
+		if len(methods) == len(completed) {
+			return []string{}, true
+		}
+		for _, m := range methods {
+			if !utils.IsStringInSlice(m, completed) && !utils.IsStringInSlice(m, nextMethods) {
+				nextMethods = append(nextMethods, m)
+			}
+		}
+	}
+	return nextMethods, false
+}
+
+// IsLoginFromAddrAllowed returns true if the login is allowed from the given remote address.
+// The denied networks are checked first, if some allowed networks are defined the address must
+// be inside one of them
+func (u *User) IsLoginFromAddrAllowed(remoteAddr string) bool {
+	if len(u.Filters.AllowedIP) == 0 && len(u.Filters.DeniedIP) == 0 {
+		return true
+	}
+	ip := net.ParseIP(utils.GetIPFromRemoteAddress(remoteAddr))
+	if ip == nil {
+		return false
+	}
+	for _, network := range u.Filters.DeniedIP {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err == nil && ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if len(u.Filters.AllowedIP) == 0 {
+		return true
+	}
+	for _, network := range u.Filters.AllowedIP {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetUID returns a validate uid, suitable for use with os.Chown
 func (u *User) GetUID() int {
 	if u.UID <= 0 || u.UID > 65535 {
@@ -63,8 +63,10 @@ func Error(sender string, format string, v ...interface{}) {
 	logger.Error().Str("sender", sender).Msg(fmt.Sprintf(format, v...))
 }
 
-// TransferLog logs an SFTP upload or download
-func TransferLog(operation string, path string, elapsed int64, size int64, user string, connectionID string) {
+// TransferLog logs an SFTP upload or download.
+// transferErr is nil if the transfer completed successfully, otherwise it is the error that made it fail
+func TransferLog(operation string, path string, elapsed int64, size int64, user string, connectionID string,
+	transferErr error) {
 	logger.Info().
 		Str("sender", operation).
 		Int64("elapsed_ms", elapsed).
@@ -72,6 +74,8 @@ func TransferLog(operation string, path string, elapsed int64, size int64, user
 		Str("username", user).
 		Str("file_path", path).
 		Str("connection_id", connectionID).
+		Bool("success", transferErr == nil).
+		Err(transferErr).
 		Msg("")
 }
 
@@ -85,3 +89,14 @@ func CommandLog(command string, path string, target string, user string, connect
 		Str("connection_id", connectionID).
 		Msg("")
 }
+
+// AuditLog logs a security relevant event, for example a login refused because of the user's restrictions
+func AuditLog(event string, user string, remoteAddr string, reason string) {
+	logger.Info().
+		Str("sender", "audit").
+		Str("event", event).
+		Str("username", user).
+		Str("remote_addr", remoteAddr).
+		Str("reason", reason).
+		Msg("")
+}
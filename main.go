@@ -4,11 +4,14 @@
 package main // import "github.com/drakkan/sftpgo"
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -32,8 +35,9 @@ func main() {
 		logFilePath string
 	)
 	flag.StringVar(&configDir, "config-dir", ".", "Location for SFTPGo config dir. It must contain sftpgo.conf, "+
-		"the private key for the SFTP server (id_rsa file) and the SQLite database if you use SQLite as data provider. "+
-		"The server private key will be autogenerated if the user that executes SFTPGo has write access to the config-dir")
+		"the private host keys for the SFTP server (id_rsa, id_ecdsa and id_ed25519 files, unless different host keys are "+
+		"configured) and the SQLite database if you use SQLite as data provider. The missing host keys will be "+
+		"autogenerated if the user that executes SFTPGo has write access to the config-dir")
 	flag.StringVar(&logFilePath, "log-file-path", "sftpgo.log", "Location for the log file")
 	flag.Parse()
 
@@ -54,8 +58,13 @@ func main() {
 	httpdConf := config.GetHTTPDConfig()
 
 	sftpd.SetDataProvider(dataProvider)
+	reloadConfig := func() error {
+		logger.Info(logSender, "reloading configuration from file %#v", configFilePath)
+		return config.ReloadConfig(configFilePath, configDir)
+	}
 
-	shutdown := make(chan bool)
+	shutdown := make(chan bool, 2)
+	var httpServer *http.Server
 
 	go func() {
 		logger.Debug(logSender, "initializing SFTP server with config %+v", sftpdConf)
@@ -68,17 +77,19 @@ func main() {
 	if httpdConf.BindPort > 0 {
 		router := api.GetHTTPRouter()
 		api.SetDataProvider(dataProvider)
+		api.SetConfigReloader(reloadConfig)
+
+		httpServer = &http.Server{
+			Addr:           fmt.Sprintf("%s:%d", httpdConf.BindAddress, httpdConf.BindPort),
+			Handler:        router,
+			ReadTimeout:    300 * time.Second,
+			WriteTimeout:   300 * time.Second,
+			MaxHeaderBytes: 1 << 20, // 1MB
+		}
 
 		go func() {
 			logger.Debug(logSender, "initializing HTTP server with config %+v", httpdConf)
-			s := &http.Server{
-				Addr:           fmt.Sprintf("%s:%d", httpdConf.BindAddress, httpdConf.BindPort),
-				Handler:        router,
-				ReadTimeout:    300 * time.Second,
-				WriteTimeout:   300 * time.Second,
-				MaxHeaderBytes: 1 << 20, // 1MB
-			}
-			if err := s.ListenAndServe(); err != nil {
+			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 				logger.Error(logSender, "could not start HTTP server: %v", err)
 			}
 			shutdown <- true
@@ -87,5 +98,31 @@ func main() {
 		logger.Debug(logSender, "HTTP server not started, disabled in config file")
 	}
 
-	<-shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-shutdown:
+			return
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				// errors are logged, the current configuration is kept if the new one is not valid
+				reloadConfig()
+				continue
+			}
+			timeout := time.Duration(config.GetSFTPDConfig().GracefulShutdownTimeout) * time.Second
+			logger.Info(logSender, "received signal %v, shutting down, timeout: %v", sig, timeout)
+			sftpd.Shutdown(timeout)
+			if httpServer != nil {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				if err := httpServer.Shutdown(ctx); err != nil {
+					logger.Warn(logSender, "error shutting down HTTP server: %v", err)
+				}
+				cancel()
+			}
+			logger.Info(logSender, "SFTPGo stopped")
+			return
+		}
+	}
 }
@@ -0,0 +1,340 @@
+package sftpd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefenderConfig defines the brute force protection. The failed logins and handshakes are scored for each
+// source IP and the IPs whose total score, inside the observation time, reaches the threshold are banned
+type DefenderConfig struct {
+	// Set to true to enable the defender
+	Enabled bool `json:"enabled"`
+	// Ban time as minutes
+	BanTime int `json:"ban_time"`
+	// The time window, as minutes, used to sum the scores for a host
+	ObservationTime int `json:"observation_time"`
+	// A host is banned when its total score reaches this value
+	Threshold int `json:"threshold"`
+	// Score for a login attempt with a non existent username
+	ScoreInvalid int `json:"score_invalid"`
+	// Score for a failed login attempt with an existing username
+	ScoreValid int `json:"score_valid"`
+	// Score for a connection closed, or failed, before any login attempt
+	ScoreHandshake int `json:"score_handshake"`
+	// Path to a file used to persist the banned hosts, relative paths are resolved against the config dir.
+	// Empty to disable
+	BanListFile string `json:"ban_list_file"`
+}
+
+// BannedHost defines a host banned by the defender
+type BannedHost struct {
+	// IP address
+	IP string `json:"ip"`
+	// Ban expiration as unix timestamp in milliseconds
+	BanTime int64 `json:"ban_time"`
+}
+
+type hostEvent struct {
+	date  time.Time
+	score int
+}
+
+// defender keeps the scored events and the banned hosts in memory
+type defender struct {
+	sync.RWMutex
+	config      DefenderConfig
+	banListPath string
+	hosts       map[string][]hostEvent
+	banned      map[string]time.Time
+	lastCleanup time.Time
+}
+
+var (
+	hostDefender *defender
+)
+
+func newDefender(config DefenderConfig, configDir string) (*defender, error) {
+	banListPath := config.BanListFile
+	if len(banListPath) > 0 && !filepath.IsAbs(banListPath) {
+		banListPath = filepath.Join(configDir, banListPath)
+	}
+	d := &defender{
+		config:      config,
+		banListPath: banListPath,
+		hosts:       make(map[string][]hostEvent),
+		banned:      make(map[string]time.Time),
+		lastCleanup: time.Now(),
+	}
+	if err := d.loadBanList(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// checkDefenderConfig fixes the invalid values, they are replaced with the defaults
+func (c *DefenderConfig) checkDefenderConfig() {
+	if c.BanTime <= 0 {
+		logger.Warn(logSender, "invalid defender ban_time %v, please fix your config file, 30 minutes will be used", c.BanTime)
+		c.BanTime = 30
+	}
+	if c.ObservationTime <= 0 {
+		logger.Warn(logSender, "invalid defender observation_time %v, please fix your config file, 30 minutes will be used",
+			c.ObservationTime)
+		c.ObservationTime = 30
+	}
+	if c.Threshold <= 0 {
+		logger.Warn(logSender, "invalid defender threshold %v, please fix your config file, 15 will be used", c.Threshold)
+		c.Threshold = 15
+	}
+	if c.ScoreInvalid < 0 || c.ScoreValid < 0 || c.ScoreHandshake < 0 {
+		logger.Warn(logSender, "negative defender scores are not allowed, please fix your config file, they will be set to 0")
+		if c.ScoreInvalid < 0 {
+			c.ScoreInvalid = 0
+		}
+		if c.ScoreValid < 0 {
+			c.ScoreValid = 0
+		}
+		if c.ScoreHandshake < 0 {
+			c.ScoreHandshake = 0
+		}
+	}
+}
+
+// isBanned returns true if the given IP is banned
+func (d *defender) isBanned(ip string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	if banTime, ok := d.banned[ip]; ok {
+		return time.Now().Before(banTime)
+	}
+	return false
+}
+
+// addEvent adds the given score to the host and bans it if the threshold is reached
+func (d *defender) addEvent(ip string, score int) {
+	if score <= 0 {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	now := time.Now()
+	d.cleanup(now)
+	if banTime, ok := d.banned[ip]; ok && now.Before(banTime) {
+		return
+	}
+	observationStart := now.Add(-time.Duration(d.config.ObservationTime) * time.Minute)
+	events := []hostEvent{}
+	totalScore := score
+	for _, event := range d.hosts[ip] {
+		if event.date.After(observationStart) {
+			events = append(events, event)
+			totalScore += event.score
+		}
+	}
+	if totalScore >= d.config.Threshold {
+		banTime := now.Add(time.Duration(d.config.BanTime) * time.Minute)
+		delete(d.hosts, ip)
+		d.banned[ip] = banTime
+		logger.Info(logSender, "host %v banned until %v, total score: %v", ip, banTime.Format(time.RFC3339), totalScore)
+		d.saveBanList()
+		return
+	}
+	d.hosts[ip] = append(events, hostEvent{date: now, score: score})
+	logger.Debug(logSender, "host %v scored %v, total score: %v/%v", ip, score, totalScore, d.config.Threshold)
+}
+
+// unban removes the ban and the scored events for the given IP, it returns false if the IP is not banned
+func (d *defender) unban(ip string) bool {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.hosts, ip)
+	banTime, ok := d.banned[ip]
+	if !ok {
+		return false
+	}
+	delete(d.banned, ip)
+	d.saveBanList()
+	if time.Now().After(banTime) {
+		return false
+	}
+	logger.Info(logSender, "host %v unbanned", ip)
+	return true
+}
+
+func (d *defender) getBannedHosts() []BannedHost {
+	d.RLock()
+	defer d.RUnlock()
+	now := time.Now()
+	hosts := []BannedHost{}
+	for ip, banTime := range d.banned {
+		if now.Before(banTime) {
+			hosts = append(hosts, BannedHost{
+				IP:      ip,
+				BanTime: utils.GetTimeAsMsSinceEpoch(banTime),
+			})
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].BanTime < hosts[j].BanTime
+	})
+	return hosts
+}
+
+// cleanup removes the expired bans and events, it runs at most once for each observation time
+// and it must be called with the lock held
+func (d *defender) cleanup(now time.Time) {
+	observationTime := time.Duration(d.config.ObservationTime) * time.Minute
+	if now.Sub(d.lastCleanup) < observationTime {
+		return
+	}
+	d.lastCleanup = now
+	for ip, events := range d.hosts {
+		if len(events) == 0 || now.Sub(events[len(events)-1].date) > observationTime {
+			delete(d.hosts, ip)
+		}
+	}
+	bansRemoved := false
+	for ip, banTime := range d.banned {
+		if now.After(banTime) {
+			delete(d.banned, ip)
+			bansRemoved = true
+		}
+	}
+	if bansRemoved {
+		d.saveBanList()
+	}
+}
+
+// saveBanList writes the active bans to the configured file, it must be called with the lock held
+func (d *defender) saveBanList() {
+	if len(d.banListPath) == 0 {
+		return
+	}
+	now := time.Now()
+	hosts := []BannedHost{}
+	for ip, banTime := range d.banned {
+		if now.Before(banTime) {
+			hosts = append(hosts, BannedHost{
+				IP:      ip,
+				BanTime: utils.GetTimeAsMsSinceEpoch(banTime),
+			})
+		}
+	}
+	content, err := json.Marshal(hosts)
+	if err == nil {
+		err = ioutil.WriteFile(d.banListPath, content, 0600)
+	}
+	if err != nil {
+		logger.Warn(logSender, "unable to save the banned hosts to file %#v: %v", d.banListPath, err)
+	}
+}
+
+// loadBanList loads the bans still active from the configured file, a missing file is not an error
+func (d *defender) loadBanList() error {
+	if len(d.banListPath) == 0 {
+		return nil
+	}
+	content, err := ioutil.ReadFile(d.banListPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		logger.Warn(logSender, "unable to read the banned hosts from file %#v: %v", d.banListPath, err)
+		return err
+	}
+	var hosts []BannedHost
+	if err = json.Unmarshal(content, &hosts); err != nil {
+		logger.Warn(logSender, "unable to parse the banned hosts file %#v: %v", d.banListPath, err)
+		return err
+	}
+	now := time.Now()
+	for _, host := range hosts {
+		banTime := time.Unix(0, host.BanTime*int64(time.Millisecond))
+		if now.Before(banTime) {
+			d.banned[host.IP] = banTime
+		}
+	}
+	logger.Info(logSender, "loaded %v banned hosts from file %#v", len(d.banned), d.banListPath)
+	return nil
+}
+
+func getDefender() *defender {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return hostDefender
+}
+
+// importBans copies the active bans from the given defender, it is used when the configuration is reloaded
+func (d *defender) importBans(from *defender) {
+	from.RLock()
+	defer from.RUnlock()
+	d.Lock()
+	defer d.Unlock()
+	now := time.Now()
+	for ip, banTime := range from.banned {
+		if now.Before(banTime) {
+			d.banned[ip] = banTime
+		}
+	}
+	d.saveBanList()
+}
+
+// GetBannedHosts returns the hosts currently banned by the defender
+func GetBannedHosts() []BannedHost {
+	d := getDefender()
+	if d == nil {
+		return []BannedHost{}
+	}
+	return d.getBannedHosts()
+}
+
+// UnbanHost removes the ban for the given IP. It returns false if the IP is not banned
+func UnbanHost(ip string) bool {
+	d := getDefender()
+	if d == nil {
+		return false
+	}
+	return d.unban(ip)
+}
+
+func isHostBanned(ip string) bool {
+	d := getDefender()
+	if d == nil {
+		return false
+	}
+	return d.isBanned(ip)
+}
+
+// addLoginFailure scores a failed login attempt, the score is higher if the username does not exist
+func addLoginFailure(conn ssh.ConnMetadata) {
+	d := getDefender()
+	if d == nil {
+		return
+	}
+	ip := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
+	score := d.config.ScoreValid
+	if _, err := dataprovider.UserExists(dataProvider, conn.User()); err != nil {
+		score = d.config.ScoreInvalid
+	}
+	d.addEvent(ip, score)
+}
+
+// addHandshakeFailure scores a connection closed, or failed, before any login attempt
+func addHandshakeFailure(ip string) {
+	d := getDefender()
+	if d == nil {
+		return
+	}
+	d.addEvent(ip, d.config.ScoreHandshake)
+}
@@ -1,25 +1,30 @@
 package sftpd
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/drakkan/sftpgo/utils"
-
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/pkg/sftp"
 )
 
+var errUploadStagingPath = errors.New("access to the upload staging dir is not allowed")
+
 // Connection details for an authenticated user
 type Connection struct {
 	// Unique identifier for the connection
@@ -34,15 +39,26 @@ type Connection struct {
 	StartTime time.Time
 	// last activity for this connection
 	lastActivity time.Time
-	lock         *sync.Mutex
-	sshConn      *ssh.ServerConn
+	// protocol for this connection: SFTP, SCP or SSH
+	protocol string
+	lock     *sync.Mutex
+	sshConn  *ssh.ServerConn
+	fs       vfs.Fs
 }
 
 // Fileread creates a reader for a file on the system and returns the reader back.
 func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 	updateConnectionActivity(c.ID)
+	if isShuttingDown() {
+		logger.Info(logSender, "denying download of %v: %v", request.Filepath, errShuttingDown)
+		return nil, sftp.ErrSshFxFailure
+	}
+
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(request.Filepath)) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
 
-	if !c.User.HasPerm(dataprovider.PermDownload) {
+	if !c.isFileAllowed(request.Filepath, operationDownload) {
 		return nil, sftp.ErrSshFxPermissionDenied
 	}
 
@@ -54,11 +70,11 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	if _, err := os.Stat(p); os.IsNotExist(err) {
+	if _, err := c.fs.Stat(p); c.fs.IsNotExist(err) {
 		return nil, sftp.ErrSshFxNoSuchFile
 	}
 
-	file, err := os.Open(p)
+	file, err := c.fs.Open(p)
 	if err != nil {
 		logger.Error(logSender, "could not open file \"%v\" for reading: %v", p, err)
 		return nil, sftp.ErrSshFxFailure
@@ -69,6 +85,7 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 	transfer := Transfer{
 		file:          file,
 		path:          p,
+		requestPath:   request.Filepath,
 		start:         time.Now(),
 		bytesSent:     0,
 		bytesReceived: 0,
@@ -76,6 +93,7 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 		connectionID:  c.ID,
 		transferType:  transferDownload,
 		isNewFile:     false,
+		protocol:      c.protocol,
 	}
 	addTransfer(&transfer)
 	return &transfer, nil
@@ -84,7 +102,15 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 // Filewrite handles the write actions for a file on the system.
 func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 	updateConnectionActivity(c.ID)
-	if !c.User.HasPerm(dataprovider.PermUpload) {
+	if isShuttingDown() {
+		logger.Info(logSender, "denying upload of %v: %v", request.Filepath, errShuttingDown)
+		return nil, sftp.ErrSshFxFailure
+	}
+	if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(request.Filepath)) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+
+	if !c.isFileAllowed(request.Filepath, operationUpload) {
 		return nil, sftp.ErrSshFxPermissionDenied
 	}
 
@@ -96,38 +122,44 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	stat, statErr := os.Stat(p)
+	stat, statErr := c.fs.Stat(p)
 	// If the file doesn't exist we need to create it, as well as the directory pathway
 	// leading up to where that file will be created.
-	if os.IsNotExist(statErr) {
-		if !c.hasSpace(true) {
+	if c.fs.IsNotExist(statErr) {
+		if !c.hasSpace(true, request.Filepath) {
 			logger.Info(logSender, "denying file write due to space limit")
 			return nil, sftp.ErrSshFxFailure
 		}
+		maxFileSize, err := c.getMaxFileSize(request.Filepath, 0, 0)
+		if err != nil {
+			logger.Info(logSender, "denying file write due to space limit: %v", err)
+			return nil, sftp.ErrSshFxFailure
+		}
 
-		if _, err := os.Stat(filepath.Dir(p)); os.IsNotExist(err) {
-			if !c.User.HasPerm(dataprovider.PermCreateDirs) {
+		if _, err := c.fs.Stat(filepath.Dir(p)); c.fs.IsNotExist(err) {
+			if !c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(path.Dir(request.Filepath))) {
 				return nil, sftp.ErrSshFxPermissionDenied
 			}
 		}
 
-		err = c.createMissingDirs(p)
+		err = c.createMissingDirs(p, c.getFsRoot(request.Filepath))
 		if err != nil {
 			logger.Error(logSender, "error making missing dir for path %v: %v", p, err)
 			return nil, sftp.ErrSshFxFailure
 		}
 
-		file, err := os.Create(p)
+		file, tempPath, err := c.openUploadFile(p, request.Filepath, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
 		if err != nil {
 			logger.Error(logSender, "error creating file %v: %v", p, err)
 			return nil, sftp.ErrSshFxFailure
 		}
 
-		utils.SetPathPermissions(p, c.User.GetUID(), c.User.GetGID())
-
 		transfer := Transfer{
 			file:          file,
 			path:          p,
+			tempPath:      tempPath,
+			fs:            c.fs,
+			requestPath:   request.Filepath,
 			start:         time.Now(),
 			bytesSent:     0,
 			bytesReceived: 0,
@@ -135,6 +167,8 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 			connectionID:  c.ID,
 			transferType:  transferUpload,
 			isNewFile:     true,
+			maxFileSize:   maxFileSize,
+			protocol:      c.protocol,
 		}
 		addTransfer(&transfer)
 		return &transfer, nil
@@ -145,7 +179,7 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 		return nil, sftp.ErrSshFxFailure
 	}
 
-	if !c.hasSpace(false) {
+	if !c.hasSpace(false, request.Filepath) {
 		logger.Info(logSender, "denying file write due to space limit")
 		return nil, sftp.ErrSshFxFailure
 	}
@@ -156,38 +190,71 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 		return nil, sftp.ErrSshFxOpUnsupported
 	}
 
-	osFlags, trunc := getOSOpenFlags(request.Pflags())
+	pflags := request.Pflags()
+	osFlags, trunc := getOSOpenFlags(pflags)
 
-	if !trunc {
-		// see https://github.com/pkg/sftp/issues/295
-		logger.Info(logSender, "upload resume is not supported, returning error")
+	if !trunc && c.isAtomicUploadEnabled() {
+		logger.Warn(logSender, "upload resume or append requested for path: %v, not supported in atomic upload mode", p)
 		return nil, sftp.ErrSshFxOpUnsupported
 	}
 
-	// we use 0666 so the umask is applied
-	file, err := os.OpenFile(p, osFlags, 0666)
+	var maxFileSize int64
+	if trunc {
+		// the existing file is truncated or replaced so its size will be released
+		maxFileSize, err = c.getMaxFileSize(request.Filepath, 0, stat.Size())
+	} else {
+		maxFileSize, err = c.getMaxFileSize(request.Filepath, stat.Size(), 0)
+	}
+	if err != nil {
+		logger.Info(logSender, "denying file write due to space limit: %v", err)
+		return nil, sftp.ErrSshFxFailure
+	}
+
+	file, tempPath, err := c.openUploadFile(p, request.Filepath, osFlags)
 	if err != nil {
 		logger.Error(logSender, "error opening existing file, flags: %v, source: %v, err: %v", request.Flags, p, err)
 		return nil, sftp.ErrSshFxFailure
 	}
 
-	if trunc {
+	var initialSize int64
+	var minWriteOffset int64
+	var replacedSize int64
+	if len(tempPath) > 0 {
+		// the existing file will be replaced when the upload completes, the quota is updated then
+		replacedSize = stat.Size()
+	} else if trunc {
 		// the file is truncated so we need to decrease quota size but not quota files
-		dataprovider.UpdateUserQuota(dataProvider, c.User, 0, -stat.Size(), false)
+		c.updateQuota(request.Filepath, 0, -stat.Size())
+	} else {
+		// upload resume or append: only the bytes that grow the file will be added to the used quota
+		initialSize = stat.Size()
+		if pflags.Append {
+			minWriteOffset = initialSize
+		}
+		logger.Debug(logSender, "upload resume requested for path: %v, initial size: %v, append: %v", p, initialSize,
+			pflags.Append)
 	}
 
-	utils.SetPathPermissions(p, c.User.GetUID(), c.User.GetGID())
-
 	transfer := Transfer{
-		file:          file,
-		path:          p,
-		start:         time.Now(),
-		bytesSent:     0,
-		bytesReceived: 0,
-		user:          c.User,
-		connectionID:  c.ID,
-		transferType:  transferUpload,
-		isNewFile:     false,
+		file:           file,
+		path:           p,
+		tempPath:       tempPath,
+		fs:             c.fs,
+		requestPath:    request.Filepath,
+		start:          time.Now(),
+		bytesSent:      0,
+		bytesReceived:  0,
+		user:           c.User,
+		connectionID:   c.ID,
+		transferType:   transferUpload,
+		isNewFile:      false,
+		isResume:       !trunc,
+		initialSize:    initialSize,
+		minWriteOffset: minWriteOffset,
+		maxWriteOffset: initialSize,
+		replacedSize:   replacedSize,
+		maxFileSize:    maxFileSize,
+		protocol:       c.protocol,
 	}
 	addTransfer(&transfer)
 	return &transfer, nil
@@ -213,33 +280,33 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 
 	switch request.Method {
 	case "Setstat":
-		return nil
+		return c.handleSFTPSetstat(p, request)
 	case "Rename":
-		err = c.handleSFTPRename(p, target)
+		err = c.handleSFTPRename(p, target, request)
 		if err != nil {
 			return err
 		}
 
 		break
 	case "Rmdir":
-		return c.handleSFTPRmdir(p)
+		return c.handleSFTPRmdir(p, request)
 
 	case "Mkdir":
-		err = c.handleSFTPMkdir(p)
+		err = c.handleSFTPMkdir(p, request)
 		if err != nil {
 			return err
 		}
 
 		break
 	case "Symlink":
-		err = c.handleSFTPSymlink(p, target)
+		err = c.handleSFTPSymlink(p, target, request)
 		if err != nil {
 			return err
 		}
 
 		break
 	case "Remove":
-		return c.handleSFTPRemove(p)
+		return c.handleSFTPRemove(p, request)
 
 	default:
 		return sftp.ErrSshFxOpUnsupported
@@ -251,7 +318,7 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 	}
 
 	// we return if we remove a file or a dir so source path or target path always exists here
-	utils.SetPathPermissions(fileLocation, c.User.GetUID(), c.User.GetGID())
+	vfs.SetPathPermissions(c.fs, fileLocation, c.User.GetUID(), c.User.GetGID())
 
 	return sftp.ErrSshFxOk
 }
@@ -260,6 +327,13 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 // a directory as well as perform file/folder stat calls.
 func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 	updateConnectionActivity(c.ID)
+	// the last path element is not resolved for these methods so they are handled separately
+	if request.Method == "Readlink" {
+		return c.handleSFTPReadlink(request)
+	}
+	if request.Method == "Lstat" {
+		return c.handleSFTPLstat(request)
+	}
 	p, err := c.buildPath(request.Filepath)
 	if err != nil {
 		return nil, sftp.ErrSshFxNoSuchFile
@@ -267,27 +341,27 @@ func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 
 	switch request.Method {
 	case "List":
-		if !c.User.HasPerm(dataprovider.PermListItems) {
+		if !c.User.HasPerm(dataprovider.PermListItems, request.Filepath) {
 			return nil, sftp.ErrSshFxPermissionDenied
 		}
 
 		logger.Debug(logSender, "requested list file for dir: %v user: %v", p, c.User.Username)
 
-		files, err := ioutil.ReadDir(p)
+		lister, err := c.getDirLister(request.Filepath, p)
 		if err != nil {
 			logger.Error(logSender, "error listing directory: %v", err)
 			return nil, sftp.ErrSshFxFailure
 		}
 
-		return listerAt(files), nil
+		return lister, nil
 	case "Stat":
-		if !c.User.HasPerm(dataprovider.PermListItems) {
+		if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(request.Filepath)) {
 			return nil, sftp.ErrSshFxPermissionDenied
 		}
 
 		logger.Debug(logSender, "requested stat for file: %v user: %v", p, c.User.Username)
-		s, err := os.Stat(p)
-		if os.IsNotExist(err) {
+		s, err := c.fs.Stat(p)
+		if c.fs.IsNotExist(err) {
 			return nil, sftp.ErrSshFxNoSuchFile
 		} else if err != nil {
 			logger.Error(logSender, "error running STAT on file: %v", err)
@@ -300,6 +374,65 @@ func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 	}
 }
 
+// Lstat implements the sftp.LstatFileLister interface, LSTAT requests are dispatched here and the symbolic
+// links are not followed
+func (c Connection) Lstat(request *sftp.Request) (sftp.ListerAt, error) {
+	return c.Filelist(request)
+}
+
+// handleSFTPReadlink returns the target of a symbolic link as a path inside the user virtual root,
+// the real filesystem paths are never disclosed. Reading a link pointing outside the user home, or outside
+// the virtual folders, is denied
+func (c Connection) handleSFTPReadlink(request *sftp.Request) (sftp.ListerAt, error) {
+	if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(request.Filepath)) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+	p, err := c.buildLinkPath(request.Filepath)
+	if err != nil {
+		return nil, sftp.ErrSshFxNoSuchFile
+	}
+	logger.Debug(logSender, "requested readlink for file: %v user: %v", p, c.User.Username)
+	s, err := c.fs.Lstat(p)
+	if c.fs.IsNotExist(err) {
+		return nil, sftp.ErrSshFxNoSuchFile
+	} else if err != nil {
+		logger.Error(logSender, "error running LSTAT on file: %v", err)
+		return nil, sftp.ErrSshFxFailure
+	}
+	target, err := c.fs.Readlink(p)
+	if err != nil {
+		logger.Warn(logSender, "error reading link %v: %v", p, err)
+		return nil, sftp.ErrSshFxFailure
+	}
+	virtualTarget, err := c.getLinkVirtualTarget(p, target)
+	if err != nil {
+		logger.Warn(logSender, "readlink denied for link %v: %v", p, err)
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+	return listerAt([]os.FileInfo{linkTargetInfo{FileInfo: s, target: virtualTarget}}), nil
+}
+
+// handleSFTPLstat returns the file info for the given path, symbolic links are not followed so links
+// pointing outside the user home are reported as links instead of being resolved
+func (c Connection) handleSFTPLstat(request *sftp.Request) (sftp.ListerAt, error) {
+	if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(request.Filepath)) {
+		return nil, sftp.ErrSshFxPermissionDenied
+	}
+	p, err := c.buildLinkPath(request.Filepath)
+	if err != nil {
+		return nil, sftp.ErrSshFxNoSuchFile
+	}
+	logger.Debug(logSender, "requested lstat for file: %v user: %v", p, c.User.Username)
+	s, err := c.fs.Lstat(p)
+	if c.fs.IsNotExist(err) {
+		return nil, sftp.ErrSshFxNoSuchFile
+	} else if err != nil {
+		logger.Error(logSender, "error running LSTAT on file: %v", err)
+		return nil, sftp.ErrSshFxFailure
+	}
+	return listerAt([]os.FileInfo{s}), nil
+}
+
 func (c Connection) getSFTPCmdTargetPath(requestTarget string) (string, error) {
 	var target string
 	// If a target is provided in this request validate that it is going to the correct
@@ -315,47 +448,68 @@ func (c Connection) getSFTPCmdTargetPath(requestTarget string) (string, error) {
 	return target, nil
 }
 
-func (c Connection) handleSFTPRename(sourcePath string, targetPath string) error {
-	if !c.User.HasPerm(dataprovider.PermRename) {
+func (c Connection) handleSFTPRename(sourcePath string, targetPath string, request *sftp.Request) error {
+	if !c.User.HasPerm(dataprovider.PermRename, path.Dir(request.Filepath)) ||
+		!c.User.HasPerm(dataprovider.PermRename, path.Dir(request.Target)) {
 		return sftp.ErrSshFxPermissionDenied
 	}
-	if err := os.Rename(sourcePath, targetPath); err != nil {
+	if c.isVirtualFolderAffected(request.Filepath) || c.isVirtualFolderAffected(request.Target) {
+		logger.Warn(logSender, "renaming a virtual folder is not allowed, source: %v target: %v", request.Filepath,
+			request.Target)
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if fi, err := c.fs.Lstat(sourcePath); err == nil && !fi.IsDir() && !c.isFileAllowed(request.Target, operationRename) {
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if c.getFsRoot(request.Filepath) != c.getFsRoot(request.Target) {
+		if err := c.renameAcrossFolders(sourcePath, targetPath, request); err != nil {
+			return err
+		}
+	} else if err := c.fs.Rename(sourcePath, targetPath); err != nil {
 		logger.Error(logSender, "failed to rename file, source: %v target: %v: %v", sourcePath, targetPath, err)
 		return sftp.ErrSshFxFailure
 	}
 	logger.CommandLog(sftpdRenameLogSender, sourcePath, targetPath, c.User.Username, c.ID)
-	executeAction(operationRename, c.User.Username, sourcePath, targetPath)
+	executeAction(operationRename, c.User.Username, sourcePath, targetPath, actionStatusOK)
 	return nil
 }
 
-func (c Connection) handleSFTPRmdir(path string) error {
-	if !c.User.HasPerm(dataprovider.PermDelete) {
+func (c Connection) handleSFTPRmdir(dirPath string, request *sftp.Request) error {
+	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(request.Filepath)) {
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if c.isVirtualFolderAffected(request.Filepath) {
+		logger.Warn(logSender, "removing a virtual folder is not allowed: %v", request.Filepath)
 		return sftp.ErrSshFxPermissionDenied
 	}
 
-	numFiles, size, fileList, err := utils.ScanDirContents(path)
+	numFiles, size, fileList, err := vfs.ScanDirContents(c.fs, dirPath)
 	if err != nil {
-		logger.Error(logSender, "failed to remove directory %v, scanning error: %v", path, err)
+		logger.Error(logSender, "failed to remove directory %v, scanning error: %v", dirPath, err)
 		return sftp.ErrSshFxFailure
 	}
-	if err := os.RemoveAll(path); err != nil {
-		logger.Error(logSender, "failed to remove directory %v: %v", path, err)
+	if err := c.fs.RemoveAll(dirPath); err != nil {
+		logger.Error(logSender, "failed to remove directory %v: %v", dirPath, err)
 		return sftp.ErrSshFxFailure
 	}
 
-	logger.CommandLog(sftpdRmdirLogSender, path, "", c.User.Username, c.ID)
-	dataprovider.UpdateUserQuota(dataProvider, c.User, -numFiles, -size, false)
+	logger.CommandLog(sftpdRmdirLogSender, dirPath, "", c.User.Username, c.ID)
+	c.updateQuota(request.Filepath, -numFiles, -size)
 	for _, p := range fileList {
-		executeAction(operationDelete, c.User.Username, p, "")
+		executeAction(operationDelete, c.User.Username, p, "", actionStatusOK)
 	}
 	return sftp.ErrSshFxOk
 }
 
-func (c Connection) handleSFTPSymlink(sourcePath string, targetPath string) error {
-	if !c.User.HasPerm(dataprovider.PermCreateSymlinks) {
+func (c Connection) handleSFTPSymlink(sourcePath string, targetPath string, request *sftp.Request) error {
+	if !c.User.HasPerm(dataprovider.PermCreateSymlinks, path.Dir(request.Target)) {
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if c.isVirtualFolderAffected(request.Target) {
+		logger.Warn(logSender, "creating a symlink over a virtual folder is not allowed: %v", request.Target)
 		return sftp.ErrSshFxPermissionDenied
 	}
-	if err := os.Symlink(sourcePath, targetPath); err != nil {
+	if err := c.fs.Symlink(sourcePath, targetPath); err != nil {
 		logger.Warn(logSender, "failed to create symlink %v -> %v: %v", sourcePath, targetPath, err)
 		return sftp.ErrSshFxFailure
 	}
@@ -364,47 +518,282 @@ func (c Connection) handleSFTPSymlink(sourcePath string, targetPath string) erro
 	return nil
 }
 
-func (c Connection) handleSFTPMkdir(path string) error {
-	if !c.User.HasPerm(dataprovider.PermCreateDirs) {
+// handleSFTPSetstat changes the mode, the owner and the times of the given path, each change requires
+// its own permission. Changing the size is not supported
+func (c Connection) handleSFTPSetstat(filePath string, request *sftp.Request) error {
+	attrFlags := request.AttrFlags()
+	attrs := request.Attributes()
+	if attrFlags.Size {
+		logger.Warn(logSender, "setstat for path %v: changing the size is not supported", filePath)
+		return sftp.ErrSshFxOpUnsupported
+	}
+	requiredPerms := []string{}
+	if attrFlags.Permissions {
+		requiredPerms = append(requiredPerms, dataprovider.PermChmod)
+	}
+	if attrFlags.UidGid {
+		requiredPerms = append(requiredPerms, dataprovider.PermChown)
+	}
+	if attrFlags.Acmodtime {
+		requiredPerms = append(requiredPerms, dataprovider.PermChtimes)
+	}
+	for _, perm := range requiredPerms {
+		if !c.User.HasPerm(perm, path.Dir(request.Filepath)) {
+			return sftp.ErrSshFxPermissionDenied
+		}
+	}
+	skipChown := false
+	if attrFlags.UidGid && (int(attrs.UID) != c.User.GetUID() || int(attrs.GID) != c.User.GetGID()) {
+		// clients such as sshfs send the current owner, this is always allowed and there is nothing to change.
+		// Users without an uid/gid mapping can only do this
+		if !c.isFileOwner(filePath, int(attrs.UID), int(attrs.GID)) {
+			logger.Warn(logSender, "setstat for path %v: chown to uid %v gid %v is not allowed, user uid %v gid %v",
+				filePath, attrs.UID, attrs.GID, c.User.GetUID(), c.User.GetGID())
+			return sftp.ErrSshFxPermissionDenied
+		}
+		skipChown = true
+	}
+	if attrFlags.Permissions {
+		if err := c.fs.Chmod(filePath, attrs.FileMode().Perm()); err != nil {
+			logger.Warn(logSender, "failed to chmod path %v, mode: %v: %v", filePath, attrs.FileMode().Perm(), err)
+			return sftp.ErrSshFxFailure
+		}
+		logger.CommandLog(sftpdChmodLogSender, filePath, "", c.User.Username, c.ID)
+	}
+	if attrFlags.UidGid && !skipChown {
+		if err := c.fs.Chown(filePath, int(attrs.UID), int(attrs.GID)); err != nil {
+			logger.Warn(logSender, "failed to chown path %v, uid: %v, gid: %v: %v", filePath, attrs.UID, attrs.GID, err)
+			return sftp.ErrSshFxFailure
+		}
+		logger.CommandLog(sftpdChownLogSender, filePath, "", c.User.Username, c.ID)
+	}
+	if attrFlags.Acmodtime {
+		atime := time.Unix(int64(attrs.Atime), 0)
+		mtime := time.Unix(int64(attrs.Mtime), 0)
+		if err := c.fs.Chtimes(filePath, atime, mtime); err != nil {
+			logger.Warn(logSender, "failed to chtimes path %v, atime: %v, mtime: %v: %v", filePath, atime, mtime, err)
+			return sftp.ErrSshFxFailure
+		}
+		logger.CommandLog(sftpdChtimesLogSender, filePath, "", c.User.Username, c.ID)
+	}
+	return nil
+}
+
+// isFileOwner returns true if the given uid and gid are the current owner of the file
+func (c Connection) isFileOwner(filePath string, uid int, gid int) bool {
+	fi, err := c.fs.Stat(filePath)
+	if err != nil {
+		return false
+	}
+	fileUID, fileGID, ok := utils.GetFileOwner(fi)
+	return ok && fileUID == uid && fileGID == gid
+}
+
+func (c Connection) handleSFTPMkdir(dirPath string, request *sftp.Request) error {
+	if !c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(request.Filepath)) {
 		return sftp.ErrSshFxPermissionDenied
 	}
 
-	if err := c.createMissingDirs(filepath.Join(path, "testfile")); err != nil {
-		logger.Error(logSender, "error making missing dir for path %v: %v", path, err)
+	if err := c.createMissingDirs(filepath.Join(dirPath, "testfile"), c.getFsRoot(request.Filepath)); err != nil {
+		logger.Error(logSender, "error making missing dir for path %v: %v", dirPath, err)
 		return sftp.ErrSshFxFailure
 	}
-	logger.CommandLog(sftpdMkdirLogSender, path, "", c.User.Username, c.ID)
+	logger.CommandLog(sftpdMkdirLogSender, dirPath, "", c.User.Username, c.ID)
 	return nil
 }
 
-func (c Connection) handleSFTPRemove(path string) error {
-	if !c.User.HasPerm(dataprovider.PermDelete) {
+func (c Connection) handleSFTPRemove(filePath string, request *sftp.Request) error {
+	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(request.Filepath)) {
+		return sftp.ErrSshFxPermissionDenied
+	}
+	if c.isVirtualFolderAffected(request.Filepath) {
+		logger.Warn(logSender, "removing a virtual folder is not allowed: %v", request.Filepath)
 		return sftp.ErrSshFxPermissionDenied
 	}
 
 	var size int64
 	var fi os.FileInfo
 	var err error
-	if fi, err = os.Lstat(path); err != nil {
-		logger.Error(logSender, "failed to remove a file %v: stat error: %v", path, err)
+	if fi, err = c.fs.Lstat(filePath); err != nil {
+		logger.Error(logSender, "failed to remove a file %v: stat error: %v", filePath, err)
 		return sftp.ErrSshFxFailure
 	}
 	size = fi.Size()
-	if err := os.Remove(path); err != nil {
-		logger.Error(logSender, "failed to remove a file/symlink %v: %v", path, err)
+	if err := c.fs.Remove(filePath); err != nil {
+		logger.Error(logSender, "failed to remove a file/symlink %v: %v", filePath, err)
 		return sftp.ErrSshFxFailure
 	}
 
-	logger.CommandLog(sftpdRemoveLogSender, path, "", c.User.Username, c.ID)
+	logger.CommandLog(sftpdRemoveLogSender, filePath, "", c.User.Username, c.ID)
 	if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
-		dataprovider.UpdateUserQuota(dataProvider, c.User, -1, -size, false)
+		c.updateQuota(request.Filepath, -1, -size)
 	}
-	executeAction(operationDelete, c.User.Username, path, "")
+	executeAction(operationDelete, c.User.Username, filePath, "", actionStatusOK)
 
 	return sftp.ErrSshFxOk
 }
 
-func (c Connection) hasSpace(checkFiles bool) bool {
+// renameAcrossFolders renames a file or a directory between the home dir and a virtual folder or
+// between two virtual folders. Regular files are copied if they cannot be renamed, for example
+// because the virtual folder is on a different filesystem. The user quota is updated if only one
+// between source and target is excluded from quota
+func (c Connection) renameAcrossFolders(sourcePath string, targetPath string, request *sftp.Request) error {
+	fi, err := c.fs.Lstat(sourcePath)
+	if err != nil {
+		logger.Error(logSender, "failed to rename file, source: %v target: %v: stat error: %v", sourcePath,
+			targetPath, err)
+		return sftp.ErrSshFxFailure
+	}
+	numFiles := 0
+	var size int64
+	if fi.IsDir() {
+		numFiles, size, _, err = vfs.ScanDirContents(c.fs, sourcePath)
+		if err != nil {
+			logger.Error(logSender, "failed to rename directory %v, scanning error: %v", sourcePath, err)
+			return sftp.ErrSshFxFailure
+		}
+	} else if fi.Mode().IsRegular() {
+		numFiles = 1
+		size = fi.Size()
+	}
+	sourceExcluded := c.User.IsFileExcludedFromQuota(request.Filepath)
+	targetExcluded := c.User.IsFileExcludedFromQuota(request.Target)
+	if sourceExcluded && !targetExcluded && !c.hasSpace(true, request.Target) {
+		logger.Info(logSender, "denying rename due to space limit")
+		return sftp.ErrSshFxFailure
+	}
+	if err = c.fs.Rename(sourcePath, targetPath); err != nil {
+		if !fi.Mode().IsRegular() {
+			logger.Error(logSender, "failed to rename file, source: %v target: %v: %v", sourcePath, targetPath, err)
+			return sftp.ErrSshFxFailure
+		}
+		logger.Debug(logSender, "unable to rename %v to %v: %v, try to copy", sourcePath, targetPath, err)
+		if err = moveFile(c.fs, sourcePath, targetPath, fi); err != nil {
+			logger.Error(logSender, "failed to move file, source: %v target: %v: %v", sourcePath, targetPath, err)
+			return sftp.ErrSshFxFailure
+		}
+	}
+	if !sourceExcluded && targetExcluded {
+		dataprovider.UpdateUserQuota(dataProvider, c.User, -numFiles, -size, false)
+	} else if sourceExcluded && !targetExcluded {
+		dataprovider.UpdateUserQuota(dataProvider, c.User, numFiles, size, false)
+	}
+	return nil
+}
+
+// isVirtualFolderAffected returns true if the given virtual path is a virtual folder or contains
+// virtual folders, such paths cannot be renamed or removed
+func (c Connection) isVirtualFolderAffected(virtualPath string) bool {
+	return c.User.IsVirtualFolder(virtualPath) || c.User.HasVirtualFoldersInside(virtualPath)
+}
+
+// updateQuota updates the user quota, the changes inside virtual folders excluded from quota are ignored
+func (c Connection) updateQuota(virtualPath string, filesAdd int, sizeAdd int64) {
+	if c.User.IsFileExcludedFromQuota(virtualPath) {
+		return
+	}
+	dataprovider.UpdateUserQuota(dataProvider, c.User, filesAdd, sizeAdd, false)
+}
+
+// readDir returns the contents of the given directory, the virtual folders inside it are included
+// using their virtual names. The entries matching the hide patterns are not included
+func (c Connection) readDir(virtualPath string, fsPath string) ([]os.FileInfo, error) {
+	files, err := c.fs.ReadDir(fsPath)
+	if err != nil {
+		return files, err
+	}
+	skipNames := c.getDirSkipNames(virtualPath, fsPath)
+	filter := c.getListingPatternsFilter(virtualPath)
+	result := make([]os.FileInfo, 0, len(files))
+	for _, f := range files {
+		if utils.IsStringInSlice(f.Name(), skipNames) || isHiddenName(f.Name()) {
+			continue
+		}
+		if filter != nil && !f.IsDir() && !filter.IsNameAllowed(f.Name()) {
+			continue
+		}
+		result = append(result, f)
+	}
+	for _, info := range c.getVirtualFoldersInfo(virtualPath) {
+		if isHiddenName(info.Name()) {
+			continue
+		}
+		found := false
+		for i, f := range result {
+			if f.Name() == info.Name() {
+				result[i] = info
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, info)
+		}
+	}
+	return result, nil
+}
+
+// isFileAllowed returns true if the file patterns filters allow the given virtual path, the denied
+// operations are logged using a dedicated sender
+func (c Connection) isFileAllowed(virtualPath, operation string) bool {
+	if c.User.IsFileAllowed(virtualPath) {
+		return true
+	}
+	logger.Info(fileFilterLogSender, "%v denied by the file patterns filters, path: %#v, user: %v, protocol: %v, connection id: %v",
+		operation, virtualPath, c.User.Username, c.protocol, c.ID)
+	return false
+}
+
+// getDirLister returns a lister that reads the contents of the given directory incrementally
+func (c Connection) getDirLister(virtualPath string, fsPath string) (sftp.ListerAt, error) {
+	dir, err := c.fs.OpenDir(fsPath)
+	if err != nil {
+		return nil, err
+	}
+	lister := newDirLister(c.ID, dir, fsPath, c.getVirtualFoldersInfo(virtualPath), c.getDirSkipNames(virtualPath, fsPath))
+	lister.filter = c.getListingPatternsFilter(virtualPath)
+	addDirLister(lister)
+	return lister, nil
+}
+
+// getListingPatternsFilter returns the file patterns filter to apply listing the given virtual directory,
+// nil means that the denied files must be listed too
+func (c Connection) getListingPatternsFilter(virtualPath string) *dataprovider.PatternsFilter {
+	if filter, ok := c.User.GetPatternsFilterForDir(virtualPath); ok && filter.HideDenied {
+		return &filter
+	}
+	return nil
+}
+
+// getVirtualFoldersInfo returns the info for the virtual folders inside the given virtual directory,
+// they are reported using their virtual names
+func (c Connection) getVirtualFoldersInfo(virtualPath string) []os.FileInfo {
+	var result []os.FileInfo
+	for _, folder := range c.User.GetVirtualFoldersInDir(virtualPath) {
+		fi, err := c.fs.Stat(folder.MappedPath)
+		if err != nil {
+			logger.Warn(logSender, "unable to stat virtual folder %v mapped path %v: %v", folder.VirtualPath,
+				folder.MappedPath, err)
+			continue
+		}
+		result = append(result, virtualFolderInfo{FileInfo: fi, name: path.Base(folder.VirtualPath)})
+	}
+	return result
+}
+
+// getDirSkipNames returns the names that must never be listed for the given directory
+func (c Connection) getDirSkipNames(virtualPath string, fsPath string) []string {
+	if fsPath == c.getFsRoot(virtualPath) {
+		// the staging dir for atomic uploads must not be visible
+		return []string{uploadStagingDirName}
+	}
+	return nil
+}
+
+func (c Connection) hasSpace(checkFiles bool, requestPath string) bool {
+	if c.User.IsFileExcludedFromQuota(requestPath) {
+		return true
+	}
 	if (checkFiles && c.User.QuotaFiles > 0) || c.User.QuotaSize > 0 {
 		numFile, size, err := dataprovider.GetUsedQuota(dataProvider, c.User.Username)
 		if err != nil {
@@ -425,52 +814,191 @@ func (c Connection) hasSpace(checkFiles bool) bool {
 	return true
 }
 
+// getMaxFileSize returns the maximum size allowed for a file uploaded to the given path, 0 means unlimited.
+// The limit is the minimum between the maximum upload file size and the size allowed by the remaining quota,
+// errQuotaExceeded is returned if the remaining quota does not allow to write any new byte.
+// initialSize is the size of the existing data kept by a resumed upload, replacedSize the size of the existing
+// file overwritten by the upload: it is still included in the used quota but it will be released
+func (c Connection) getMaxFileSize(requestPath string, initialSize int64, replacedSize int64) (int64, error) {
+	maxFileSize := c.User.Filters.MaxUploadFileSize
+	if c.User.QuotaSize > 0 && !c.User.IsFileExcludedFromQuota(requestPath) {
+		_, size, err := dataprovider.GetUsedQuota(dataProvider, c.User.Username)
+		if err != nil {
+			logger.Warn(logSender, "unable to get the used quota for %v, the remaining size will not be enforced: %v",
+				c.User.Username, err)
+			return maxFileSize, nil
+		}
+		quotaMaxFileSize := initialSize + replacedSize + c.User.QuotaSize - size
+		if quotaMaxFileSize <= initialSize {
+			// 0 means unlimited so we cannot return it, nothing can be written
+			logger.Debug(logSender, "no space left for user %v, used size: %v/%v, initial size: %v, replaced size: %v",
+				c.User.Username, size, c.User.QuotaSize, initialSize, replacedSize)
+			return 0, errQuotaExceeded
+		}
+		if maxFileSize == 0 || quotaMaxFileSize < maxFileSize {
+			maxFileSize = quotaMaxFileSize
+		}
+	}
+	return maxFileSize, nil
+}
+
+// isAtomicUploadEnabled returns true if the uploads must be written to a temporary file
+func (c Connection) isAtomicUploadEnabled() bool {
+	return getUploadMode() == uploadModeAtomic && c.fs.IsAtomicUploadSupported()
+}
+
+// openUploadFile opens the file to write for an upload to fsPath. In atomic mode the data are written to
+// a new temporary file inside the upload staging dir and its path is returned, the temporary file will be
+// renamed to fsPath when the upload completes
+func (c Connection) openUploadFile(fsPath, requestPath string, flag int) (vfs.File, string, error) {
+	if !c.isAtomicUploadEnabled() {
+		// we use 0666 so the umask is applied
+		file, err := c.fs.OpenFile(fsPath, flag, 0666)
+		if err == nil {
+			vfs.SetPathPermissions(c.fs, fsPath, c.User.GetUID(), c.User.GetGID())
+		}
+		return file, "", err
+	}
+	stagingDir := filepath.Join(c.getFsRoot(requestPath), uploadStagingDirName)
+	if err := c.fs.MkdirAll(stagingDir, 0700); err != nil {
+		return nil, "", err
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	tempPath := filepath.Join(stagingDir, hex.EncodeToString(b)+"."+filepath.Base(fsPath))
+	file, err := c.fs.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, "", err
+	}
+	vfs.SetPathPermissions(c.fs, tempPath, c.User.GetUID(), c.User.GetGID())
+	logger.Debug(logSender, "atomic upload for path %v, temporary file: %v", fsPath, tempPath)
+	return file, tempPath, nil
+}
+
+// getFsRoot returns the filesystem root for the given virtual path: the mapped path if the
+// virtual path is inside a virtual folder, the user home dir otherwise
+func (c Connection) getFsRoot(virtualPath string) string {
+	if folder, err := c.User.GetVirtualFolderForPath(virtualPath); err == nil {
+		return folder.MappedPath
+	}
+	return c.User.GetHomeDir()
+}
+
 // Normalizes a directory we get from the SFTP request to ensure the user is not able to escape
 // from their data directory. After normalization if the directory is still within their home
-// path it is returned. If they managed to "escape" an error will be returned.
+// path, or within the mapped path for virtual folders, it is returned. If they managed to "escape"
+// an error will be returned.
 func (c Connection) buildPath(rawPath string) (string, error) {
-	r := filepath.Clean(filepath.Join(c.User.HomeDir, rawPath))
-	p, err := filepath.EvalSymlinks(r)
-	if err != nil && !os.IsNotExist(err) {
+	root := c.User.GetHomeDir()
+	r := filepath.Clean(filepath.Join(root, rawPath))
+	if folder, err := c.User.GetVirtualFolderForPath(rawPath); err == nil {
+		root = folder.MappedPath
+		r = filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+rawPath), folder.VirtualPath)))
+	}
+	if isUploadStagingPath(r, root) {
+		logger.Warn(logSender, "access to the upload staging dir is not allowed, path: %v", r)
+		return "", errUploadStagingPath
+	}
+	p, err := c.fs.EvalSymlinks(r)
+	if err != nil && !c.fs.IsNotExist(err) {
 		return "", err
-	} else if os.IsNotExist(err) {
+	} else if c.fs.IsNotExist(err) {
 		// The requested directory doesn't exist, so at this point we need to iterate up the
 		// path chain until we hit a directory that _does_ exist and can be validated.
-		_, err = c.findFirstExistingDir(r)
+		_, err = c.findFirstExistingDir(r, root)
 		if err != nil {
 			logger.Warn(logSender, "error resolving not existent path: %v", err)
 		}
 		return r, err
 	}
 
-	err = c.isSubDir(p)
+	err = c.isSubDir(p, root)
 	if err != nil {
-		logger.Warn(logSender, "Invalid path resolution, dir: %v outside user home: %v err: %v", p, c.User.HomeDir, err)
+		logger.Warn(logSender, "Invalid path resolution, dir: %v outside user home: %v err: %v", p, root, err)
 	}
 	return r, err
 }
 
+// buildLinkPath is like buildPath but the last path element is not resolved, so a symbolic link can be
+// inspected even if it points outside the user home. The parent directory is validated as in buildPath
+func (c Connection) buildLinkPath(rawPath string) (string, error) {
+	virtualPath := path.Clean("/" + rawPath)
+	if virtualPath == "/" || c.User.IsVirtualFolder(virtualPath) {
+		return c.buildPath(virtualPath)
+	}
+	parent, err := c.buildPath(path.Dir(virtualPath))
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(parent, path.Base(virtualPath))
+	if isUploadStagingPath(p, c.getFsRoot(virtualPath)) {
+		logger.Warn(logSender, "access to the upload staging dir is not allowed, path: %v", p)
+		return "", errUploadStagingPath
+	}
+	return p, nil
+}
+
+// getLinkVirtualTarget returns the target of the given symbolic link as a path inside the user virtual root.
+// An error is returned if the target is outside the user home dir and outside the virtual folders
+func (c Connection) getLinkVirtualTarget(linkPath, target string) (string, error) {
+	if !filepath.IsAbs(target) {
+		linkDir := filepath.Dir(linkPath)
+		if resolvedDir, err := c.fs.EvalSymlinks(linkDir); err == nil {
+			linkDir = resolvedDir
+		}
+		target = filepath.Join(linkDir, target)
+	}
+	target = filepath.Clean(target)
+	for _, folder := range c.User.VirtualFolders {
+		if rel, ok := c.getPathRelativeToRoot(target, folder.MappedPath); ok {
+			return path.Join(folder.VirtualPath, rel), nil
+		}
+	}
+	if rel, ok := c.getPathRelativeToRoot(target, c.User.GetHomeDir()); ok {
+		return path.Join("/", rel), nil
+	}
+	return "", fmt.Errorf("link target %v is outside the user home", target)
+}
+
+// getPathRelativeToRoot returns the given filesystem path relative to root, as slash separated path,
+// and true if the path is inside root. The resolved root is checked too
+func (c Connection) getPathRelativeToRoot(fsPath, root string) (string, bool) {
+	roots := []string{filepath.Clean(root)}
+	if resolvedRoot, err := c.fs.EvalSymlinks(root); err == nil && resolvedRoot != roots[0] {
+		roots = append(roots, resolvedRoot)
+	}
+	for _, r := range roots {
+		rel, err := filepath.Rel(r, fsPath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel), true
+		}
+	}
+	return "", false
+}
+
 // iterate up the path chain until we hit a directory that does exist and can be validated.
 // all nonexistent directories will be returned
-func (c Connection) findNonexistentDirs(path string) ([]string, error) {
+func (c Connection) findNonexistentDirs(path, root string) ([]string, error) {
 	results := []string{}
 	cleanPath := filepath.Clean(path)
 	parent := filepath.Dir(cleanPath)
-	_, err := os.Stat(parent)
+	_, err := c.fs.Stat(parent)
 
-	for os.IsNotExist(err) {
+	for c.fs.IsNotExist(err) {
 		results = append(results, parent)
 		parent = filepath.Dir(parent)
-		_, err = os.Stat(parent)
+		_, err = c.fs.Stat(parent)
 	}
 	if err != nil {
 		return results, err
 	}
-	p, err := filepath.EvalSymlinks(parent)
+	p, err := c.fs.EvalSymlinks(parent)
 	if err != nil {
 		return results, err
 	}
-	err = c.isSubDir(p)
+	err = c.isSubDir(p, root)
 	if err != nil {
 		logger.Warn(logSender, "Error finding non existing dir: %v", err)
 	}
@@ -478,8 +1006,8 @@ func (c Connection) findNonexistentDirs(path string) ([]string, error) {
 }
 
 // iterate up the path chain until we hit a directory that does exist and can be validated.
-func (c Connection) findFirstExistingDir(path string) (string, error) {
-	results, err := c.findNonexistentDirs(path)
+func (c Connection) findFirstExistingDir(path, root string) (string, error) {
+	results, err := c.findNonexistentDirs(path, root)
 	if err != nil {
 		logger.Warn(logSender, "unable to find non existent dirs: %v", err)
 		return "", err
@@ -489,30 +1017,30 @@ func (c Connection) findFirstExistingDir(path string) (string, error) {
 		lastMissingDir := results[len(results)-1]
 		parent = filepath.Dir(lastMissingDir)
 	} else {
-		parent = c.User.GetHomeDir()
+		parent = root
 	}
-	p, err := filepath.EvalSymlinks(parent)
+	p, err := c.fs.EvalSymlinks(parent)
 	if err != nil {
 		return "", err
 	}
-	fileInfo, err := os.Stat(p)
+	fileInfo, err := c.fs.Stat(p)
 	if err != nil {
 		return "", err
 	}
 	if !fileInfo.IsDir() {
 		return "", fmt.Errorf("resolved path is not a dir: %v", p)
 	}
-	err = c.isSubDir(p)
+	err = c.isSubDir(p, root)
 	return p, err
 }
 
-// checks if sub is a subpath of the user home dir.
+// checks if sub is a subpath of the given root, the user home dir or a virtual folder mapped path.
 // EvalSymlink must be used on sub before calling this method
-func (c Connection) isSubDir(sub string) error {
-	// home dir must exist and it is already a validated absolute path
-	parent, err := filepath.EvalSymlinks(c.User.HomeDir)
+func (c Connection) isSubDir(sub, root string) error {
+	// root must exist and it is already a validated absolute path
+	parent, err := c.fs.EvalSymlinks(root)
 	if err != nil {
-		logger.Warn(logSender, "invalid home dir %v: %v", c.User.HomeDir, err)
+		logger.Warn(logSender, "invalid root dir %v: %v", root, err)
 		return err
 	}
 	if !strings.HasPrefix(sub, parent) {
@@ -522,19 +1050,25 @@ func (c Connection) isSubDir(sub string) error {
 	return nil
 }
 
-func (c Connection) createMissingDirs(filePath string) error {
-	dirsToCreate, err := c.findNonexistentDirs(filePath)
+// isUploadStagingPath returns true if the given cleaned path is the upload staging dir inside root or it is inside it
+func isUploadStagingPath(fsPath, root string) bool {
+	stagingDir := filepath.Join(root, uploadStagingDirName)
+	return fsPath == stagingDir || strings.HasPrefix(fsPath, stagingDir+string(filepath.Separator))
+}
+
+func (c Connection) createMissingDirs(filePath, root string) error {
+	dirsToCreate, err := c.findNonexistentDirs(filePath, root)
 	if err != nil {
 		return err
 	}
 	last := len(dirsToCreate) - 1
 	for i := range dirsToCreate {
 		d := dirsToCreate[last-i]
-		if err := os.Mkdir(d, 0777); err != nil {
+		if err := c.fs.Mkdir(d, 0777); err != nil {
 			logger.Error(logSender, "error creating missing dir: %v", d)
 			return err
 		}
-		utils.SetPathPermissions(d, c.User.GetUID(), c.User.GetGID())
+		vfs.SetPathPermissions(c.fs, d, c.User.GetUID(), c.User.GetGID())
 	}
 	return nil
 }
@@ -547,9 +1081,9 @@ func getOSOpenFlags(requestFlags sftp.FileOpenFlags) (flags int, trunc bool) {
 	} else if requestFlags.Write {
 		osFlags |= os.O_WRONLY
 	}
-	if requestFlags.Append {
-		osFlags |= os.O_APPEND
-	}
+	// the append flag is not passed to the OS, os.File.WriteAt cannot be used on files opened with O_APPEND.
+	// Clients send absolute offsets starting at the remote file size, Transfer.WriteAt refuses the offsets
+	// that would overwrite the existing data
 	if requestFlags.Creat {
 		osFlags |= os.O_CREATE
 	}
@@ -562,3 +1096,27 @@ func getOSOpenFlags(requestFlags sftp.FileOpenFlags) (flags int, trunc bool) {
 	}
 	return osFlags, truncateFile
 }
+
+// moveFile copies the source file to the target path and then removes the source file.
+// It is used if a file cannot be renamed across virtual folders
+func moveFile(fs vfs.Fs, sourcePath string, targetPath string, fi os.FileInfo) error {
+	src, err := fs.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fs.OpenFile(targetPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fs.Remove(targetPath)
+		return err
+	}
+	fs.Chtimes(targetPath, fi.ModTime(), fi.ModTime())
+	return fs.Remove(sourcePath)
+}
@@ -1,10 +1,69 @@
 package sftpd
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"runtime"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/vfs"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	testCAPubKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDKajsM9YLfm4I/Wi3KZhs/R8aMzhWIv/+ScFhtJutf3 test CA"
 )
 
+// mockSSHChannel records the data written by the server, reads return the data in readBuffer
+type mockSSHChannel struct {
+	readBuffer  *bytes.Buffer
+	writeBuffer *bytes.Buffer
+}
+
+func (c *mockSSHChannel) Read(data []byte) (int, error) {
+	return c.readBuffer.Read(data)
+}
+
+func (c *mockSSHChannel) Write(data []byte) (int, error) {
+	return c.writeBuffer.Write(data)
+}
+
+func (c *mockSSHChannel) Close() error {
+	return nil
+}
+
+func (c *mockSSHChannel) CloseWrite() error {
+	return nil
+}
+
+func (c *mockSSHChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return true, nil
+}
+
+func (c *mockSSHChannel) Stderr() io.ReadWriter {
+	return nil
+}
+
+// openErrorFs is a filesystem that cannot open files
+type openErrorFs struct {
+	vfs.Fs
+}
+
+func (fs openErrorFs) Open(name string) (vfs.File, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
+
 func TestWrongActions(t *testing.T) {
 	actionsCopy := actions
 	badCommand := "/bad/command"
@@ -16,13 +75,13 @@ func TestWrongActions(t *testing.T) {
 		Command:             badCommand,
 		HTTPNotificationURL: "",
 	}
-	err := executeAction(operationDownload, "username", "path", "")
+	err := executeAction(operationDownload, "username", "path", "", actionStatusOK)
 	if err == nil {
 		t.Errorf("action with bad command must fail")
 	}
 	actions.Command = ""
 	actions.HTTPNotificationURL = "http://foo\x7f.com/"
-	err = executeAction(operationDownload, "username", "path", "")
+	err = executeAction(operationDownload, "username", "path", "", actionStatusOK)
 	if err == nil {
 		t.Errorf("action with bad url must fail")
 	}
@@ -43,3 +102,975 @@ func TestRemoveNonexistentQuotaScan(t *testing.T) {
 		t.Errorf("remove nonexistent transfer must fail")
 	}
 }
+
+func TestParseCommandPayload(t *testing.T) {
+	cmd, args, err := parseCommandPayload("scp -t -r '/dir with spaces' \"/other dir\" /escaped\\ dir")
+	if err != nil {
+		t.Errorf("unexpected error parsing command: %v", err)
+	}
+	if cmd != "scp" {
+		t.Errorf("unexpected command: %v", cmd)
+	}
+	if len(args) != 5 || args[2] != "/dir with spaces" || args[3] != "/other dir" || args[4] != "/escaped dir" {
+		t.Errorf("unexpected args: %#v", args)
+	}
+	_, _, err = parseCommandPayload("scp -t 'unterminated")
+	if err == nil {
+		t.Errorf("parsing an unterminated quote must fail")
+	}
+	_, _, err = parseCommandPayload("   ")
+	if err == nil {
+		t.Errorf("parsing an empty command must fail")
+	}
+}
+
+func TestLoadHostKeys(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "hostkeys")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(configDir)
+	c := Configuration{}
+	keys, err := c.checkAndLoadHostKeys(configDir, &ssh.ServerConfig{})
+	if err != nil {
+		t.Errorf("unable to load default host keys: %v", err)
+	}
+	if len(keys) != 3 {
+		t.Errorf("unexpected number of host keys: %v", len(keys))
+	}
+	for _, k := range keys {
+		if _, err := os.Stat(k.Path); err != nil {
+			t.Errorf("host key %v not generated: %v", k.Path, err)
+		}
+	}
+	if keys[2].Type != ssh.KeyAlgoED25519 {
+		t.Errorf("unexpected key type: %v", keys[2].Type)
+	}
+	// already generated keys must be loaded and not regenerated
+	loadedKeys, err := c.checkAndLoadHostKeys(configDir, &ssh.ServerConfig{})
+	if err != nil {
+		t.Errorf("unable to load host keys: %v", err)
+	}
+	for i, k := range loadedKeys {
+		if k.Fingerprint != keys[i].Fingerprint {
+			t.Errorf("host key %v changed", k.Path)
+		}
+	}
+	c.HostKeys = []string{filepath.Join(configDir, "missing_key")}
+	_, err = c.checkAndLoadHostKeys(configDir, &ssh.ServerConfig{})
+	if err == nil {
+		t.Errorf("loading a missing key with an unknown type must fail")
+	}
+	invalidKey := filepath.Join(configDir, "invalid_key")
+	ioutil.WriteFile(invalidKey, []byte("invalid key"), 0600)
+	c.HostKeys = []string{invalidKey}
+	_, err = c.checkAndLoadHostKeys(configDir, &ssh.ServerConfig{})
+	if err == nil {
+		t.Errorf("loading an invalid key must fail")
+	}
+}
+
+func TestInitializeCertChecker(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "certchecker")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(configDir)
+	c := Configuration{}
+	err = c.initializeCertChecker(configDir)
+	if err != nil || c.certChecker != nil {
+		t.Errorf("cert checker must be disabled without trusted CA keys, err: %v", err)
+	}
+	c.TrustedUserCAKeys = []string{"missing_ca.pub"}
+	err = c.initializeCertChecker(configDir)
+	if err == nil {
+		t.Errorf("loading a missing CA key must fail")
+	}
+	ioutil.WriteFile(filepath.Join(configDir, "ca.pub"), []byte("# comment only\n"), 0600)
+	c.TrustedUserCAKeys = []string{"ca.pub"}
+	err = c.initializeCertChecker(configDir)
+	if err == nil {
+		t.Errorf("loading a file without CA keys must fail")
+	}
+	ioutil.WriteFile(filepath.Join(configDir, "ca.pub"), []byte("invalid key\n"), 0600)
+	err = c.initializeCertChecker(configDir)
+	if err == nil {
+		t.Errorf("loading an invalid CA key must fail")
+	}
+	ioutil.WriteFile(filepath.Join(configDir, "ca.pub"), []byte("# trusted CA\n"+testCAPubKey+"\n\n"), 0600)
+	err = c.initializeCertChecker(configDir)
+	if err != nil || c.certChecker == nil {
+		t.Errorf("unable to initialize cert checker: %v", err)
+	}
+	c.RevokedUserCertsFile = "revoked.json"
+	err = c.initializeCertChecker(configDir)
+	if err == nil {
+		t.Errorf("loading a missing revoked certificates file must fail")
+	}
+	ioutil.WriteFile(filepath.Join(configDir, "revoked.json"), []byte("not a json list"), 0600)
+	err = c.initializeCertChecker(configDir)
+	if err == nil {
+		t.Errorf("loading an invalid revoked certificates file must fail")
+	}
+}
+
+func TestGetNextAuthMethods(t *testing.T) {
+	user := dataprovider.User{}
+	_, done := user.GetNextAuthMethods([]string{dataprovider.SSHLoginMethodPassword})
+	if !done {
+		t.Errorf("a single method must be enough without required methods")
+	}
+	user.Filters.RequiredAuthMethods = []string{"publickey,password", "password"}
+	next, done := user.GetNextAuthMethods([]string{dataprovider.SSHLoginMethodPublicKey})
+	if done || len(next) != 1 || next[0] != dataprovider.SSHLoginMethodPassword {
+		t.Errorf("unexpected next methods: %v done: %v", next, done)
+	}
+	_, done = user.GetNextAuthMethods([]string{dataprovider.SSHLoginMethodPassword})
+	if !done {
+		t.Errorf("password must be enough")
+	}
+	_, done = user.GetNextAuthMethods([]string{dataprovider.SSHLoginMethodPublicKey, dataprovider.SSHLoginMethodPassword})
+	if !done {
+		t.Errorf("publickey and password must be enough")
+	}
+	next, done = user.GetNextAuthMethods([]string{"unknown"})
+	if done || len(next) != 0 {
+		t.Errorf("unexpected next methods: %v done: %v", next, done)
+	}
+}
+
+func TestGetPermissionsForPath(t *testing.T) {
+	user := dataprovider.User{
+		Permissions: []string{dataprovider.PermListItems},
+		DirPermissions: map[string][]string{
+			"/incoming":        []string{dataprovider.PermUpload},
+			"/incoming/sub/in": []string{dataprovider.PermAny},
+		},
+	}
+	if !user.HasPerm(dataprovider.PermListItems, "/") || user.HasPerm(dataprovider.PermUpload, "/") {
+		t.Errorf("unexpected permissions for the root dir")
+	}
+	if !user.HasPerm(dataprovider.PermUpload, "/incoming/sub") || user.HasPerm(dataprovider.PermListItems, "/incoming/sub") {
+		t.Errorf("permissions must be inherited from the closest parent dir")
+	}
+	if !user.HasPerm(dataprovider.PermDelete, "/incoming/sub/in/dir") {
+		t.Errorf("permissions must be inherited from the closest parent dir")
+	}
+	if user.HasPerm(dataprovider.PermUpload, "/incomingdir") {
+		t.Errorf("permissions must not be inherited from a dir with the same prefix")
+	}
+}
+
+func TestVirtualFoldersPaths(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "vfolder_home")
+	mappedPath := filepath.Join(os.TempDir(), "vfolder_mapped")
+	os.MkdirAll(homeDir, 0777)
+	os.MkdirAll(mappedPath, 0777)
+	user := dataprovider.User{
+		HomeDir:     homeDir,
+		Permissions: []string{dataprovider.PermListItems},
+		VirtualFolders: []dataprovider.VirtualFolder{
+			dataprovider.VirtualFolder{
+				VirtualPath: "/shared/vdir",
+				MappedPath:  mappedPath,
+				Permissions: []string{dataprovider.PermDownload},
+			},
+		},
+	}
+	c := Connection{User: user, fs: vfs.NewOsFs()}
+	p, err := c.buildPath("/shared/vdir/sub/file")
+	if err != nil || p != filepath.Join(mappedPath, "sub", "file") {
+		t.Errorf("unexpected path resolution inside a virtual folder: %v, err: %v", p, err)
+	}
+	p, err = c.buildPath("/shared/vdir")
+	if err != nil || p != mappedPath {
+		t.Errorf("unexpected path resolution for a virtual folder: %v, err: %v", p, err)
+	}
+	p, err = c.buildPath("/shared/vdirfile")
+	if err != nil || p != filepath.Join(homeDir, "shared", "vdirfile") {
+		t.Errorf("unexpected path resolution outside a virtual folder: %v, err: %v", p, err)
+	}
+	if !user.HasPerm(dataprovider.PermDownload, "/shared/vdir/sub") || user.HasPerm(dataprovider.PermListItems, "/shared/vdir") {
+		t.Errorf("virtual folder permissions must be inherited")
+	}
+	if !user.HasPerm(dataprovider.PermListItems, "/shared") {
+		t.Errorf("unexpected permissions for the virtual folder parent dir")
+	}
+	if !c.isVirtualFolderAffected("/shared") || !c.isVirtualFolderAffected("/shared/vdir") ||
+		c.isVirtualFolderAffected("/shared/vdir/sub") {
+		t.Errorf("unexpected virtual folder detection")
+	}
+	os.RemoveAll(homeDir)
+	os.RemoveAll(mappedPath)
+}
+
+func TestAtomicUpload(t *testing.T) {
+	uploadMode = uploadModeAtomic
+	defer func() {
+		uploadMode = uploadModeStandard
+	}()
+	homeDir := filepath.Join(os.TempDir(), "atomic_home")
+	fs := vfs.NewMemoryFs()
+	fs.MkdirAll(homeDir, 0777)
+	user := dataprovider.User{
+		Username:    "atomic_user",
+		HomeDir:     homeDir,
+		Permissions: []string{dataprovider.PermAny},
+	}
+	c := Connection{User: user, fs: fs, lock: new(sync.Mutex)}
+	request := sftp.NewRequest("Put", "/file")
+	request.Flags = 0x02 | 0x08 | 0x10 // write, create, truncate
+	w, err := c.Filewrite(request)
+	if err != nil {
+		t.Fatalf("unable to open file for writing: %v", err)
+	}
+	transfer := w.(*Transfer)
+	if len(transfer.tempPath) == 0 || !isUploadStagingPath(transfer.tempPath, homeDir) {
+		t.Errorf("the upload must be written inside the staging dir: %#v", transfer.tempPath)
+	}
+	transfer.WriteAt([]byte("data"), 0)
+	if _, err = fs.Stat(filepath.Join(homeDir, "file")); !fs.IsNotExist(err) {
+		t.Errorf("the target file must not exist before the upload completes: %v", err)
+	}
+	err = transfer.Close()
+	if err != nil {
+		t.Errorf("unable to close transfer: %v", err)
+	}
+	fi, err := fs.Stat(filepath.Join(homeDir, "file"))
+	if err != nil || fi.Size() != 4 {
+		t.Errorf("the file must be renamed to the target path when the upload completes: %+v, err: %v", fi, err)
+	}
+	if _, err = fs.Stat(transfer.tempPath); !fs.IsNotExist(err) {
+		t.Errorf("the temporary file must not exist after the upload: %v", err)
+	}
+	// a failed upload must leave the existing file untouched
+	w, err = c.Filewrite(request)
+	if err != nil {
+		t.Fatalf("unable to open file for writing: %v", err)
+	}
+	transfer = w.(*Transfer)
+	if transfer.replacedSize != 4 {
+		t.Errorf("unexpected replaced size: %v", transfer.replacedSize)
+	}
+	transfer.WriteAt([]byte("new data"), 0)
+	transfer.setTransferError(errors.New("connection lost"))
+	err = transfer.Close()
+	if err == nil {
+		t.Errorf("closing a failed atomic upload must fail")
+	}
+	fi, err = fs.Stat(filepath.Join(homeDir, "file"))
+	if err != nil || fi.Size() != 4 {
+		t.Errorf("a failed atomic upload must not replace the existing file: %+v, err: %v", fi, err)
+	}
+	if _, err = fs.Stat(transfer.tempPath); !fs.IsNotExist(err) {
+		t.Errorf("the temporary file must be removed after a failed upload: %v", err)
+	}
+	request = sftp.NewRequest("Put", "/file")
+	request.Flags = 0x02 // write without truncate, upload resume
+	_, err = c.Filewrite(request)
+	if err != sftp.ErrSshFxOpUnsupported {
+		t.Errorf("upload resume must not be supported in atomic mode: %v", err)
+	}
+	files, err := c.readDir("/", homeDir)
+	if err != nil || len(files) != 1 || files[0].Name() != "file" {
+		t.Errorf("the staging dir must not be listed: %v, err: %v", files, err)
+	}
+	_, err = c.buildPath("/" + uploadStagingDirName + "/file")
+	if err == nil {
+		t.Errorf("the staging dir must not be accessible")
+	}
+}
+
+func TestSCPDownloadOpenError(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "scp_home")
+	memFs := vfs.NewMemoryFs()
+	memFs.MkdirAll(homeDir, 0777)
+	filePath := filepath.Join(homeDir, "file")
+	f, _ := memFs.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0666)
+	f.WriteAt([]byte("data"), 0)
+	f.Close()
+	stat, err := memFs.Stat(filePath)
+	if err != nil {
+		t.Fatalf("unable to stat test file: %v", err)
+	}
+	user := dataprovider.User{
+		Username:    "scp_user",
+		HomeDir:     homeDir,
+		Permissions: []string{dataprovider.PermAny},
+	}
+	// the client confirms every protocol message
+	channel := &mockSSHChannel{
+		readBuffer:  bytes.NewBuffer([]byte{0, 0, 0}),
+		writeBuffer: bytes.NewBuffer(nil),
+	}
+	scpCmd := scpCommand{
+		connection: Connection{ID: "scp_connection", User: user, fs: openErrorFs{Fs: memFs}, lock: new(sync.Mutex)},
+		args:       []string{"-p", "-f", "/file"},
+		channel:    channel,
+	}
+	scpCmd.reader = bufio.NewReader(channel)
+	err = scpCmd.sendDownloadFile("/file", filePath, stat)
+	if err == nil {
+		t.Errorf("downloading a file that cannot be opened must fail")
+	}
+	sent := channel.writeBuffer.Bytes()
+	if len(sent) == 0 || sent[0] != errMsg[0] || bytes.Contains(sent, []byte("C0")) {
+		t.Errorf("only the error message must be sent if the file cannot be opened: %q", sent)
+	}
+	scpCmd.connection.fs = memFs
+	channel.writeBuffer.Reset()
+	err = scpCmd.sendDownloadFile("/file", filePath, stat)
+	if err != nil {
+		t.Errorf("unexpected download error: %v", err)
+	}
+	if !bytes.HasPrefix(channel.writeBuffer.Bytes(), []byte("T")) {
+		t.Errorf("the times message must be sent first: %q", channel.writeBuffer.Bytes())
+	}
+}
+
+func TestPartialUploadPolicy(t *testing.T) {
+	defer func() {
+		partialUploadPolicy = partialUploadKeep
+	}()
+	homeDir := filepath.Join(os.TempDir(), "partial_home")
+	fs := vfs.NewMemoryFs()
+	fs.MkdirAll(homeDir, 0777)
+	user := dataprovider.User{
+		Username:    "partial_user",
+		HomeDir:     homeDir,
+		Permissions: []string{dataprovider.PermAny},
+	}
+	c := Connection{ID: "partial_connection", User: user, fs: fs, lock: new(sync.Mutex)}
+	filePath := filepath.Join(homeDir, "file")
+	partialPath := filePath + partialUploadSuffix
+	request := sftp.NewRequest("Put", "/file")
+	request.Flags = 0x02 | 0x08 | 0x10 // write, create, truncate
+	openTransfer := func() *Transfer {
+		w, err := c.Filewrite(request)
+		if err != nil {
+			t.Fatalf("unable to open file for writing: %v", err)
+		}
+		transfer := w.(*Transfer)
+		transfer.WriteAt([]byte("data"), 0)
+		return transfer
+	}
+	partialUploadPolicy = partialUploadKeep
+	transfer := openTransfer()
+	abortConnectionTransfers(c.ID)
+	if transfer.getTransferError() != errTransferAborted {
+		t.Errorf("the transfer must be marked as aborted: %v", transfer.getTransferError())
+	}
+	transfer.Close()
+	if _, err := fs.Stat(filePath); err != nil {
+		t.Errorf("the partial file must be kept: %v", err)
+	}
+	partialUploadPolicy = partialUploadRename
+	transfer = openTransfer()
+	abortConnectionTransfers(c.ID)
+	transfer.Close()
+	if _, err := fs.Stat(filePath); !fs.IsNotExist(err) {
+		t.Errorf("the partial file must be renamed: %v", err)
+	}
+	fi, err := fs.Stat(partialPath)
+	if err != nil || fi.Size() != 4 {
+		t.Errorf("unexpected partial file: %+v, err: %v", fi, err)
+	}
+	// an existing partial file is overwritten
+	transfer = openTransfer()
+	transfer.WriteAt([]byte("more"), 4)
+	transfer.setTransferError(errors.New("connection lost"))
+	numFiles, sizeDiff := transfer.getQuotaUpdate()
+	path, numFiles, sizeDiff := transfer.handlePartialUpload(numFiles, sizeDiff)
+	if path != partialPath || numFiles != 0 || sizeDiff != 4 {
+		t.Errorf("unexpected partial upload result, path: %v, files: %v, size: %v", path, numFiles, sizeDiff)
+	}
+	removeTransfer(transfer)
+	partialUploadPolicy = partialUploadDelete
+	transfer = openTransfer()
+	transfer.setTransferError(errors.New("connection lost"))
+	transfer.Close()
+	if _, err = fs.Stat(filePath); !fs.IsNotExist(err) {
+		t.Errorf("the partial file must be removed: %v", err)
+	}
+	// a failed upload resume must not destroy the existing data
+	transfer = openTransfer()
+	transfer.Close()
+	resumeRequest := sftp.NewRequest("Put", "/file")
+	resumeRequest.Flags = 0x02 // write without truncate, upload resume
+	w, err := c.Filewrite(resumeRequest)
+	if err != nil {
+		t.Fatalf("unable to open file for resume: %v", err)
+	}
+	transfer = w.(*Transfer)
+	transfer.WriteAt([]byte("more"), 4)
+	abortConnectionTransfers(c.ID)
+	transfer.Close()
+	fi, err = fs.Stat(filePath)
+	if err != nil || fi.Size() != 8 {
+		t.Errorf("the resumed file must be kept: %+v, err: %v", fi, err)
+	}
+	// a completed upload is not affected by the policy
+	transfer = openTransfer()
+	err = transfer.Close()
+	if err != nil {
+		t.Errorf("unable to close transfer: %v", err)
+	}
+	if _, err = fs.Stat(filePath); err != nil {
+		t.Errorf("the uploaded file must exist: %v", err)
+	}
+}
+
+func TestReadlinkAndLstat(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "link_home")
+	mappedPath := filepath.Join(os.TempDir(), "link_mapped")
+	fs := vfs.NewMemoryFs()
+	fs.MkdirAll(filepath.Join(homeDir, "dir"), 0777)
+	fs.MkdirAll(mappedPath, 0777)
+	user := dataprovider.User{
+		Username:    "link_user",
+		HomeDir:     homeDir,
+		Permissions: []string{dataprovider.PermAny},
+		VirtualFolders: []dataprovider.VirtualFolder{
+			dataprovider.VirtualFolder{
+				VirtualPath: "/vdir",
+				MappedPath:  mappedPath,
+			},
+		},
+	}
+	c := Connection{User: user, fs: fs, lock: new(sync.Mutex)}
+	fs.Symlink("dir", filepath.Join(homeDir, "relative.link"))
+	fs.Symlink(filepath.Join(mappedPath, "file"), filepath.Join(homeDir, "dir", "vdir.link"))
+	fs.Symlink(os.TempDir(), filepath.Join(homeDir, "outside.link"))
+	readlink := func(p string) (string, error) {
+		lister, err := c.Filelist(sftp.NewRequest("Readlink", p))
+		if err != nil {
+			return "", err
+		}
+		files := make([]os.FileInfo, 1)
+		_, err = lister.ListAt(files, 0)
+		return files[0].Name(), err
+	}
+	target, err := readlink("/relative.link")
+	if err != nil || target != "/dir" {
+		t.Errorf("unexpected link target: %#v, err: %v", target, err)
+	}
+	target, err = readlink("/dir/vdir.link")
+	if err != nil || target != "/vdir/file" {
+		t.Errorf("unexpected link target: %#v, err: %v", target, err)
+	}
+	_, err = readlink("/outside.link")
+	if err != sftp.ErrSshFxPermissionDenied {
+		t.Errorf("reading a link pointing outside the home dir must be denied: %v", err)
+	}
+	_, err = readlink("/dir")
+	if err == nil {
+		t.Errorf("readlink must fail for a directory")
+	}
+	_, err = c.Filelist(sftp.NewRequest("Stat", "/outside.link"))
+	if err == nil {
+		t.Errorf("stat must not resolve a link pointing outside the home dir")
+	}
+	lister, err := c.Filelist(sftp.NewRequest("Lstat", "/outside.link"))
+	if err != nil {
+		t.Errorf("lstat for a link pointing outside the home dir must succeed: %v", err)
+	} else {
+		files := make([]os.FileInfo, 1)
+		lister.ListAt(files, 0)
+		if files[0].Mode()&os.ModeSymlink == 0 {
+			t.Errorf("lstat must not follow symlinks: %+v", files[0])
+		}
+	}
+	_, err = c.Filelist(sftp.NewRequest("Lstat", "/"+uploadStagingDirName))
+	if err == nil {
+		t.Errorf("lstat for the upload staging dir must fail")
+	}
+}
+
+func TestDirLister(t *testing.T) {
+	defer func() {
+		maxListEntries = 0
+		hidePatterns = nil
+	}()
+	homeDir := filepath.Join(os.TempDir(), "lister_home")
+	mappedPath := filepath.Join(os.TempDir(), "lister_mapped")
+	fs := vfs.NewMemoryFs()
+	fs.MkdirAll(homeDir, 0777)
+	fs.MkdirAll(mappedPath, 0777)
+	fs.MkdirAll(filepath.Join(homeDir, uploadStagingDirName), 0777)
+	fs.MkdirAll(filepath.Join(homeDir, "vdir"), 0777)
+	for i := 0; i < 250; i++ {
+		f, _ := fs.OpenFile(filepath.Join(homeDir, fmt.Sprintf("file%03d", i)), os.O_WRONLY|os.O_CREATE, 0666)
+		f.Close()
+	}
+	f, _ := fs.OpenFile(filepath.Join(homeDir, ".hidden"), os.O_WRONLY|os.O_CREATE, 0666)
+	f.Close()
+	user := dataprovider.User{
+		Username:    "lister_user",
+		HomeDir:     homeDir,
+		Permissions: []string{dataprovider.PermAny},
+		VirtualFolders: []dataprovider.VirtualFolder{
+			dataprovider.VirtualFolder{
+				VirtualPath: "/vdir",
+				MappedPath:  mappedPath,
+			},
+		},
+	}
+	c := Connection{ID: "lister_connection", User: user, fs: fs, lock: new(sync.Mutex)}
+	countListers := func() int {
+		mutex.RLock()
+		defer mutex.RUnlock()
+		count := 0
+		for _, l := range openDirListers {
+			if l.connectionID == c.ID {
+				count++
+			}
+		}
+		return count
+	}
+	listAll := func() ([]string, error) {
+		lister, err := c.Filelist(sftp.NewRequest("List", "/"))
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		var offset int64
+		for {
+			files := make([]os.FileInfo, 100)
+			n, err := lister.ListAt(files, offset)
+			for _, fi := range files[:n] {
+				names = append(names, fi.Name())
+			}
+			offset += int64(n)
+			if err == io.EOF {
+				return names, nil
+			}
+			if err != nil {
+				return names, err
+			}
+		}
+	}
+	names, err := listAll()
+	if err != nil || len(names) != 252 {
+		t.Errorf("unexpected listing, entries: %v, err: %v", len(names), err)
+	} else if names[0] != "vdir" {
+		t.Errorf("the virtual folders must be listed first: %v", names[0])
+	}
+	for _, name := range names {
+		if name == uploadStagingDirName {
+			t.Errorf("the upload staging dir must not be listed")
+		}
+	}
+	hidePatterns = []string{".*"}
+	names, err = listAll()
+	if err != nil || len(names) != 251 {
+		t.Errorf("unexpected listing with hide patterns, entries: %v, err: %v", len(names), err)
+	}
+	maxListEntries = 150
+	names, err = listAll()
+	if err != nil || len(names) != 150 {
+		t.Errorf("unexpected listing with max entries, entries: %v, err: %v", len(names), err)
+	}
+	lister, err := c.Filelist(sftp.NewRequest("List", "/"))
+	if err != nil {
+		t.Fatalf("unable to list dir: %v", err)
+	}
+	_, err = lister.ListAt(make([]os.FileInfo, 10), 10)
+	if err == nil || err == io.EOF {
+		t.Errorf("listing from an unexpected offset must fail")
+	}
+	files, err := c.readDir("/", homeDir)
+	if err != nil || len(files) != 251 {
+		t.Errorf("hide patterns must be applied reading a whole directory: %v, err: %v", len(files), err)
+	}
+	maxListEntries = 0
+	c.User.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		dataprovider.PatternsFilter{
+			Path:           "/",
+			DeniedPatterns: []string{"file1*"},
+			HideDenied:     true,
+		},
+	}
+	names, err = listAll()
+	if err != nil || len(names) != 151 {
+		t.Errorf("the denied files must be hidden, entries: %v, err: %v", len(names), err)
+	}
+	files, err = c.readDir("/", homeDir)
+	if err != nil || len(files) != 151 {
+		t.Errorf("the denied files must be hidden reading a whole directory: %v, err: %v", len(files), err)
+	}
+	c.User.Filters.FilePatterns[0].HideDenied = false
+	names, err = listAll()
+	if err != nil || len(names) != 251 {
+		t.Errorf("the denied files must be listed if hide denied is not set, entries: %v, err: %v", len(names), err)
+	}
+	// the completed listings are closed, the abandoned ones are closed on disconnect
+	if countListers() != 1 {
+		t.Errorf("unexpected number of open listers: %v", countListers())
+	}
+	lister, err = c.Filelist(sftp.NewRequest("List", "/"))
+	if err != nil {
+		t.Fatalf("unable to list dir: %v", err)
+	}
+	n, err := lister.ListAt(make([]os.FileInfo, 10), 0)
+	if err != nil || n != 10 {
+		t.Errorf("unexpected partial listing, entries: %v, err: %v", n, err)
+	}
+	if countListers() != 2 {
+		t.Errorf("unexpected number of open listers: %v", countListers())
+	}
+	closeConnectionDirListers(c.ID)
+	if countListers() != 0 {
+		t.Errorf("the abandoned listers must be closed, open listers: %v", countListers())
+	}
+	if !lister.(*dirLister).eof {
+		t.Errorf("the directory must be closed")
+	}
+	n, err = lister.ListAt(make([]os.FileInfo, 10), 10)
+	if err != io.EOF || n != 0 {
+		t.Errorf("a closed lister must return EOF, entries: %v, err: %v", n, err)
+	}
+}
+
+func TestFilePatternsFilters(t *testing.T) {
+	user := dataprovider.User{
+		Username:    "patterns_user",
+		Permissions: []string{dataprovider.PermAny},
+	}
+	user.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		dataprovider.PatternsFilter{
+			Path:           "/",
+			DeniedPatterns: []string{"*.zip"},
+		},
+		dataprovider.PatternsFilter{
+			Path:            "/images",
+			AllowedPatterns: []string{"*.jpg", "*.png"},
+			DeniedPatterns:  []string{"secret*"},
+		},
+	}
+	c := Connection{User: user, lock: new(sync.Mutex)}
+	allowed := []string{"/file.txt", "/dir/file.txt", "/images/img.JPG", "/images/sub/img.png"}
+	denied := []string{"/file.zip", "/dir/sub/file.ZIP", "/images/img.txt", "/images/secret.jpg", "/images/sub/file.zip"}
+	for _, p := range allowed {
+		if !c.isFileAllowed(p, operationUpload) {
+			t.Errorf("file %#v must be allowed", p)
+		}
+	}
+	for _, p := range denied {
+		if c.isFileAllowed(p, operationUpload) {
+			t.Errorf("file %#v must be denied", p)
+		}
+	}
+	filter, ok := c.User.GetPatternsFilterForDir("/images/sub")
+	if !ok || filter.Path != "/images" {
+		t.Errorf("unexpected filter for sub dir: %+v", filter)
+	}
+}
+
+func TestDefender(t *testing.T) {
+	config := DefenderConfig{
+		Enabled:        true,
+		BanTime:        -1,
+		Threshold:      0,
+		ScoreInvalid:   -2,
+		ScoreValid:     1,
+		ScoreHandshake: 1,
+	}
+	config.checkDefenderConfig()
+	if config.BanTime != 30 || config.ObservationTime != 30 || config.Threshold != 15 || config.ScoreInvalid != 0 {
+		t.Errorf("invalid defender config values must be replaced: %+v", config)
+	}
+	config.Threshold = 5
+	config.ScoreInvalid = 2
+	config.BanListFile = "banned_hosts.json"
+	configDir := os.TempDir()
+	banListPath := filepath.Join(configDir, config.BanListFile)
+	os.Remove(banListPath)
+	d, err := newDefender(config, configDir)
+	if err != nil {
+		t.Fatalf("unable to create defender: %v", err)
+	}
+	ip := "192.168.1.1"
+	d.addEvent(ip, config.ScoreInvalid)
+	d.addEvent(ip, config.ScoreValid)
+	// events outside the observation time must not be counted
+	d.hosts[ip][0].date = time.Now().Add(-time.Duration(config.ObservationTime+1) * time.Minute)
+	d.addEvent(ip, config.ScoreInvalid)
+	if d.isBanned(ip) {
+		t.Errorf("host must not be banned, score: %+v", d.hosts[ip])
+	}
+	d.addEvent(ip, config.ScoreInvalid)
+	if !d.isBanned(ip) {
+		t.Errorf("host must be banned")
+	}
+	if d.isBanned("192.168.1.2") {
+		t.Errorf("host must not be banned")
+	}
+	hosts := d.getBannedHosts()
+	if len(hosts) != 1 || hosts[0].IP != ip {
+		t.Errorf("unexpected banned hosts: %+v", hosts)
+	}
+	// the bans must be restored from the persisted list
+	d1, err := newDefender(config, configDir)
+	if err != nil {
+		t.Fatalf("unable to create defender: %v", err)
+	}
+	if !d1.isBanned(ip) {
+		t.Errorf("the persisted ban must be loaded")
+	}
+	if !d.unban(ip) {
+		t.Errorf("unable to unban host")
+	}
+	if d.isBanned(ip) || d.unban(ip) {
+		t.Errorf("host must not be banned anymore")
+	}
+	d1, err = newDefender(config, configDir)
+	if err != nil {
+		t.Fatalf("unable to create defender: %v", err)
+	}
+	if d1.isBanned(ip) {
+		t.Errorf("the removed ban must not be persisted")
+	}
+	d.banned[ip] = time.Now().Add(-time.Minute)
+	if d.isBanned(ip) || d.unban(ip) {
+		t.Errorf("expired bans must be ignored")
+	}
+	d.hosts[ip] = []hostEvent{hostEvent{date: time.Now().Add(-time.Hour), score: 1}}
+	d.lastCleanup = time.Now().Add(-time.Hour)
+	d.addEvent("192.168.1.2", 1)
+	if _, ok := d.hosts[ip]; ok {
+		t.Errorf("expired events must be removed")
+	}
+	ioutil.WriteFile(banListPath, []byte("invalid json"), 0666)
+	_, err = newDefender(config, configDir)
+	if err == nil {
+		t.Errorf("loading an invalid ban list must fail")
+	}
+	os.Remove(banListPath)
+	if UnbanHost(ip) || isHostBanned(ip) || len(GetBannedHosts()) != 0 {
+		t.Errorf("no host can be banned with the defender disabled")
+	}
+}
+
+func TestConnectionsLimits(t *testing.T) {
+	defer func() {
+		maxConnections = 0
+		maxConnectionsPerIP = 0
+	}()
+	c := Configuration{
+		MaxConnections:      -1,
+		MaxConnectionsPerIP: -1,
+	}
+	c.checkConnectionsLimits()
+	if c.MaxConnections != 0 || c.MaxConnectionsPerIP != 0 {
+		t.Errorf("invalid connections limits must be replaced: %+v", c)
+	}
+	maxConnections = 3
+	maxConnectionsPerIP = 2
+	stats := GetNetConnectionsStats()
+	ip1 := "192.168.1.1"
+	ip2 := "192.168.1.2"
+	for _, ip := range []string{ip1, ip1, ip2} {
+		if err := addNetConnection(ip); err != nil {
+			t.Errorf("unexpected error adding connection from %v: %v", ip, err)
+		}
+	}
+	if err := addNetConnection(ip2); err == nil {
+		t.Errorf("max connections must be enforced")
+	}
+	removeNetConnection(ip2)
+	if err := addNetConnection(ip1); err == nil {
+		t.Errorf("max connections per ip must be enforced")
+	}
+	if err := addNetConnection(ip2); err != nil {
+		t.Errorf("unexpected error adding connection from %v: %v", ip2, err)
+	}
+	newStats := GetNetConnectionsStats()
+	if newStats.OpenConnections != stats.OpenConnections+3 || newStats.MaxConnections != 3 ||
+		newStats.RejectedConnections != stats.RejectedConnections+1 ||
+		newStats.RejectedConnectionsPerIP != stats.RejectedConnectionsPerIP+1 {
+		t.Errorf("unexpected connections stats: %+v, initial stats: %+v", newStats, stats)
+	}
+	for _, ip := range []string{ip1, ip1, ip2} {
+		removeNetConnection(ip)
+	}
+	if _, ok := netConnections[ip1]; ok {
+		t.Errorf("the closed connections must be removed")
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	current, currentServerConfig := getServerConfig()
+	c := current
+	c.HostKeys = []string{"missing_key"}
+	c.MaxListEntries = current.MaxListEntries + 100
+	if err := c.Reload(".."); err == nil {
+		t.Errorf("reloading a configuration with a missing host key must fail")
+	}
+	conf, serverConfig := getServerConfig()
+	if conf.MaxListEntries != current.MaxListEntries || serverConfig != currentServerConfig {
+		t.Errorf("the current configuration must be kept if the new one is not valid")
+	}
+	c.HostKeys = current.HostKeys
+	c.BindPort = current.BindPort + 1
+	if err := c.Reload(".."); err != nil {
+		t.Errorf("unable to reload the configuration: %v", err)
+	}
+	conf, serverConfig = getServerConfig()
+	if conf.BindPort != current.BindPort {
+		t.Errorf("the bind port cannot be changed on reload")
+	}
+	if maxEntries, _ := getListingOptions(); maxEntries != c.MaxListEntries {
+		t.Errorf("max list entries not reloaded, expected: %v actual: %v", c.MaxListEntries, maxEntries)
+	}
+	if serverConfig == currentServerConfig {
+		t.Errorf("the SSH server configuration must be rebuilt on reload")
+	}
+	if err := current.Reload(".."); err != nil {
+		t.Errorf("unable to restore the configuration: %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	mutex.Lock()
+	listener := serverListener
+	connections := openConnections
+	serverListener = nil
+	openConnections = make(map[string]Connection)
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		serverListener = listener
+		openConnections = connections
+		shuttingDown = false
+		mutex.Unlock()
+	}()
+	transfer := &Transfer{
+		path:         "/shutdown_test",
+		connectionID: "shutdown_id",
+		start:        time.Now(),
+		lastActivity: time.Now(),
+	}
+	addTransfer(transfer)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		removeTransfer(transfer)
+	}()
+	start := time.Now()
+	Shutdown(5 * time.Second)
+	if !isShuttingDown() {
+		t.Errorf("the server must be shutting down")
+	}
+	if getActiveTransfersCount() != 0 || time.Since(start) >= 5*time.Second {
+		t.Errorf("shutdown must return as soon as the active transfers complete, elapsed: %v", time.Since(start))
+	}
+	_, err := loginUser(dataprovider.User{Username: "shutdown_user", HomeDir: os.TempDir()}, &net.TCPAddr{})
+	if err == nil {
+		t.Errorf("login must be refused while the server is shutting down")
+	}
+	addTransfer(transfer)
+	start = time.Now()
+	Shutdown(300 * time.Millisecond)
+	if time.Since(start) < 300*time.Millisecond {
+		t.Errorf("shutdown must wait for the active transfers up to the timeout")
+	}
+	removeTransfer(transfer)
+}
+
+func TestMaxFileSizeQuotaExceeded(t *testing.T) {
+	user := dataprovider.User{
+		Username:    "quota_user",
+		Password:    "pwd",
+		HomeDir:     filepath.Join(os.TempDir(), "quota_user"),
+		QuotaSize:   100,
+		Permissions: []string{dataprovider.PermAny},
+	}
+	err := dataprovider.AddUser(dataProvider, user)
+	if err != nil {
+		t.Fatalf("unable to add user: %v", err)
+	}
+	user, err = dataprovider.UserExists(dataProvider, user.Username)
+	if err != nil {
+		t.Fatalf("unable to get user: %v", err)
+	}
+	defer dataprovider.DeleteUser(dataProvider, user)
+	err = dataprovider.UpdateUserQuota(dataProvider, user, 1, 100, false)
+	if err != nil {
+		t.Errorf("unable to update quota: %v", err)
+	}
+	c := Connection{
+		User: user,
+	}
+	if _, err = c.getMaxFileSize("/file", 0, 0); err != errQuotaExceeded {
+		t.Errorf("new files must be denied if the quota is used up, err: %v", err)
+	}
+	if _, err = c.getMaxFileSize("/file", 100, 0); err != errQuotaExceeded {
+		t.Errorf("resume must be denied if the quota is used up, err: %v", err)
+	}
+	maxFileSize, err := c.getMaxFileSize("/file", 0, 100)
+	if err != nil || maxFileSize != 100 {
+		t.Errorf("unexpected max file size for a replaced file: %v, err: %v", maxFileSize, err)
+	}
+}
+
+func TestTransfersRefusedOnShutdown(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "shutdown_home")
+	fs := vfs.NewMemoryFs()
+	fs.MkdirAll(homeDir, 0777)
+	filePath := filepath.Join(homeDir, "file")
+	f, _ := fs.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0666)
+	f.WriteAt([]byte("data"), 0)
+	f.Close()
+	stat, err := fs.Stat(filePath)
+	if err != nil {
+		t.Fatalf("unable to stat test file: %v", err)
+	}
+	user := dataprovider.User{
+		Username:    "shutdown_user",
+		HomeDir:     homeDir,
+		Permissions: []string{dataprovider.PermAny},
+	}
+	c := Connection{ID: "shutdown_connection", User: user, fs: fs, lock: new(sync.Mutex)}
+	mutex.Lock()
+	shuttingDown = true
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		shuttingDown = false
+		mutex.Unlock()
+	}()
+	numTransfers := getActiveTransfersCount()
+	_, err = c.Fileread(sftp.NewRequest("Get", "/file"))
+	if err == nil {
+		t.Errorf("downloads must be refused while the server is shutting down")
+	}
+	request := sftp.NewRequest("Put", "/file")
+	request.Flags = 0x02 | 0x08 | 0x10 // write, create, truncate
+	_, err = c.Filewrite(request)
+	if err == nil {
+		t.Errorf("uploads must be refused while the server is shutting down")
+	}
+	channel := &mockSSHChannel{
+		readBuffer:  bytes.NewBuffer([]byte{0, 0, 0}),
+		writeBuffer: bytes.NewBuffer(nil),
+	}
+	scpCmd := scpCommand{
+		connection: c,
+		args:       []string{"-t", "/"},
+		channel:    channel,
+	}
+	scpCmd.reader = bufio.NewReader(channel)
+	err = scpCmd.handleUpload("/file", 4, &scpTimes{})
+	if err != errShuttingDown {
+		t.Errorf("SCP uploads must be refused while the server is shutting down, err: %v", err)
+	}
+	err = scpCmd.sendDownloadFile("/file", filePath, stat)
+	if err != errShuttingDown {
+		t.Errorf("SCP downloads must be refused while the server is shutting down, err: %v", err)
+	}
+	if getActiveTransfersCount() != numTransfers {
+		t.Errorf("no transfer must be started while the server is shutting down")
+	}
+	if fi, err := fs.Stat(filePath); err != nil || fi.Size() != stat.Size() {
+		t.Errorf("the existing file must not be modified: %+v, err: %v", fi, err)
+	}
+}
@@ -1,12 +1,41 @@
 package sftpd
 
 import (
+	"fmt"
 	"io"
 	"os"
+	"path"
+	"sync"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 type listerAt []os.FileInfo
 
+// virtualFolderInfo reports a virtual folder using the info for its mapped path and its virtual name
+type virtualFolderInfo struct {
+	os.FileInfo
+	name string
+}
+
+// Name returns the virtual folder name
+func (fi virtualFolderInfo) Name() string {
+	return fi.name
+}
+
+// linkTargetInfo reports the target of a symbolic link as name, readlink responses use the name as target
+type linkTargetInfo struct {
+	os.FileInfo
+	target string
+}
+
+// Name returns the link target as path inside the user virtual root
+func (fi linkTargetInfo) Name() string {
+	return fi.target
+}
+
 // ListAt returns the number of entries copied and an io.EOF error if we made it to the end of the file list.
 // Take a look at the pkg/sftp godoc for more information about how this function should work.
 func (l listerAt) ListAt(f []os.FileInfo, offset int64) (int, error) {
@@ -20,3 +49,132 @@ func (l listerAt) ListAt(f []os.FileInfo, offset int64) (int, error) {
 	}
 	return n, nil
 }
+
+// dirLister lists a directory incrementally: the entries are read from the filesystem, using Readdir, only
+// when the client requests them, so the whole directory is never loaded in memory.
+// The virtual folders are returned first. The entries with the same name of a virtual folder, the entries
+// matching the hide patterns, the ones in skipNames and the files not allowed by filter, if any, are not listed.
+// The open listers are tracked per connection, the directories not read until the end are closed on disconnect
+type dirLister struct {
+	sync.Mutex
+	connectionID string
+	dir          vfs.DirLister
+	dirPath      string
+	filter       *dataprovider.PatternsFilter
+	cache        []os.FileInfo
+	skipNames    map[string]bool
+	offset       int64
+	maxEntries   int
+	eof          bool
+}
+
+func newDirLister(connectionID string, dir vfs.DirLister, dirPath string, virtualFolders []os.FileInfo,
+	skipNames []string) *dirLister {
+	l := &dirLister{
+		connectionID: connectionID,
+		dir:          dir,
+		dirPath:      dirPath,
+		skipNames:    make(map[string]bool),
+	}
+	l.maxEntries, _ = getListingOptions()
+	for _, name := range skipNames {
+		l.skipNames[name] = true
+	}
+	for _, info := range virtualFolders {
+		l.skipNames[info.Name()] = true
+		if !isHiddenName(info.Name()) {
+			l.cache = append(l.cache, info)
+		}
+	}
+	return l
+}
+
+// ListAt returns the next directory entries and an io.EOF error when the end of the directory is reached.
+// The entries are read sequentially so offset must match the number of entries already returned
+func (l *dirLister) ListAt(f []os.FileInfo, offset int64) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	if offset != l.offset {
+		return 0, fmt.Errorf("unexpected offset %v for directory %v, the next entry offset is %v", offset, l.dirPath,
+			l.offset)
+	}
+	n := 0
+	for n < len(f) {
+		if l.maxEntries > 0 && l.offset >= int64(l.maxEntries) {
+			if !l.eof {
+				logger.Info(logSender, "listing for directory %v truncated, max entries: %v", l.dirPath, l.maxEntries)
+				l.close()
+			}
+			break
+		}
+		if len(l.cache) == 0 {
+			if l.eof {
+				break
+			}
+			if err := l.readNext(len(f) - n); err != nil {
+				return n, err
+			}
+			continue
+		}
+		f[n] = l.cache[0]
+		l.cache = l.cache[1:]
+		l.offset++
+		n++
+	}
+	if n < len(f) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readNext reads up to count entries from the directory, the directory is closed when its end is reached
+func (l *dirLister) readNext(count int) error {
+	entries, err := l.dir.Readdir(count)
+	if err == io.EOF {
+		l.close()
+		return nil
+	}
+	if err != nil {
+		logger.Warn(logSender, "error reading directory %v: %v", l.dirPath, err)
+		l.close()
+		return err
+	}
+	for _, info := range entries {
+		if l.skipNames[info.Name()] || isHiddenName(info.Name()) {
+			continue
+		}
+		if l.filter != nil && !info.IsDir() && !l.filter.IsNameAllowed(info.Name()) {
+			continue
+		}
+		l.cache = append(l.cache, info)
+	}
+	return nil
+}
+
+// close closes the directory, it must be called with the lock held
+func (l *dirLister) close() {
+	if !l.eof {
+		l.eof = true
+		l.dir.Close()
+		removeDirLister(l)
+	}
+}
+
+// abort closes the directory if the listing is not completed, the entries already read are discarded
+func (l *dirLister) abort() {
+	l.Lock()
+	defer l.Unlock()
+	l.cache = nil
+	l.close()
+}
+
+// isHiddenName returns true if the given file name matches one of the configured hide patterns
+func isHiddenName(name string) bool {
+	_, patterns := getListingOptions()
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,768 @@
+package sftpd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	scpBufferSize = 32768
+)
+
+var (
+	okMsg      = []byte{0x00}
+	warnMsg    = []byte{0x01} // must be followed by an optional message and a newline
+	errMsg     = []byte{0x02} // must be followed by an optional message and a newline
+	newLine    = []byte{0x0A}
+	errPermDen = errors.New("permission denied")
+)
+
+type execMsg struct {
+	Command string
+}
+
+type exitStatusMsg struct {
+	Status uint32
+}
+
+type scpTimes struct {
+	mtime time.Time
+	atime time.Time
+}
+
+// scpCommand handles the SCP protocol on a session channel, the scp client runs the remote command
+// "scp -t" to upload files and "scp -f" to download them
+type scpCommand struct {
+	connection Connection
+	args       []string
+	channel    ssh.Channel
+	reader     *bufio.Reader
+}
+
+func (c *scpCommand) handle() error {
+	var err error
+	addConnection(c.connection.ID, c.connection)
+	defer removeConnection(c.connection.ID)
+	c.reader = bufio.NewReader(c.channel)
+	commandType := c.getCommandType()
+	logger.Debug(logSenderSCP, "handle scp command, args: %v user: %v command type: %v", c.args,
+		c.connection.User.Username, commandType)
+	if commandType == "-t" {
+		// -t means "to", so upload
+		err = c.handleRecursiveUpload()
+	} else if commandType == "-f" {
+		// -f means "from" so download
+		err = c.readConfirmationMessage()
+		if err == nil {
+			for _, p := range c.getSourcePaths() {
+				err = c.handleDownload(p)
+				if err != nil {
+					break
+				}
+			}
+		}
+	} else {
+		err = fmt.Errorf("scp command not supported, args: %v", c.args)
+		c.sendErrorMessage(err.Error())
+	}
+	if err != nil {
+		logger.Debug(logSenderSCP, "scp command ended with error, args: %v user: %v: %v", c.args,
+			c.connection.User.Username, err)
+	}
+	c.sendExitStatus(err)
+	return err
+}
+
+// handleRecursiveUpload handles the sink side of the protocol: each protocol message is acknowledged,
+// "D" and "E" messages enter and leave directories, "C" messages are followed by the file data
+// and "T" messages set the times for the next file or directory
+func (c *scpCommand) handleRecursiveUpload() error {
+	destPath := c.getDestPath()
+	var dirs []string
+	var dirTimes []*scpTimes
+	var times *scpTimes
+	var sizeToRead int64
+	var name string
+	err := c.sendConfirmationMessage()
+	if err != nil {
+		return err
+	}
+	for {
+		command, err := c.getNextUploadProtocolMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch command[0] {
+		case 'T':
+			times, err = c.parseTimesMessage(command)
+			if err != nil {
+				c.sendErrorMessage(err.Error())
+				return err
+			}
+			err = c.sendConfirmationMessage()
+		case 'E':
+			if len(dirs) == 0 {
+				err = fmt.Errorf("unexpected end dir command")
+				c.sendErrorMessage(err.Error())
+				return err
+			}
+			c.setTimes(dirs[len(dirs)-1], dirTimes[len(dirTimes)-1])
+			dirs = dirs[:len(dirs)-1]
+			dirTimes = dirTimes[:len(dirTimes)-1]
+			logger.Debug(logSenderSCP, "received end dir command, num dirs: %v", len(dirs))
+			err = c.sendConfirmationMessage()
+		case 'D', 'C':
+			sizeToRead, name, err = c.parseUploadMessage(command)
+			if err != nil {
+				c.sendErrorMessage(err.Error())
+				return err
+			}
+			targetPath := c.getUploadTargetPath(destPath, dirs, name)
+			if command[0] == 'D' {
+				if !c.isRecursive() {
+					err = fmt.Errorf("received directory without -r")
+					c.sendErrorMessage(err.Error())
+					return err
+				}
+				err = c.handleCreateDir(targetPath)
+				if err != nil {
+					return err
+				}
+				dirs = append(dirs, targetPath)
+				dirTimes = append(dirTimes, times)
+				logger.Debug(logSenderSCP, "received start dir command, num dirs: %v dest path: %v", len(dirs), targetPath)
+				err = c.sendConfirmationMessage()
+			} else {
+				err = c.handleUpload(targetPath, sizeToRead, times)
+			}
+			times = nil
+		case warnMsg[0], errMsg[0]:
+			err = fmt.Errorf("error received from the scp client: %v", strings.TrimSpace(command[1:]))
+			return err
+		default:
+			err = fmt.Errorf("unknown scp upload message: %#v", command)
+			c.sendErrorMessage(err.Error())
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// getUploadTargetPath returns the virtual path for an uploaded file or directory.
+// A file or directory received outside any directory is placed inside the destination path if it
+// is a directory, otherwise it is uploaded as the destination path itself
+func (c *scpCommand) getUploadTargetPath(destPath string, dirs []string, name string) string {
+	if len(dirs) > 0 {
+		return path.Join(dirs[len(dirs)-1], name)
+	}
+	if c.isDestPathDir() {
+		return path.Join(destPath, name)
+	}
+	if p, err := c.connection.buildPath(destPath); err == nil {
+		if fi, err := c.connection.fs.Stat(p); err == nil && fi.IsDir() {
+			return path.Join(destPath, name)
+		}
+	}
+	return destPath
+}
+
+func (c *scpCommand) handleCreateDir(dirPath string) error {
+	updateConnectionActivity(c.connection.ID)
+	p, err := c.connection.buildPath(dirPath)
+	if err != nil {
+		logger.Warn(logSenderSCP, "error creating dir: %v, invalid file path, err: %v", dirPath, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	if fi, err := c.connection.fs.Stat(p); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		err = fmt.Errorf("%v: not a directory", dirPath)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	if !c.connection.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(dirPath)) {
+		logger.Warn(logSenderSCP, "error creating dir: %v, permission denied", dirPath)
+		c.sendErrorMessage(errPermDen.Error())
+		return errPermDen
+	}
+	if err = c.connection.fs.Mkdir(p, 0777); err != nil {
+		logger.Error(logSenderSCP, "error creating dir %v: %v", p, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	vfs.SetPathPermissions(c.connection.fs, p, c.connection.User.GetUID(), c.connection.User.GetGID())
+	logger.CommandLog(scpMkdirLogSender, p, "", c.connection.User.Username, c.connection.ID)
+	return nil
+}
+
+// handleUpload handles a "C" message: the target file is created or truncated, the file data are
+// read from the channel and written using a Transfer so quota, bandwidth and actions are handled
+// the same way as for SFTP uploads
+func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64, times *scpTimes) error {
+	updateConnectionActivity(c.connection.ID)
+	if isShuttingDown() {
+		logger.Info(logSenderSCP, "denying upload of %v: %v", uploadFilePath, errShuttingDown)
+		c.sendErrorMessage(errShuttingDown.Error())
+		return errShuttingDown
+	}
+	if !c.connection.User.HasPerm(dataprovider.PermUpload, path.Dir(uploadFilePath)) {
+		logger.Warn(logSenderSCP, "cannot upload file: %v, permission denied", uploadFilePath)
+		c.sendErrorMessage(errPermDen.Error())
+		return errPermDen
+	}
+
+	if !c.connection.isFileAllowed(uploadFilePath, operationUpload) {
+		c.sendErrorMessage(errPermDen.Error())
+		return errPermDen
+	}
+
+	p, err := c.connection.buildPath(uploadFilePath)
+	if err != nil {
+		logger.Warn(logSenderSCP, "error uploading file: %v, invalid file path, err: %v", uploadFilePath, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+
+	transfer := Transfer{
+		path:          p,
+		fs:            c.connection.fs,
+		requestPath:   uploadFilePath,
+		start:         time.Now(),
+		bytesSent:     0,
+		bytesReceived: 0,
+		user:          c.connection.User,
+		connectionID:  c.connection.ID,
+		transferType:  transferUpload,
+		protocol:      c.connection.protocol,
+	}
+	err = c.getUploadFile(&transfer)
+	if err != nil {
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	addTransfer(&transfer)
+
+	err = c.getUploadFileData(sizeToRead, &transfer)
+	if err == nil {
+		c.setTimes(uploadFilePath, times)
+	}
+	return err
+}
+
+// getUploadFile creates or truncates the file to upload, for the given transfer, and checks the user quota
+func (c *scpCommand) getUploadFile(transfer *Transfer) error {
+	c.connection.lock.Lock()
+	defer c.connection.lock.Unlock()
+
+	p := transfer.path
+	uploadFilePath := transfer.requestPath
+	stat, statErr := c.connection.fs.Stat(p)
+	if c.connection.fs.IsNotExist(statErr) {
+		if !c.connection.hasSpace(true, uploadFilePath) {
+			logger.Info(logSenderSCP, "denying file write due to space limit")
+			return errors.New("denying file write due to space limit")
+		}
+		maxFileSize, err := c.connection.getMaxFileSize(uploadFilePath, 0, 0)
+		if err != nil {
+			logger.Info(logSenderSCP, "denying file write due to space limit: %v", err)
+			return err
+		}
+		file, tempPath, err := c.connection.openUploadFile(p, uploadFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			logger.Error(logSenderSCP, "error creating file %v: %v", p, err)
+			return err
+		}
+		transfer.file = file
+		transfer.tempPath = tempPath
+		transfer.isNewFile = true
+		transfer.maxFileSize = maxFileSize
+		return nil
+	}
+	if statErr != nil {
+		logger.Error(logSenderSCP, "error performing file stat %v: %v", p, statErr)
+		return statErr
+	}
+	if stat.IsDir() {
+		logger.Warn(logSenderSCP, "attempted to open a directory for writing to: %v", p)
+		return fmt.Errorf("%v: is a directory", uploadFilePath)
+	}
+	if !c.connection.hasSpace(false, uploadFilePath) {
+		logger.Info(logSenderSCP, "denying file write due to space limit")
+		return errors.New("denying file write due to space limit")
+	}
+	maxFileSize, err := c.connection.getMaxFileSize(uploadFilePath, 0, stat.Size())
+	if err != nil {
+		logger.Info(logSenderSCP, "denying file write due to space limit: %v", err)
+		return err
+	}
+	file, tempPath, err := c.connection.openUploadFile(p, uploadFilePath, os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		logger.Error(logSenderSCP, "error opening existing file %v: %v", p, err)
+		return err
+	}
+	transfer.file = file
+	transfer.tempPath = tempPath
+	transfer.maxFileSize = maxFileSize
+	if len(tempPath) > 0 {
+		// the existing file will be replaced when the upload completes, the quota is updated then
+		transfer.replacedSize = stat.Size()
+	} else {
+		// the file is truncated so we need to decrease quota size but not quota files
+		c.connection.updateQuota(uploadFilePath, 0, -stat.Size())
+	}
+	return nil
+}
+
+func (c *scpCommand) getUploadFileData(sizeToRead int64, transfer *Transfer) error {
+	err := c.sendConfirmationMessage()
+	if err != nil {
+		transfer.setTransferError(err)
+		transfer.Close()
+		return err
+	}
+	if sizeToRead > 0 {
+		buf := make([]byte, scpBufferSize)
+		var offset int64
+		for offset < sizeToRead {
+			toRead := sizeToRead - offset
+			if toRead > scpBufferSize {
+				toRead = scpBufferSize
+			}
+			n, err := io.ReadFull(c.reader, buf[:toRead])
+			if err != nil {
+				transfer.setTransferError(err)
+				transfer.Close()
+				return err
+			}
+			_, err = transfer.WriteAt(buf[:n], offset)
+			if err != nil {
+				transfer.Close()
+				c.sendErrorMessage(err.Error())
+				return err
+			}
+			offset += int64(n)
+		}
+	}
+	err = c.readConfirmationMessage()
+	if err != nil {
+		transfer.setTransferError(err)
+		transfer.Close()
+		return err
+	}
+	err = transfer.Close()
+	if err != nil {
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	return c.sendConfirmationMessage()
+}
+
+// handleDownload handles the source side of the protocol for the given virtual path.
+// Directories are sent recursively if the -r flag was given
+func (c *scpCommand) handleDownload(filePath string) error {
+	updateConnectionActivity(c.connection.ID)
+	if !c.connection.User.HasPerm(dataprovider.PermDownload, path.Dir(filePath)) {
+		logger.Warn(logSenderSCP, "cannot download file: %v, permission denied", filePath)
+		c.sendErrorMessage(errPermDen.Error())
+		return errPermDen
+	}
+
+	p, err := c.connection.buildPath(filePath)
+	if err != nil {
+		logger.Warn(logSenderSCP, "error downloading file: %v, invalid file path, err: %v", filePath, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+
+	stat, err := c.connection.fs.Stat(p)
+	if err != nil {
+		logger.Warn(logSenderSCP, "error downloading file: %v, err: %v", p, err)
+		c.sendErrorMessage(fmt.Sprintf("%v: no such file or directory", filePath))
+		return err
+	}
+
+	if stat.IsDir() {
+		if !c.isRecursive() {
+			err = fmt.Errorf("%v: not a regular file", filePath)
+			c.sendErrorMessage(err.Error())
+			return err
+		}
+		return c.handleRecursiveDownload(filePath, p, stat)
+	}
+	if !c.connection.isFileAllowed(filePath, operationDownload) {
+		c.sendErrorMessage(errPermDen.Error())
+		return errPermDen
+	}
+	if !stat.Mode().IsRegular() {
+		err = fmt.Errorf("%v: not a regular file", filePath)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	return c.sendDownloadFile(filePath, p, stat)
+}
+
+func (c *scpCommand) handleRecursiveDownload(dirPath string, p string, stat os.FileInfo) error {
+	err := c.sendTimesMessage(stat)
+	if err != nil {
+		return err
+	}
+	dirName := filepath.Base(p)
+	if c.connection.User.IsVirtualFolder(dirPath) {
+		dirName = path.Base(dirPath)
+	}
+	err = c.sendProtocolMessage(fmt.Sprintf("D%04o 0 %v\n", stat.Mode().Perm(), dirName))
+	if err != nil {
+		return err
+	}
+	files, err := c.connection.readDir(dirPath, p)
+	if err != nil {
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	for _, file := range files {
+		filePath := path.Join(dirPath, file.Name())
+		if !file.IsDir() && !c.connection.User.IsFileAllowed(filePath) {
+			logger.Debug(logSenderSCP, "file %v not allowed by the file patterns filters, skipped", filePath)
+			continue
+		}
+		// the virtual path is used so symlinks are resolved and validated against the user home
+		err = c.handleDownload(filePath)
+		if err != nil {
+			return err
+		}
+	}
+	return c.sendProtocolMessage("E\n")
+}
+
+// sendDownloadFile sends the file at the filesystem path p, filePath is the virtual path requested by the client.
+// The file is opened before sending the file header, so an open error does not desync the protocol
+func (c *scpCommand) sendDownloadFile(filePath string, p string, stat os.FileInfo) error {
+	if isShuttingDown() {
+		logger.Info(logSenderSCP, "denying download of %v: %v", filePath, errShuttingDown)
+		c.sendErrorMessage(errShuttingDown.Error())
+		return errShuttingDown
+	}
+	file, err := c.connection.fs.Open(p)
+	if err != nil {
+		logger.Error(logSenderSCP, "could not open file \"%v\" for reading: %v", p, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	err = c.sendTimesMessage(stat)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = c.sendProtocolMessage(fmt.Sprintf("C%04o %v %v\n", stat.Mode().Perm(), stat.Size(), filepath.Base(p)))
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	transfer := Transfer{
+		file:          file,
+		path:          p,
+		fs:            c.connection.fs,
+		requestPath:   filePath,
+		start:         time.Now(),
+		bytesSent:     0,
+		bytesReceived: 0,
+		user:          c.connection.User,
+		connectionID:  c.connection.ID,
+		transferType:  transferDownload,
+		isNewFile:     false,
+		protocol:      c.connection.protocol,
+	}
+	addTransfer(&transfer)
+
+	buf := make([]byte, scpBufferSize)
+	var offset int64
+	for {
+		n, err := transfer.ReadAt(buf, offset)
+		if n > 0 {
+			if _, e := c.channel.Write(buf[:n]); e != nil {
+				transfer.setTransferError(e)
+				transfer.Close()
+				return e
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			transfer.Close()
+			c.sendErrorMessage(err.Error())
+			return err
+		}
+	}
+	err = transfer.Close()
+	if err != nil {
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	err = c.sendConfirmationMessage()
+	if err != nil {
+		return err
+	}
+	return c.readConfirmationMessage()
+}
+
+// sendTimesMessage sends the modification and access times if the -p flag was given
+func (c *scpCommand) sendTimesMessage(stat os.FileInfo) error {
+	if !c.isPreserveTimes() {
+		return nil
+	}
+	modTime := stat.ModTime().Unix()
+	return c.sendProtocolMessage(fmt.Sprintf("T%v 0 %v 0\n", modTime, modTime))
+}
+
+// sendProtocolMessage sends a protocol message and waits for the client confirmation
+func (c *scpCommand) sendProtocolMessage(message string) error {
+	_, err := c.channel.Write([]byte(message))
+	if err != nil {
+		logger.Warn(logSenderSCP, "error sending protocol message: %v, err: %v", message, err)
+		return err
+	}
+	return c.readConfirmationMessage()
+}
+
+func (c *scpCommand) setTimes(filePath string, times *scpTimes) {
+	if times == nil || !c.isPreserveTimes() {
+		return
+	}
+	if !c.connection.User.HasPerm(dataprovider.PermChtimes, path.Dir(filePath)) {
+		logger.Debug(logSenderSCP, "times not preserved for path %v, permission denied", filePath)
+		return
+	}
+	p, err := c.connection.buildPath(filePath)
+	if err == nil {
+		err = c.connection.fs.Chtimes(p, times.atime, times.mtime)
+	}
+	if err != nil {
+		logger.Warn(logSenderSCP, "unable to set times for path %v: %v", filePath, err)
+	}
+}
+
+func (c *scpCommand) getNextUploadProtocolMessage() (string, error) {
+	command, err := c.reader.ReadString(newLine[0])
+	if err != nil {
+		if err == io.EOF && len(command) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return command, err
+	}
+	return strings.TrimSuffix(command, string(newLine)), nil
+}
+
+// parseUploadMessage parses "C" and "D" messages, the expected format is: <mode> <size> <name>
+func (c *scpCommand) parseUploadMessage(command string) (int64, string, error) {
+	parts := strings.SplitN(command, " ", 3)
+	if len(parts) != 3 {
+		return 0, "", fmt.Errorf("invalid upload message: %#v", command)
+	}
+	if _, err := strconv.ParseUint(parts[0][1:], 8, 32); err != nil {
+		return 0, "", fmt.Errorf("invalid file mode in upload message: %#v", command)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, "", fmt.Errorf("invalid size in upload message: %#v", command)
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, "", fmt.Errorf("invalid name in upload message: %#v", command)
+	}
+	return size, name, nil
+}
+
+// parseTimesMessage parses "T" messages, the expected format is: <mtime> 0 <atime> 0
+func (c *scpCommand) parseTimesMessage(command string) (*scpTimes, error) {
+	parts := strings.Split(command[1:], " ")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid times message: %#v", command)
+	}
+	mtime, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modification time in message: %#v", command)
+	}
+	atime, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access time in message: %#v", command)
+	}
+	return &scpTimes{
+		mtime: time.Unix(mtime, 0),
+		atime: time.Unix(atime, 0),
+	}, nil
+}
+
+func (c *scpCommand) readConfirmationMessage() error {
+	code, err := c.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code != okMsg[0] {
+		message, _ := c.reader.ReadString(newLine[0])
+		err = fmt.Errorf("scp client error, code: %v message: %v", code, strings.TrimSpace(message))
+		logger.Warn(logSenderSCP, "%v", err)
+	}
+	return err
+}
+
+func (c *scpCommand) sendConfirmationMessage() error {
+	_, err := c.channel.Write(okMsg)
+	return err
+}
+
+func (c *scpCommand) sendErrorMessage(message string) {
+	msg := append(append([]byte{}, errMsg...), []byte(message)...)
+	msg = append(msg, newLine...)
+	if _, err := c.channel.Write(msg); err != nil {
+		logger.Warn(logSenderSCP, "unable to send scp error message: %v", err)
+	}
+}
+
+func (c *scpCommand) sendExitStatus(err error) {
+	status := uint32(0)
+	if err != nil {
+		status = uint32(1)
+	}
+	exitStatus := exitStatusMsg{
+		Status: status,
+	}
+	c.channel.SendRequest("exit-status", false, ssh.Marshal(&exitStatus))
+	c.channel.Close()
+}
+
+// getCommandType returns "-t" for uploads and "-f" for downloads
+func (c *scpCommand) getCommandType() string {
+	for _, arg := range c.getFlags() {
+		if arg == "-t" || arg == "-f" {
+			return arg
+		}
+	}
+	return ""
+}
+
+func (c *scpCommand) isRecursive() bool {
+	return utils.IsStringInSlice("-r", c.getFlags())
+}
+
+func (c *scpCommand) isPreserveTimes() bool {
+	return utils.IsStringInSlice("-p", c.getFlags())
+}
+
+func (c *scpCommand) isDestPathDir() bool {
+	return utils.IsStringInSlice("-d", c.getFlags())
+}
+
+// getFlags returns the arguments before the paths, single letter flags can be grouped, for example -rt
+func (c *scpCommand) getFlags() []string {
+	var flags []string
+	for _, arg := range c.args {
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		for _, f := range arg[1:] {
+			flags = append(flags, "-"+string(f))
+		}
+	}
+	return flags
+}
+
+func (c *scpCommand) getSourcePaths() []string {
+	var paths []string
+	isFlag := true
+	for _, arg := range c.args {
+		if isFlag {
+			if arg == "--" {
+				isFlag = false
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				continue
+			}
+			isFlag = false
+		}
+		paths = append(paths, arg)
+	}
+	return paths
+}
+
+func (c *scpCommand) getDestPath() string {
+	paths := c.getSourcePaths()
+	if len(paths) == 0 {
+		return "/"
+	}
+	return paths[len(paths)-1]
+}
+
+// parseCommandPayload splits the command sent inside an "exec" request into the command name and its
+// arguments. Arguments can be quoted using single or double quotes and characters escaped using a backslash
+func parseCommandPayload(command string) (string, []string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+	escaped := false
+	for _, r := range command {
+		if escaped {
+			current.WriteRune(r)
+			escaped = false
+			continue
+		}
+		switch {
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return "", args, fmt.Errorf("unterminated quote or escape in command: %#v", command)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	if len(args) == 0 {
+		return "", args, fmt.Errorf("invalid empty command")
+	}
+	return args[0], args[1:], nil
+}
@@ -1,6 +1,10 @@
 package sftpd
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -13,14 +17,17 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
@@ -43,77 +50,221 @@ type Configuration struct {
 	Umask string `json:"umask"`
 	// Actions to execute on SFTP create, download, delete and rename
 	Actions Actions `json:"actions"`
+	// If true SCP is enabled, SCP commands are served using "exec" requests on the same SSH listener
+	EnableSCP bool `json:"enable_scp"`
+	// Built-in commands that can be executed using "exec" requests, for example sha256sum or du.
+	// Commands are implemented inside SFTPGo and they can only access the user's home directory.
+	// Empty slice to disable
+	EnabledSSHCommands []string `json:"enabled_ssh_commands"`
+	// Paths to the private host keys, relative paths are resolved against the config dir.
+	// Missing keys named id_rsa, id_ecdsa or id_ed25519 are autogenerated.
+	// If empty id_rsa, id_ecdsa and id_ed25519 inside the config dir are used
+	HostKeys []string `json:"host_keys"`
+	// Paths to the public keys of the trusted certificate authorities for user certificates,
+	// relative paths are resolved against the config dir. Each file can contain one or more keys
+	// in authorized_keys format. Empty to disable certificate authentication
+	TrustedUserCAKeys []string `json:"trusted_user_ca_keys"`
+	// Path to a file containing a JSON list with the SHA256 fingerprints of the revoked user certificates,
+	// the fingerprint is computed on the whole certificate and not on the certified key, so a certificate
+	// can be revoked while other certificates for the same key are still valid.
+	// Relative paths are resolved against the config dir. Empty to disable
+	RevokedUserCertsFile string `json:"revoked_user_certs_file"`
+	// Upload mode: 0 means standard, the files are uploaded directly to the requested path.
+	// 1 means atomic: the files are uploaded to a temporary path and renamed to the requested path
+	// when the client ends the upload. Atomic mode avoids problems such as a web server that
+	// serves partial files when the files are being uploaded
+	UploadMode int `json:"upload_mode"`
+	// Policy for the uploads that fail, for example because the client disconnects, in standard upload mode.
+	// 0 means the partial file is kept, 1 means it is removed, 2 means it is renamed adding the ".partial" suffix
+	PartialUploadPolicy int `json:"partial_upload_policy"`
+	// Maximum number of entries returned for a single directory listing, the remaining entries are not listed.
+	// 0 means unlimited
+	MaxListEntries int `json:"max_list_entries"`
+	// Files and directories whose names match one of these shell patterns, for example ".*" for dotfiles,
+	// are not included in directory listings. They can still be accessed using their path
+	HidePatterns []string `json:"hide_patterns"`
+	// Maximum number of open network connections, including the ones not yet authenticated. 0 means unlimited
+	MaxConnections int `json:"max_connections"`
+	// Maximum number of open network connections from a single IP address. 0 means unlimited
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+	// Maximum time, as seconds, to wait for the active transfers to complete on shutdown, the remaining
+	// connections are then closed
+	GracefulShutdownTimeout int `json:"graceful_shutdown_timeout"`
+	// Brute force protection, the hosts with too many failed logins are banned for a configurable time
+	Defender    DefenderConfig `json:"defender"`
+	certChecker *ssh.CertChecker
+}
+
+// HostKey defines the details for a host key used by the SFTP server
+type HostKey struct {
+	// Path to the private key file
+	Path string `json:"path"`
+	// Key type, for example ssh-ed25519
+	Type string `json:"type"`
+	// SHA256 fingerprint for the public key
+	Fingerprint string `json:"fingerprint"`
 }
 
 // Initialize the SFTP server and add a persistent listener to handle inbound SFTP connections.
 func (c Configuration) Initialize(configDir string) error {
-	umask, err := strconv.ParseUint(c.Umask, 8, 8)
-	if err == nil {
-		utils.SetUmask(int(umask), c.Umask)
-	} else {
-		logger.Warn(logSender, "error reading umask, please fix your config file: %v", err)
+	if err := c.configure(configDir); err != nil {
+		return err
 	}
-	actions = c.Actions
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", c.BindAddress, c.BindPort))
+	if err != nil {
+		logger.Warn(logSender, "error starting listener on address %s:%d: %v", c.BindAddress, c.BindPort, err)
+		return err
+	}
+
+	logger.Info(logSender, "server listener registered address: %v", listener.Addr().String())
+	setServerListener(listener)
+	startIdleTimer()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil && isShuttingDown() {
+			logger.Debug(logSender, "listener closed, the server is shutting down")
+			return nil
+		}
+		if conn != nil {
+			ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
+			if isHostBanned(ipAddr) {
+				logger.Debug(logSender, "connection refused, host %v is banned", ipAddr)
+				conn.Close()
+				continue
+			}
+			// the limits are enforced before the SSH handshake
+			if err := addNetConnection(ipAddr); err != nil {
+				logger.Debug(logSender, "connection refused: %v", err)
+				conn.Close()
+				continue
+			}
+			// the configuration is read for each connection so a reloaded configuration is used
+			// for the new connections while the existing ones are not affected
+			conf, serverConfig := getServerConfig()
+			go func() {
+				defer removeNetConnection(ipAddr)
+				conf.AcceptInboundConnection(conn, serverConfig)
+			}()
+		}
+	}
+}
+
+// Reload applies the given configuration to the running server without dropping the existing connections.
+// The new SSH settings, such as the banner and the host keys, are used for the new connections, the other
+// settings, such as the actions, apply to the existing connections too. Changing the listener address
+// requires a restart. If the configuration is invalid an error is returned and the current one is kept
+func (c Configuration) Reload(configDir string) error {
+	current, _ := getServerConfig()
+	if current.BindAddress != c.BindAddress || current.BindPort != c.BindPort {
+		logger.Warn(logSender, "bind address and port cannot be changed without a restart, the listener on %s:%d is kept",
+			current.BindAddress, current.BindPort)
+		c.BindAddress = current.BindAddress
+		c.BindPort = current.BindPort
+	}
+	if err := c.configure(configDir); err != nil {
+		logger.Warn(logSender, "configuration reload rejected, the current configuration is kept: %v", err)
+		return err
+	}
+	logger.Info(logSender, "configuration reloaded")
+	return nil
+}
+
+// configure validates the configuration and builds the SSH server configuration, then they are applied
+// together. Nothing is applied if the configuration is not valid
+func (c Configuration) configure(configDir string) error {
+	umask, umaskErr := strconv.ParseUint(c.Umask, 8, 8)
+	if umaskErr != nil {
+		logger.Warn(logSender, "error reading umask, please fix your config file: %v", umaskErr)
+	}
+	c.checkUploadOptions()
+	c.checkListingOptions()
+	c.checkConnectionsLimits()
+	c.checkSSHCommands()
 	serverConfig := &ssh.ServerConfig{
 		NoClientAuth: false,
 		MaxAuthTries: c.MaxAuthTries,
 		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 			sp, err := c.validatePasswordCredentials(conn, pass)
 			if err != nil {
+				if _, ok := err.(*ssh.PartialSuccessError); ok {
+					return nil, err
+				}
 				return nil, errors.New("could not validate credentials")
 			}
 
 			return sp, nil
 		},
 		PublicKeyCallback: func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			sp, err := c.validatePublicKeyCredentials(conn, string(pubKey.Marshal()))
+			sp, err := c.validatePublicKeyCredentials(conn, pubKey)
 			if err != nil {
+				if _, ok := err.(*ssh.PartialSuccessError); ok {
+					return nil, err
+				}
 				return nil, errors.New("could not validate credentials")
 			}
 
 			return sp, nil
 		},
-		ServerVersion: "SSH-2.0-" + c.Banner,
-	}
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			sp, err := c.validateKeyboardInteractiveCredentials(conn, client)
+			if err != nil {
+				if _, ok := err.(*ssh.PartialSuccessError); ok {
+					return nil, err
+				}
+				return nil, errors.New("could not validate credentials")
+			}
 
-	if _, err := os.Stat(filepath.Join(configDir, "id_rsa")); os.IsNotExist(err) {
-		logger.Info(logSender, "creating new private key for server")
-		if err := c.generatePrivateKey(configDir); err != nil {
-			return err
-		}
-	} else if err != nil {
-		return err
+			return sp, nil
+		},
+		ServerVersion: "SSH-2.0-" + c.Banner,
 	}
 
-	privateBytes, err := ioutil.ReadFile(filepath.Join(configDir, "id_rsa"))
+	keys, err := c.checkAndLoadHostKeys(configDir, serverConfig)
 	if err != nil {
 		return err
 	}
 
-	private, err := ssh.ParsePrivateKey(privateBytes)
-	if err != nil {
+	if err := c.initializeCertChecker(configDir); err != nil {
 		return err
 	}
 
-	// Add our private key to the server configuration.
-	serverConfig.AddHostKey(private)
-
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", c.BindAddress, c.BindPort))
+	d, err := c.initializeDefender(configDir)
 	if err != nil {
-		logger.Warn(logSender, "error starting listener on address %s:%d: %v", c.BindAddress, c.BindPort, err)
 		return err
 	}
 
-	logger.Info(logSender, "server listener registered address: %v", listener.Addr().String())
-	if c.IdleTimeout > 0 {
-		startIdleTimer(time.Duration(c.IdleTimeout) * time.Minute)
+	if umaskErr == nil {
+		utils.SetUmask(int(umask), c.Umask)
 	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	activeConfig = c
+	sshServerConfig = serverConfig
+	hostKeys = keys
+	hostDefender = d
+	actions = c.Actions
+	uploadMode = c.UploadMode
+	partialUploadPolicy = c.PartialUploadPolicy
+	maxListEntries = c.MaxListEntries
+	hidePatterns = c.HidePatterns
+	maxConnections = c.MaxConnections
+	maxConnectionsPerIP = c.MaxConnectionsPerIP
+	idleTimeout = time.Duration(c.IdleTimeout) * time.Minute
+	return nil
+}
 
-	for {
-		conn, _ := listener.Accept()
-		if conn != nil {
-			go c.AcceptInboundConnection(conn, serverConfig)
-		}
+func (c *Configuration) checkUploadOptions() {
+	if c.UploadMode != uploadModeStandard && c.UploadMode != uploadModeAtomic {
+		logger.Warn(logSender, "invalid upload_mode %v, please fix your config file, standard mode will be used",
+			c.UploadMode)
+		c.UploadMode = uploadModeStandard
+	}
+	if c.PartialUploadPolicy < partialUploadKeep || c.PartialUploadPolicy > partialUploadRename {
+		logger.Warn(logSender, "invalid partial_upload_policy %v, please fix your config file, partial uploads will be kept",
+			c.PartialUploadPolicy)
+		c.PartialUploadPolicy = partialUploadKeep
 	}
 }
 
@@ -121,21 +272,71 @@ func (c Configuration) Initialize(configDir string) error {
 func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig) {
 	defer conn.Close()
 
+	// the failed logins are scored using a per connection callback, the public key failures are scored
+	// only once for each connection since clients usually try all the available keys
+	loginTried := false
+	pubKeyFailed := false
+	connConfig := *config
+	connConfig.AuthLogCallback = func(metadata ssh.ConnMetadata, method string, err error) {
+		if method == "none" {
+			return
+		}
+		loginTried = true
+		if err == nil {
+			return
+		}
+		if _, ok := err.(*ssh.PartialSuccessError); ok {
+			return
+		}
+		if method == dataprovider.SSHLoginMethodPublicKey {
+			if pubKeyFailed {
+				return
+			}
+			pubKeyFailed = true
+		}
+		addLoginFailure(metadata)
+	}
+
 	// Before beginning a handshake must be performed on the incoming net.Conn
-	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, &connConfig)
 	if err != nil {
 		logger.Warn(logSender, "failed to accept an incoming connection: %v", err)
+		if !loginTried {
+			addHandshakeFailure(utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()))
+		}
 		return
 	}
 	defer sconn.Close()
 
 	logger.Debug(logSender, "accepted inbound connection, ip: %v", conn.RemoteAddr().String())
 
+	var user dataprovider.User
+
+	err = json.Unmarshal([]byte(sconn.Permissions.Extensions["user"]), &user)
+
+	if err != nil {
+		logger.Warn(logSender, "Unable to deserialize user info, cannot serve connection: %v", err)
+		return
+	}
+
+	fs, err := user.GetFilesystem()
+	if err != nil {
+		logger.Warn(logSender, "Unable to create the filesystem for user %v, cannot serve connection: %v", user.Username, err)
+		return
+	}
+
+	connectionID := hex.EncodeToString(sconn.SessionID())
+
 	go ssh.DiscardRequests(reqs)
 
 	for newChannel := range chans {
 		// If its not a session channel we just move on because its not something we
 		// know how to handle at this point.
+		if isShuttingDown() {
+			logger.Debug(logSender, "new channel rejected, the server is shutting down, connection id: %v", connectionID)
+			newChannel.Reject(ssh.ResourceShortage, "server is shutting down")
+			continue
+		}
 		if newChannel.ChannelType() != "session" {
 			logger.Debug(logSender, "received an unknown channel type: %v", newChannel.ChannelType())
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
@@ -148,8 +349,21 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 			continue
 		}
 
+		connection := Connection{
+			ID:            connectionID,
+			User:          user,
+			ClientVersion: string(sconn.ClientVersion()),
+			RemoteAddr:    sconn.RemoteAddr(),
+			StartTime:     time.Now(),
+			lastActivity:  time.Now(),
+			lock:          new(sync.Mutex),
+			sshConn:       sconn,
+			fs:            fs,
+		}
+
 		// Channels have a type that is dependent on the protocol. For SFTP this is "subsystem"
-		// with a payload that (should) be "sftp". Discard anything else we receive ("pty", "shell", etc)
+		// with a payload that (should) be "sftp". For SCP this is "exec" with a payload that
+		// contains the scp command. Discard anything else we receive ("pty", "shell", etc)
 		go func(in <-chan *ssh.Request) {
 			for req := range in {
 				ok := false
@@ -158,77 +372,166 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 				case "subsystem":
 					if string(req.Payload[4:]) == "sftp" {
 						ok = true
+						connection.protocol = protocolSFTP
+						go c.handleSftpConnection(channel, connection)
 					}
+				case "exec":
+					ok = c.handleExecRequest(req.Payload, channel, connection)
 				}
 
 				req.Reply(ok, nil)
 			}
 		}(requests)
+	}
+}
 
-		var user dataprovider.User
-
-		err = json.Unmarshal([]byte(sconn.Permissions.Extensions["user"]), &user)
-
-		if err != nil {
-			logger.Warn(logSender, "Unable to deserialize user info, cannot serve connection: %v", err)
-			return
+// handleExecRequest starts the requested command, if enabled, and returns false if the command cannot be served
+func (c Configuration) handleExecRequest(payload []byte, channel ssh.Channel, connection Connection) bool {
+	var msg execMsg
+	if err := ssh.Unmarshal(payload, &msg); err != nil {
+		return false
+	}
+	name, args, err := parseCommandPayload(msg.Command)
+	logger.Debug(logSender, "new exec command: %v args: %v user: %v, error: %v", name, args,
+		connection.User.Username, err)
+	if err != nil {
+		return false
+	}
+	if name == "scp" && c.EnableSCP && len(args) >= 2 {
+		connection.protocol = protocolSCP
+		scpCommand := scpCommand{
+			connection: connection,
+			args:       args,
+			channel:    channel,
 		}
+		go scpCommand.handle()
+		return true
+	}
+	if utils.IsStringInSlice(name, c.EnabledSSHCommands) {
+		connection.protocol = protocolSSH
+		sshCommand := sshCommand{
+			command:    name,
+			connection: connection,
+			args:       args,
+			channel:    channel,
+		}
+		go sshCommand.handle()
+		return true
+	}
+	return false
+}
 
-		connectionID := hex.EncodeToString(sconn.SessionID())
+func (c Configuration) handleSftpConnection(channel io.ReadWriteCloser, connection Connection) {
+	addConnection(connection.ID, connection)
+	// Create the server instance for the channel using the handler we created above.
+	server := sftp.NewRequestServer(&sftpChannel{ReadWriteCloser: channel, connectionID: connection.ID}, sftp.Handlers{
+		FileGet:  connection,
+		FilePut:  connection,
+		FileCmd:  connection,
+		FileList: connection,
+	})
 
-		// Create a new handler for the currently logged in user's server.
-		handler := c.createHandler(sconn, user, connectionID)
+	if err := server.Serve(); err == io.EOF {
+		logger.Debug(logSender, "connection closed, id: %v", connection.ID)
+		server.Close()
+	} else if err != nil {
+		logger.Error(logSender, "sftp connection closed with error id %v: %v", connection.ID, err)
+	}
 
-		// Create the server instance for the channel using the handler we created above.
-		server := sftp.NewRequestServer(channel, handler)
+	closeConnectionDirListers(connection.ID)
+	removeConnection(connection.ID)
+}
 
-		if err := server.Serve(); err == io.EOF {
-			logger.Debug(logSender, "connection closed, id: %v", connectionID)
-			server.Close()
-		} else if err != nil {
-			logger.Error(logSender, "sftp connection closed with error id %v: %v", connectionID, err)
-		}
+// sftpChannel wraps the channel used by an SFTP session. When the client connection is closed the
+// SFTP server closes the files still open, so the related transfers are marked as aborted first
+type sftpChannel struct {
+	io.ReadWriteCloser
+	connectionID string
+}
 
-		removeConnection(connectionID)
+func (c *sftpChannel) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if err != nil {
+		abortConnectionTransfers(c.connectionID)
 	}
+	return n, err
 }
 
-func (c Configuration) createHandler(conn *ssh.ServerConn, user dataprovider.User, connectionID string) sftp.Handlers {
-
-	connection := Connection{
-		ID:            connectionID,
-		User:          user,
-		ClientVersion: string(conn.ClientVersion()),
-		RemoteAddr:    conn.RemoteAddr(),
-		StartTime:     time.Now(),
-		lastActivity:  time.Now(),
-		lock:          new(sync.Mutex),
-		sshConn:       conn,
+func (c *Configuration) checkListingOptions() {
+	if c.MaxListEntries < 0 {
+		logger.Warn(logSender, "invalid max_list_entries %v, please fix your config file, listings will not be limited",
+			c.MaxListEntries)
+		c.MaxListEntries = 0
 	}
+	patterns := []string{}
+	for _, pattern := range c.HidePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			logger.Warn(logSender, "invalid hide pattern %#v ignored: %v", pattern, err)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	c.HidePatterns = patterns
+	logger.Debug(logSender, "max list entries: %v, hide patterns: %v", c.MaxListEntries, c.HidePatterns)
+}
 
-	addConnection(connectionID, connection)
+func (c *Configuration) checkConnectionsLimits() {
+	if c.MaxConnections < 0 {
+		logger.Warn(logSender, "invalid max_connections %v, please fix your config file, connections will not be limited",
+			c.MaxConnections)
+		c.MaxConnections = 0
+	}
+	if c.MaxConnectionsPerIP < 0 {
+		logger.Warn(logSender, "invalid max_connections_per_ip %v, please fix your config file, connections will not be limited",
+			c.MaxConnectionsPerIP)
+		c.MaxConnectionsPerIP = 0
+	}
+	logger.Debug(logSender, "max connections: %v, max connections per IP: %v", c.MaxConnections, c.MaxConnectionsPerIP)
+}
 
-	return sftp.Handlers{
-		FileGet:  connection,
-		FilePut:  connection,
-		FileCmd:  connection,
-		FileList: connection,
+func (c *Configuration) checkSSHCommands() {
+	sshCommands := []string{}
+	for _, command := range c.EnabledSSHCommands {
+		if utils.IsStringInSlice(command, supportedSSHCommands) {
+			sshCommands = append(sshCommands, command)
+		} else {
+			logger.Warn(logSender, "unsupported ssh command: %#v ignored", command)
+		}
 	}
+	c.EnabledSSHCommands = sshCommands
+	logger.Debug(logSender, "enabled SSH commands: %v", c.EnabledSSHCommands)
 }
 
-func loginUser(user dataprovider.User) (*ssh.Permissions, error) {
+func loginUser(user dataprovider.User, remoteAddr net.Addr) (*ssh.Permissions, error) {
+	if isShuttingDown() {
+		logger.Debug(logSender, "login refused for user %v, the server is shutting down", user.Username)
+		return nil, errors.New("the server is shutting down")
+	}
 	if !filepath.IsAbs(user.HomeDir) {
 		logger.Warn(logSender, "user %v has invalid home dir: %v. Home dir must be an absolute path, login not allowed",
 			user.Username, user.HomeDir)
 		return nil, fmt.Errorf("Cannot login user with invalid home dir: %v", user.HomeDir)
 	}
-	if _, err := os.Stat(user.HomeDir); os.IsNotExist(err) {
+	if !user.IsLoginFromAddrAllowed(remoteAddr.String()) {
+		logger.AuditLog(auditEventLoginRefused, user.Username, remoteAddr.String(), "source address not allowed")
+		logger.Debug(logSender, "login refused for user %v, source address %v not allowed", user.Username, remoteAddr)
+		return nil, fmt.Errorf("Login for user %v is not allowed from this address: %v", user.Username, remoteAddr)
+	}
+	fs, err := user.GetFilesystem()
+	if err != nil {
+		logger.Warn(logSender, "unable to create the filesystem for user %v: %v, login not allowed", user.Username, err)
+		return nil, err
+	}
+	if _, err := fs.Stat(user.HomeDir); fs.IsNotExist(err) {
 		logger.Debug(logSender, "home directory \"%v\" for user %v does not exist, try to create", user.HomeDir, user.Username)
-		err := os.MkdirAll(user.HomeDir, 0777)
+		err := fs.MkdirAll(user.HomeDir, 0777)
 		if err == nil {
-			utils.SetPathPermissions(user.HomeDir, user.GetUID(), user.GetGID())
+			vfs.SetPathPermissions(fs, user.HomeDir, user.GetUID(), user.GetGID())
 		}
 	}
+	for _, folder := range user.VirtualFolders {
+		checkVirtualFolderDirs(fs, user, folder)
+	}
 
 	if user.MaxSessions > 0 {
 		activeSessions := getActiveSessions(user.Username)
@@ -250,47 +553,397 @@ func loginUser(user dataprovider.User) (*ssh.Permissions, error) {
 	return p, nil
 }
 
-func (c Configuration) validatePublicKeyCredentials(conn ssh.ConnMetadata, pubKey string) (*ssh.Permissions, error) {
-	var err error
+// checkVirtualFolderDirs creates the mapped path for the given virtual folder and its parent
+// directory inside the user home, if missing, so the folder can be reached browsing the user tree
+func checkVirtualFolderDirs(fs vfs.Fs, user dataprovider.User, folder dataprovider.VirtualFolder) {
+	dirs := []string{folder.MappedPath, filepath.Join(user.GetHomeDir(), filepath.FromSlash(path.Dir(folder.VirtualPath)))}
+	for _, dir := range dirs {
+		if _, err := fs.Stat(dir); fs.IsNotExist(err) {
+			logger.Debug(logSender, "directory %#v for virtual folder %#v, user %v, does not exist, try to create", dir,
+				folder.VirtualPath, user.Username)
+			err := fs.MkdirAll(dir, 0777)
+			if err == nil {
+				vfs.SetPathPermissions(fs, dir, user.GetUID(), user.GetGID())
+			} else {
+				logger.Warn(logSender, "unable to create directory %#v for virtual folder %#v: %v", dir,
+					folder.VirtualPath, err)
+			}
+		}
+	}
+}
+
+func (c Configuration) validatePublicKeyCredentials(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+	user, criticalOptions, err := c.checkPublicKey(conn, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkAuthMethods(conn, user, []string{dataprovider.SSHLoginMethodPublicKey}, criticalOptions)
+}
+
+// checkPublicKey returns the user that owns the given public key or certificate and the certificate's
+// critical options, if any
+func (c Configuration) checkPublicKey(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (dataprovider.User, map[string]string, error) {
+	if cert, ok := pubKey.(*ssh.Certificate); ok {
+		return c.validateUserCertificate(conn, cert)
+	}
+	user, err := dataprovider.CheckUserAndPubKey(dataProvider, conn.User(), string(pubKey.Marshal()),
+		utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()))
+	return user, nil, err
+}
+
+// validateUserCertificate checks that the certificate is signed by a trusted CA, it is not revoked,
+// it is inside its validity window, it has no unsupported critical options and the username is
+// one of its principals. Certificates without principals are rejected
+func (c Configuration) validateUserCertificate(conn ssh.ConnMetadata, cert *ssh.Certificate) (dataprovider.User, map[string]string, error) {
 	var user dataprovider.User
+	if c.certChecker == nil {
+		logger.Debug(logSender, "certificate authentication refused for user %#v, no trusted CA configured", conn.User())
+		return user, nil, errors.New("certificate authentication is not enabled")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		logger.Debug(logSender, "certificate authentication refused for user %#v, certificate %#v has no principals",
+			conn.User(), cert.KeyId)
+		return user, nil, errors.New("certificate without principals")
+	}
+	certPerms, err := c.certChecker.Authenticate(conn, cert)
+	if err != nil {
+		logger.Debug(logSender, "certificate authentication refused for user %#v, certificate %#v: %v", conn.User(),
+			cert.KeyId, err)
+		return user, nil, err
+	}
+	user, err = dataprovider.UserExists(dataProvider, conn.User())
+	if err != nil {
+		return user, nil, err
+	}
+	logger.Debug(logSender, "user %#v authenticated using certificate %#v serial %v signed by %v", user.Username,
+		cert.KeyId, cert.Serial, ssh.FingerprintSHA256(cert.SignatureKey))
+	return user, certPerms.CriticalOptions, nil
+}
+
+// checkAuthMethods is called after each successful authentication step. If the completed methods are enough
+// the user is logged in, otherwise the client is asked to continue the authentication using the next allowed
+// methods. The critical options of a certificate are returned with the final permissions since the
+// source-address option is enforced by the SSH library using them
+func (c Configuration) checkAuthMethods(conn ssh.ConnMetadata, user dataprovider.User, completed []string,
+	criticalOptions map[string]string) (*ssh.Permissions, error) {
+	nextMethods, done := user.GetNextAuthMethods(completed)
+	if done {
+		p, err := loginUser(user, conn.RemoteAddr())
+		if err != nil {
+			return nil, err
+		}
+		p.CriticalOptions = criticalOptions
+		return p, nil
+	}
+	if len(nextMethods) == 0 {
+		logger.Debug(logSender, "authentication refused for user %#v, completed methods %v do not match the required ones: %v",
+			user.Username, completed, user.Filters.RequiredAuthMethods)
+		return nil, errors.New("authentication method not allowed")
+	}
+	logger.Debug(logSender, "user %#v completed authentication methods %v, next allowed methods: %v", user.Username,
+		completed, nextMethods)
+	partialSuccess := &ssh.PartialSuccessError{}
+	for _, method := range nextMethods {
+		methods := append(append([]string{}, completed...), method)
+		switch method {
+		case dataprovider.SSHLoginMethodPassword:
+			partialSuccess.Next.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+				u, err := c.checkPassword(conn, pass)
+				if err != nil {
+					return nil, err
+				}
+				return c.checkAuthMethods(conn, u, methods, criticalOptions)
+			}
+		case dataprovider.SSHLoginMethodKeyboardInteractive:
+			partialSuccess.Next.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata,
+				client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				u, err := c.checkKeyboardInteractive(conn, client)
+				if err != nil {
+					return nil, err
+				}
+				return c.checkAuthMethods(conn, u, methods, criticalOptions)
+			}
+		case dataprovider.SSHLoginMethodPublicKey:
+			partialSuccess.Next.PublicKeyCallback = func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
+				u, options, err := c.checkPublicKey(conn, pubKey)
+				if err != nil {
+					return nil, err
+				}
+				if options == nil {
+					options = criticalOptions
+				}
+				return c.checkAuthMethods(conn, u, methods, options)
+			}
+		}
+	}
+	return nil, partialSuccess
+}
 
-	if user, err = dataprovider.CheckUserAndPubKey(dataProvider, conn.User(), pubKey); err == nil {
-		return loginUser(user)
+func (c *Configuration) initializeCertChecker(configDir string) error {
+	c.certChecker = nil
+	if len(c.TrustedUserCAKeys) == 0 {
+		return nil
+	}
+	var caKeys []ssh.PublicKey
+	for _, k := range c.TrustedUserCAKeys {
+		keyPath := k
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(configDir, keyPath)
+		}
+		keys, err := parseAuthorizedKeysFile(keyPath)
+		if err != nil {
+			logger.Warn(logSender, "error loading trusted user CA keys from file %#v: %v", keyPath, err)
+			return err
+		}
+		for _, key := range keys {
+			logger.Info(logSender, "loaded trusted user CA key type: %v, fingerprint: %v", key.Type(),
+				ssh.FingerprintSHA256(key))
+		}
+		caKeys = append(caKeys, keys...)
+	}
+	revokedCerts := []string{}
+	if len(c.RevokedUserCertsFile) > 0 {
+		revokedPath := c.RevokedUserCertsFile
+		if !filepath.IsAbs(revokedPath) {
+			revokedPath = filepath.Join(configDir, revokedPath)
+		}
+		content, err := ioutil.ReadFile(revokedPath)
+		if err == nil {
+			err = json.Unmarshal(content, &revokedCerts)
+		}
+		if err != nil {
+			logger.Warn(logSender, "error loading revoked user certificates from file %#v: %v", revokedPath, err)
+			return err
+		}
+		logger.Info(logSender, "loaded %v revoked user certificates", len(revokedCerts))
+	}
+	c.certChecker = &ssh.CertChecker{
+		SupportedCriticalOptions: []string{},
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			authBytes := auth.Marshal()
+			for _, k := range caKeys {
+				if bytes.Equal(k.Marshal(), authBytes) {
+					return true
+				}
+			}
+			return false
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return utils.IsStringInSlice(ssh.FingerprintSHA256(cert), revokedCerts)
+		},
+	}
+	return nil
+}
+
+// initializeDefender returns the defender to use, nil if disabled. If the configuration is reloaded the
+// current defender is kept if its settings are unchanged, otherwise the active bans are copied to the new one
+func (c *Configuration) initializeDefender(configDir string) (*defender, error) {
+	if !c.Defender.Enabled {
+		return nil, nil
+	}
+	c.Defender.checkDefenderConfig()
+	current := getDefender()
+	if current != nil && current.config == c.Defender {
+		return current, nil
+	}
+	d, err := newDefender(c.Defender, configDir)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil {
+		d.importBans(current)
+	}
+	logger.Info(logSender, "defender enabled, threshold: %v, observation time: %v minutes, ban time: %v minutes",
+		c.Defender.Threshold, c.Defender.ObservationTime, c.Defender.BanTime)
+	return d, nil
+}
+
+// parseAuthorizedKeysFile returns the public keys contained in a file using the authorized_keys format
+func parseAuthorizedKeysFile(keysPath string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	content, err := ioutil.ReadFile(keysPath)
+	if err != nil {
+		return keys, err
+	}
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return keys, fmt.Errorf("no public key found in file %#v", keysPath)
 	}
-	return nil, err
+	return keys, nil
 }
 
 func (c Configuration) validatePasswordCredentials(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-	var err error
-	var user dataprovider.User
+	user, err := c.checkPassword(conn, pass)
+	if err != nil {
+		return nil, err
+	}
+	return c.checkAuthMethods(conn, user, []string{dataprovider.SSHLoginMethodPassword}, nil)
+}
 
-	if user, err = dataprovider.CheckUserAndPass(dataProvider, conn.User(), string(pass)); err == nil {
-		return loginUser(user)
+// checkPassword returns the user with the given password. Password authentication is refused for users with
+// the TOTP second factor enabled, they must use keyboard interactive authentication
+func (c Configuration) checkPassword(conn ssh.ConnMetadata, pass []byte) (dataprovider.User, error) {
+	user, err := dataprovider.CheckUserAndPass(dataProvider, conn.User(), string(pass),
+		utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()))
+	if err != nil {
+		return user, err
 	}
-	return nil, err
+	if user.TOTPConfig.Enabled {
+		logger.Debug(logSender, "password authentication refused for user %#v, TOTP is enabled", user.Username)
+		return user, errors.New("password authentication is not allowed with TOTP enabled")
+	}
+	return user, nil
 }
 
-// Generates a private key that will be used by the SFTP server.
-func (c Configuration) generatePrivateKey(configDir string) error {
-	key, err := rsa.GenerateKey(rand.Reader, 4096)
+func (c Configuration) validateKeyboardInteractiveCredentials(conn ssh.ConnMetadata,
+	client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	user, err := c.checkKeyboardInteractive(conn, client)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return c.checkAuthMethods(conn, user, []string{dataprovider.SSHLoginMethodKeyboardInteractive}, nil)
+}
 
-	o, err := os.OpenFile(filepath.Join(configDir, "id_rsa"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+// checkKeyboardInteractive asks for the password and then, if the user has the second factor enabled,
+// for the TOTP code
+func (c Configuration) checkKeyboardInteractive(conn ssh.ConnMetadata,
+	client ssh.KeyboardInteractiveChallenge) (dataprovider.User, error) {
+	var user dataprovider.User
+	answers, err := client(conn.User(), "", []string{"Password: "}, []bool{false})
 	if err != nil {
-		return err
+		return user, err
 	}
-	defer o.Close()
+	if len(answers) != 1 {
+		return user, errors.New("unexpected number of answers")
+	}
+	user, err = dataprovider.CheckUserAndPass(dataProvider, conn.User(), answers[0],
+		utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()))
+	if err != nil {
+		return user, err
+	}
+	if !user.TOTPConfig.Enabled {
+		return user, nil
+	}
+	answers, err = client(conn.User(), "", []string{"Verification code: "}, []bool{true})
+	if err != nil {
+		return user, err
+	}
+	if len(answers) != 1 {
+		return user, errors.New("unexpected number of answers")
+	}
+	err = dataprovider.CheckUserTOTPCode(user, strings.TrimSpace(answers[0]))
+	if err != nil {
+		logger.Debug(logSender, "keyboard interactive authentication refused for user %#v: %v", user.Username, err)
+	}
+	return user, err
+}
 
-	pkey := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
+// checkAndLoadHostKeys adds the configured host keys to the given server configuration and returns their details,
+// missing keys with a default name are generated
+func (c *Configuration) checkAndLoadHostKeys(configDir string, serverConfig *ssh.ServerConfig) ([]HostKey, error) {
+	if len(c.HostKeys) == 0 {
+		c.HostKeys = []string{defaultPrivateRSAKeyName, defaultPrivateECDSAKeyName, defaultPrivateEd25519KeyName}
 	}
+	keys := []HostKey{}
+	for _, k := range c.HostKeys {
+		hostKeyPath := k
+		if !filepath.IsAbs(hostKeyPath) {
+			hostKeyPath = filepath.Join(configDir, hostKeyPath)
+		}
+		if _, err := os.Stat(hostKeyPath); os.IsNotExist(err) {
+			logger.Info(logSender, "creating new private key %#v", hostKeyPath)
+			if err := generatePrivateKey(hostKeyPath); err != nil {
+				logger.Warn(logSender, "unable to create private key %#v: %v", hostKeyPath, err)
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
 
-	if err := pem.Encode(o, pkey); err != nil {
+		privateBytes, err := ioutil.ReadFile(hostKeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		private, err := ssh.ParsePrivateKey(privateBytes)
+		if err != nil {
+			logger.Warn(logSender, "unable to parse private key %#v: %v", hostKeyPath, err)
+			return nil, err
+		}
+
+		hostKey := HostKey{
+			Path:        hostKeyPath,
+			Type:        private.PublicKey().Type(),
+			Fingerprint: ssh.FingerprintSHA256(private.PublicKey()),
+		}
+		logger.Info(logSender, "loaded host key %#v, type: %v, fingerprint: %v", hostKey.Path, hostKey.Type,
+			hostKey.Fingerprint)
+		// Add our private key to the server configuration, a key replaces any previous key with the same type
+		serverConfig.AddHostKey(private)
+		keys = append(keys, hostKey)
+	}
+	return keys, nil
+}
+
+// generatePrivateKey generates a private key that will be used by the SFTP server.
+// The key type is inferred from the file name: id_rsa, id_ecdsa and id_ed25519 are supported
+func generatePrivateKey(keyPath string) error {
+	var pkey *pem.Block
+	switch filepath.Base(keyPath) {
+	case defaultPrivateRSAKeyName:
+		key, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return err
+		}
+		pkey = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}
+	case defaultPrivateECDSAKeyName:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		keyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		pkey = &pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: keyBytes,
+		}
+	case defaultPrivateEd25519KeyName:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		pkey = &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: keyBytes,
+		}
+	default:
+		return fmt.Errorf("unable to infer the key type from the file name %#v", filepath.Base(keyPath))
+	}
+
+	o, err := os.OpenFile(keyPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
 		return err
 	}
+	defer o.Close()
 
-	return nil
+	return pem.Encode(o, pkey)
 }
@@ -4,7 +4,9 @@
 package sftpd
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -16,6 +18,7 @@ import (
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
@@ -27,21 +30,84 @@ const (
 	sftpdMkdirLogSender    = "SFTPMkdir"
 	sftpdSymlinkLogSender  = "SFTPSymlink"
 	sftpdRemoveLogSender   = "SFTPRemove"
+	sftpdChmodLogSender    = "SFTPChmod"
+	sftpdChownLogSender    = "SFTPChown"
+	sftpdChtimesLogSender  = "SFTPChtimes"
+	fileFilterLogSender    = "FileFilter"
+	logSenderSCP           = "scp"
+	scpUploadLogSender     = "SCPUpload"
+	scpDownloadLogSender   = "SCPDownload"
+	scpMkdirLogSender      = "SCPMkdir"
+	sshCmdLogSenderPrefix  = "SSH"
 	operationDownload      = "download"
 	operationUpload        = "upload"
 	operationDelete        = "delete"
 	operationRename        = "rename"
+	protocolSFTP           = "SFTP"
+	protocolSCP            = "SCP"
+	protocolSSH            = "SSH"
+	actionStatusOK         = "ok"
+	actionStatusError      = "error"
+	// audit log event for the logins refused because of the user's source address restrictions
+	auditEventLoginRefused = "login_refused"
+	// suffix added to the partial uploads if the partial upload policy is rename
+	partialUploadSuffix = ".partial"
+
+	defaultPrivateRSAKeyName     = "id_rsa"
+	defaultPrivateECDSAKeyName   = "id_ecdsa"
+	defaultPrivateEd25519KeyName = "id_ed25519"
+	// hidden directory, inside the user home and the virtual folders mapped paths, for atomic uploads temporary files
+	uploadStagingDirName = ".sftpgo-uploads"
+)
+
+// Available upload modes
+const (
+	// the data are written directly to the target file
+	uploadModeStandard = iota
+	// the data are written to a temporary file that is renamed to the target file when the upload completes
+	uploadModeAtomic
+)
+
+// Available policies for partial uploads, they are applied to the failed uploads in standard upload mode
+const (
+	// the partial file is kept
+	partialUploadKeep = iota
+	// the partial file is removed
+	partialUploadDelete
+	// the partial file is renamed adding the ".partial" suffix
+	partialUploadRename
 )
 
 var (
-	mutex                sync.RWMutex
-	openConnections      map[string]Connection
-	activeTransfers      []*Transfer
-	idleConnectionTicker *time.Ticker
-	idleTimeout          time.Duration
-	activeQuotaScans     []ActiveQuotaScan
-	dataProvider         dataprovider.Provider
-	actions              Actions
+	mutex                     sync.RWMutex
+	openConnections           map[string]Connection
+	activeTransfers           []*Transfer
+	openDirListers            []*dirLister
+	idleConnectionTicker      *time.Ticker
+	idleTimeout               time.Duration
+	activeQuotaScans          []ActiveQuotaScan
+	dataProvider              dataprovider.Provider
+	actions                   Actions
+	hostKeys                  []HostKey
+	uploadMode                int
+	partialUploadPolicy       int
+	maxListEntries            int
+	hidePatterns              []string
+	maxConnections            int
+	maxConnectionsPerIP       int
+	netConnections            map[string]int
+	totalNetConnections       int
+	rejectedConnections       int64
+	rejectedConnectionsPerIP  int64
+	serverListener            net.Listener
+	activeConfig              Configuration
+	sshServerConfig           *ssh.ServerConfig
+	idleTimerStarted          bool
+	shuttingDown              bool
+	errTransferAborted        = errors.New("transfer aborted, the client connection was closed")
+	errShuttingDown           = errors.New("new transfers are not allowed, the server is shutting down")
+	errQuotaExceeded          = errors.New("denying write due to space limit: quota exceeded")
+	errUploadFileSizeExceeded = errors.New("denying write: the file exceeds the maximum allowed upload size")
 )
 
 type connectionTransfer struct {
@@ -78,6 +144,8 @@ type ConnectionStatus struct {
 	ConnectionID string `json:"connection_id"`
 	// client's version string
 	ClientVersion string `json:"client_version"`
+	// Protocol for this connection: SFTP, SCP or SSH
+	Protocol string `json:"protocol"`
 	// Remote address for this connection
 	RemoteAddress string `json:"remote_address"`
 	// Connection time as unix timestamp in milliseconds
@@ -88,8 +156,24 @@ type ConnectionStatus struct {
 	Transfers []connectionTransfer `json:"active_transfers"`
 }
 
+// NetConnectionsStats defines the counters for the network connections. The open connections include
+// the ones not yet authenticated
+type NetConnectionsStats struct {
+	// Open network connections
+	OpenConnections int `json:"open_connections"`
+	// Maximum number of open connections, 0 means unlimited
+	MaxConnections int `json:"max_connections"`
+	// Maximum number of open connections for each source IP, 0 means unlimited
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+	// Connections rejected because the maximum number of open connections was reached
+	RejectedConnections int64 `json:"rejected_connections"`
+	// Connections rejected because the maximum number of open connections for the source IP was reached
+	RejectedConnectionsPerIP int64 `json:"rejected_connections_per_ip"`
+}
+
 func init() {
 	openConnections = make(map[string]Connection)
+	netConnections = make(map[string]int)
 	idleConnectionTicker = time.NewTicker(5 * time.Minute)
 }
 
@@ -110,6 +194,57 @@ func getActiveSessions(username string) int {
 	return numSessions
 }
 
+// addNetConnection registers a new network connection from the given IP. It returns an error,
+// and the connection is counted as rejected, if a connections limit is reached
+func addNetConnection(ip string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if maxConnections > 0 && totalNetConnections >= maxConnections {
+		rejectedConnections++
+		return fmt.Errorf("too many open connections: %v", totalNetConnections)
+	}
+	if maxConnectionsPerIP > 0 && netConnections[ip] >= maxConnectionsPerIP {
+		rejectedConnectionsPerIP++
+		return fmt.Errorf("too many open connections from %v: %v", ip, netConnections[ip])
+	}
+	totalNetConnections++
+	netConnections[ip]++
+	return nil
+}
+
+func removeNetConnection(ip string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	totalNetConnections--
+	if netConnections[ip] > 1 {
+		netConnections[ip]--
+	} else {
+		delete(netConnections, ip)
+	}
+}
+
+// GetNetConnectionsStats returns the counters for the network connections
+func GetNetConnectionsStats() NetConnectionsStats {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return NetConnectionsStats{
+		OpenConnections:          totalNetConnections,
+		MaxConnections:           maxConnections,
+		MaxConnectionsPerIP:      maxConnectionsPerIP,
+		RejectedConnections:      rejectedConnections,
+		RejectedConnectionsPerIP: rejectedConnectionsPerIP,
+	}
+}
+
+// GetHostKeys returns the host keys used by the SFTP server
+func GetHostKeys() []HostKey {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	keys := make([]HostKey, len(hostKeys))
+	copy(keys, hostKeys)
+	return keys
+}
+
 // GetQuotaScans returns the active quota scans
 func GetQuotaScans() []ActiveQuotaScan {
 	mutex.RLock()
@@ -185,6 +320,7 @@ func GetConnectionsStats() []ConnectionStatus {
 			Username:       c.User.Username,
 			ConnectionID:   c.ID,
 			ClientVersion:  c.ClientVersion,
+			Protocol:       c.protocol,
 			RemoteAddress:  c.RemoteAddr.String(),
 			ConnectionTime: utils.GetTimeAsMsSinceEpoch(c.StartTime),
 			LastActivity:   utils.GetTimeAsMsSinceEpoch(c.lastActivity),
@@ -218,8 +354,15 @@ func GetConnectionsStats() []ConnectionStatus {
 	return stats
 }
 
-func startIdleTimer(maxIdleTime time.Duration) {
-	idleTimeout = maxIdleTime
+// startIdleTimer starts the periodic check for the idle connections, the idle timeout can be changed
+// reloading the configuration so the check runs even if it is disabled
+func startIdleTimer() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if idleTimerStarted {
+		return
+	}
+	idleTimerStarted = true
 	go func() {
 		for t := range idleConnectionTicker.C {
 			logger.Debug(logSender, "idle connections check ticker %v", t)
@@ -232,6 +375,9 @@ func startIdleTimer(maxIdleTime time.Duration) {
 func CheckIdleConnections() {
 	mutex.RLock()
 	defer mutex.RUnlock()
+	if idleTimeout <= 0 {
+		return
+	}
 	for _, c := range openConnections {
 		idleTime := time.Since(c.lastActivity)
 		for _, t := range activeTransfers {
@@ -296,6 +442,138 @@ func removeTransfer(transfer *Transfer) error {
 	return err
 }
 
+func getActiveTransfersCount() int {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return len(activeTransfers)
+}
+
+// getServerConfig returns the active configuration and the SSH server configuration built from it
+func getServerConfig() (Configuration, *ssh.ServerConfig) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return activeConfig, sshServerConfig
+}
+
+func getActions() Actions {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return actions
+}
+
+func getUploadMode() int {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return uploadMode
+}
+
+func getPartialUploadPolicy() int {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return partialUploadPolicy
+}
+
+func getListingOptions() (int, []string) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return maxListEntries, hidePatterns
+}
+
+func setServerListener(listener net.Listener) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	serverListener = listener
+}
+
+func isShuttingDown() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return shuttingDown
+}
+
+// Shutdown stops the SFTP server. The listener is closed and the new sessions are refused, then it waits
+// for the active transfers to complete, up to the given timeout, and closes the remaining connections
+func Shutdown(timeout time.Duration) {
+	mutex.Lock()
+	shuttingDown = true
+	listener := serverListener
+	serverListener = nil
+	mutex.Unlock()
+	if listener != nil {
+		logger.Info(logSender, "closing listener on address: %v", listener.Addr().String())
+		listener.Close()
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		numTransfers := getActiveTransfersCount()
+		if numTransfers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			logger.Warn(logSender, "shutdown timeout expired, %v active transfers will be aborted", numTransfers)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, c := range openConnections {
+		logger.Debug(logSender, "closing connection with id: %v on shutdown", c.ID)
+		c.sshConn.Close()
+	}
+	logger.Info(logSender, "SFTP server shutdown completed")
+}
+
+func addDirLister(lister *dirLister) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	openDirListers = append(openDirListers, lister)
+}
+
+func removeDirLister(lister *dirLister) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, l := range openDirListers {
+		if l == lister {
+			openDirListers[i] = openDirListers[len(openDirListers)-1]
+			openDirListers = openDirListers[:len(openDirListers)-1]
+			return
+		}
+	}
+}
+
+// closeConnectionDirListers closes the directories still open for the given connection. The SFTP server does not
+// close the listers, so the directories abandoned by the client before the end of the listing are closed here
+func closeConnectionDirListers(connectionID string) {
+	var listers []*dirLister
+	mutex.Lock()
+	for i := len(openDirListers) - 1; i >= 0; i-- {
+		if openDirListers[i].connectionID == connectionID {
+			listers = append(listers, openDirListers[i])
+			openDirListers = append(openDirListers[:i], openDirListers[i+1:]...)
+		}
+	}
+	mutex.Unlock()
+	// the listers are closed without holding the global mutex, they acquire it to unregister themselves
+	for _, l := range listers {
+		logger.Debug(logSender, "closing abandoned listing for directory %v, connection id: %v", l.dirPath, connectionID)
+		l.abort()
+	}
+}
+
+// abortConnectionTransfers marks the active transfers for the given connection as aborted.
+// It is called when the client connection is closed, the transfers still open are then closed by the SFTP server
+func abortConnectionTransfers(connectionID string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, t := range activeTransfers {
+		if t.connectionID == connectionID && t.getTransferError() == nil {
+			logger.Debug(logSender, "transfer for path %v aborted, connection id: %v", t.path, connectionID)
+			t.setTransferError(errTransferAborted)
+		}
+	}
+}
+
 func updateConnectionActivity(id string) {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -305,17 +583,18 @@ func updateConnectionActivity(id string) {
 	}
 }
 
-func executeAction(operation string, username string, path string, target string) error {
+func executeAction(operation string, username string, path string, target string, status string) error {
+	actions := getActions()
 	if !utils.IsStringInSlice(operation, actions.ExecuteOn) {
 		return nil
 	}
 	var err error
 	if len(actions.Command) > 0 && filepath.IsAbs(actions.Command) {
 		if _, err = os.Stat(actions.Command); err == nil {
-			command := exec.Command(actions.Command, operation, username, path, target)
+			command := exec.Command(actions.Command, operation, username, path, target, status)
 			err = command.Start()
-			logger.Debug(logSender, "executed command \"%v\" with arguments: %v, %v, %v, %v, error: %v",
-				actions.Command, operation, username, path, target, err)
+			logger.Debug(logSender, "executed command \"%v\" with arguments: %v, %v, %v, %v, %v, error: %v",
+				actions.Command, operation, username, path, target, status, err)
 		} else {
 			logger.Warn(logSender, "Invalid action command \"%v\" : %v", actions.Command, err)
 		}
@@ -331,6 +610,7 @@ func executeAction(operation string, username string, path string, target string
 			if len(target) > 0 {
 				q.Add("target_path", target)
 			}
+			q.Add("status", status)
 			url.RawQuery = q.Encode()
 			go func() {
 				startTime := time.Now()
@@ -0,0 +1,249 @@
+package sftpd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	supportedSSHCommands = []string{"md5sum", "sha1sum", "sha256sum", "sha384sum", "sha512sum", "du", "df"}
+	errUnsupportedConfig = errors.New("command unsupported for this configuration")
+)
+
+// sshCommand handles the built-in commands that can be executed using "exec" requests.
+// Commands are never executed using the system shell: they are implemented inside SFTPGo
+// and they can only access the files inside the user's home directory
+type sshCommand struct {
+	command    string
+	connection Connection
+	args       []string
+	channel    ssh.Channel
+}
+
+func (c *sshCommand) handle() error {
+	var err error
+	addConnection(c.connection.ID, c.connection)
+	defer removeConnection(c.connection.ID)
+	updateConnectionActivity(c.connection.ID)
+	logger.Debug(logSender, "handle ssh command: %v args: %v user: %v", c.command, c.args, c.connection.User.Username)
+	switch c.command {
+	case "md5sum", "sha1sum", "sha256sum", "sha384sum", "sha512sum":
+		err = c.handleHashCommands()
+	case "du":
+		err = c.handleDiskUsage()
+	case "df":
+		err = c.handleDiskFree()
+	default:
+		err = errUnsupportedConfig
+	}
+	if err != nil {
+		c.sendErrorMessage(err)
+	}
+	c.sendExitStatus(err)
+	return err
+}
+
+func (c *sshCommand) handleHashCommands() error {
+	paths := c.getPaths()
+	if len(paths) == 0 {
+		return errors.New("no file specified")
+	}
+	for _, sshPath := range paths {
+		virtualPath := c.getVirtualPath(sshPath)
+		if !c.connection.User.HasPerm(dataprovider.PermDownload, path.Dir(virtualPath)) {
+			return fmt.Errorf("%v: %v", sshPath, errPermDen)
+		}
+		// computing the hash is a read, the file patterns filters apply
+		if !c.connection.isFileAllowed(virtualPath, c.command) {
+			return fmt.Errorf("%v: %v", sshPath, errPermDen)
+		}
+		p, err := c.connection.buildPath(virtualPath)
+		if err != nil {
+			return fmt.Errorf("%v: %v", sshPath, errPermDen)
+		}
+		h, err := c.computeHash(p)
+		if err != nil {
+			logger.Warn(logSender, "unable to compute %v for file %#v: %v", c.command, p, err)
+			return fmt.Errorf("%v: unable to compute hash", sshPath)
+		}
+		logger.CommandLog(c.getLogSender(), p, "", c.connection.User.Username, c.connection.ID)
+		_, err = c.channel.Write([]byte(fmt.Sprintf("%v  %v\n", h, sshPath)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *sshCommand) handleDiskUsage() error {
+	paths := c.getPaths()
+	if len(paths) == 0 {
+		paths = append(paths, ".")
+	}
+	for _, sshPath := range paths {
+		virtualPath := c.getVirtualPath(sshPath)
+		if !c.connection.User.HasPerm(dataprovider.PermListItems, virtualPath) {
+			return fmt.Errorf("%v: %v", sshPath, errPermDen)
+		}
+		p, err := c.connection.buildPath(virtualPath)
+		if err != nil {
+			return fmt.Errorf("%v: %v", sshPath, errPermDen)
+		}
+		var size int64
+		fi, err := c.connection.fs.Stat(p)
+		if err == nil {
+			if fi.IsDir() {
+				_, size, _, err = vfs.ScanDirContents(c.connection.fs, p)
+			} else {
+				size = fi.Size()
+			}
+		}
+		if err != nil {
+			logger.Warn(logSender, "unable to compute disk usage for path %#v: %v", p, err)
+			return fmt.Errorf("%v: unable to compute disk usage", sshPath)
+		}
+		logger.CommandLog(c.getLogSender(), p, "", c.connection.User.Username, c.connection.ID)
+		_, err = c.channel.Write([]byte(fmt.Sprintf("%v\t%v\n", size, sshPath)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleDiskFree reports the quota limits for users with a size quota and the free space on
+// the filesystem containing the home directory for the other users. Sizes are in bytes
+func (c *sshCommand) handleDiskFree() error {
+	if !c.connection.User.HasPerm(dataprovider.PermListItems, "/") {
+		return errPermDen
+	}
+	var total, used, available uint64
+	if c.connection.User.QuotaSize > 0 {
+		_, usedSize, err := dataprovider.GetUsedQuota(dataProvider, c.connection.User.Username)
+		if err != nil {
+			logger.Warn(logSender, "error getting used quota for %v: %v", c.connection.User.Username, err)
+			return errors.New("unable to get disk usage")
+		}
+		total = uint64(c.connection.User.QuotaSize)
+		if usedSize > 0 {
+			used = uint64(usedSize)
+		}
+		if used < total {
+			available = total - used
+		}
+	} else {
+		if _, ok := c.connection.fs.(*vfs.OsFs); !ok {
+			// the disk space is only known for the local filesystem
+			return errors.New("disk usage is only available for users with a size quota")
+		}
+		var err error
+		total, available, err = utils.GetDiskSpace(c.connection.User.HomeDir)
+		if err != nil {
+			logger.Warn(logSender, "unable to get disk space for dir %#v: %v", c.connection.User.HomeDir, err)
+			return errors.New("unable to get disk usage")
+		}
+		used = total - available
+	}
+	usedPercentage := uint64(0)
+	if total > 0 {
+		usedPercentage = used * 100 / total
+	}
+	logger.CommandLog(c.getLogSender(), c.connection.User.HomeDir, "", c.connection.User.Username, c.connection.ID)
+	_, err := c.channel.Write([]byte(fmt.Sprintf("Size Used Available Use%%\n%v %v %v %v%%\n", total, used,
+		available, usedPercentage)))
+	return err
+}
+
+func (c *sshCommand) computeHash(filePath string) (string, error) {
+	var h hash.Hash
+	switch c.command {
+	case "md5sum":
+		h = md5.New()
+	case "sha1sum":
+		h = sha1.New()
+	case "sha256sum":
+		h = sha256.New()
+	case "sha384sum":
+		h = sha512.New384()
+	default:
+		h = sha512.New()
+	}
+	f, err := c.connection.fs.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("%v is a directory", filePath)
+	}
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// getPaths returns the command arguments ignoring flags, flags are not allowed after an argument equal to "--"
+func (c *sshCommand) getPaths() []string {
+	var paths []string
+	isFlag := true
+	for _, arg := range c.args {
+		if isFlag {
+			if arg == "--" {
+				isFlag = false
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				continue
+			}
+		}
+		paths = append(paths, arg)
+	}
+	return paths
+}
+
+// getVirtualPath converts a path relative to the home dir to a virtual absolute path
+func (c *sshCommand) getVirtualPath(sshPath string) string {
+	return path.Join("/", sshPath)
+}
+
+// getLogSender returns the sender for command logs, for example SSHSha256sum
+func (c *sshCommand) getLogSender() string {
+	return sshCmdLogSenderPrefix + strings.ToUpper(c.command[:1]) + c.command[1:]
+}
+
+func (c *sshCommand) sendErrorMessage(err error) {
+	message := fmt.Sprintf("%v: %v\n", c.command, err)
+	if _, e := c.channel.Stderr().Write([]byte(message)); e != nil {
+		logger.Warn(logSender, "unable to send ssh command error message: %v", e)
+	}
+}
+
+func (c *sshCommand) sendExitStatus(err error) {
+	status := uint32(0)
+	if err != nil {
+		status = uint32(1)
+	}
+	exitStatus := exitStatusMsg{
+		Status: status,
+	}
+	c.channel.SendRequest("exit-status", false, ssh.Marshal(&exitStatus))
+	c.channel.Close()
+}
@@ -1,11 +1,14 @@
 package sftpd
 
 import (
-	"os"
+	"fmt"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
 )
 
 const (
@@ -16,8 +19,12 @@ const (
 // Transfer contains the transfer details for an upload or a download.
 // It implements the io Reader and Writer interface to handle files downloads and uploads
 type Transfer struct {
-	file          *os.File
-	path          string
+	file vfs.File
+	path string
+	// temporary file for atomic uploads, it is renamed to path when the upload completes. Empty for the other transfers
+	tempPath      string
+	fs            vfs.Fs
+	requestPath   string
 	start         time.Time
 	bytesSent     int64
 	bytesReceived int64
@@ -26,6 +33,34 @@ type Transfer struct {
 	transferType  int
 	lastActivity  time.Time
 	isNewFile     bool
+	// true for upload resume and append, the existing data is kept
+	isResume       bool
+	initialSize    int64
+	minWriteOffset int64
+	maxWriteOffset int64
+	// size of the existing file replaced by an atomic upload
+	replacedSize int64
+	// maximum size allowed for the uploaded file, computed when the file is opened. 0 means unlimited
+	maxFileSize int64
+	protocol    string
+	// the first error for the transfer, it can be set by other goroutines so it is protected by errLock
+	transferError error
+	errLock       sync.Mutex
+}
+
+// setTransferError records the error for the transfer, only the first error is kept
+func (t *Transfer) setTransferError(err error) {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+	if t.transferError == nil {
+		t.transferError = err
+	}
+}
+
+func (t *Transfer) getTransferError() error {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+	return t.transferError
 }
 
 // ReadAt reads len(p) bytes from the File to download starting at byte offset off and updates the bytes sent.
@@ -33,42 +68,195 @@ type Transfer struct {
 func (t *Transfer) ReadAt(p []byte, off int64) (n int, err error) {
 	t.lastActivity = time.Now()
 	readed, e := t.file.ReadAt(p, off)
+	if e != nil && e != io.EOF {
+		t.setTransferError(e)
+	}
 	t.bytesSent += int64(readed)
 	t.handleThrottle()
 	return readed, e
 }
 
 // WriteAt writes len(p) bytes to the uploaded file starting at byte offset off and updates the bytes received.
+// Offsets are absolute, for uploads in append mode writes before the initial file size are refused.
 // It handles upload bandwidth throttling too
 func (t *Transfer) WriteAt(p []byte, off int64) (n int, err error) {
 	t.lastActivity = time.Now()
+	if err := t.getTransferError(); err != nil {
+		// the upload already failed, for example because the quota was exceeded, nothing more will be written
+		return 0, err
+	}
+	if off < t.minWriteOffset {
+		err := fmt.Errorf("invalid write offset %v, the file was opened in append mode, its initial size is %v",
+			off, t.minWriteOffset)
+		logger.Warn(logSender, "denying write for path %#v: %v", t.path, err)
+		t.setTransferError(err)
+		return 0, err
+	}
+	if t.maxFileSize > 0 && off+int64(len(p)) > t.maxFileSize {
+		err := t.getMaxFileSizeError()
+		logger.Info(logSender, "denying write for path %#v, offset: %v, size: %v, max file size: %v: %v", t.path, off,
+			len(p), t.maxFileSize, err)
+		t.setTransferError(err)
+		return 0, err
+	}
 	written, e := t.file.WriteAt(p, off)
+	if e != nil {
+		t.setTransferError(e)
+	}
 	t.bytesReceived += int64(written)
+	if off+int64(written) > t.maxWriteOffset {
+		t.maxWriteOffset = off + int64(written)
+	}
 	t.handleThrottle()
 	return written, e
 }
 
 // Close it is called when the transfer is completed.
 // It closes the underlying file, log the transfer info, update the user quota, for uploads, and execute any defined actions.
+// Atomic uploads are moved to the target path if the transfer completed without errors, otherwise they are discarded.
+// Failed standard uploads are handled according to the configured partial upload policy
 func (t *Transfer) Close() error {
 	err := t.file.Close()
+	if err != nil {
+		t.setTransferError(err)
+	}
+	if len(t.tempPath) > 0 {
+		if atomicErr := t.closeAtomicUpload(); err == nil {
+			err = atomicErr
+		}
+	}
+	transferError := t.getTransferError()
+	status := actionStatusOK
+	if transferError != nil {
+		status = actionStatusError
+	}
 	elapsed := time.Since(t.start).Nanoseconds() / 1000000
 	if t.transferType == transferDownload {
-		logger.TransferLog(sftpdDownloadLogSender, t.path, elapsed, t.bytesSent, t.user.Username, t.connectionID)
-		executeAction(operationDownload, t.user.Username, t.path, "")
+		logger.TransferLog(t.getLogSender(), t.path, elapsed, t.bytesSent, t.user.Username, t.connectionID, transferError)
+		executeAction(operationDownload, t.user.Username, t.path, "", status)
 	} else {
-		logger.TransferLog(sftpUploadLogSender, t.path, elapsed, t.bytesReceived, t.user.Username, t.connectionID)
-		executeAction(operationUpload, t.user.Username, t.path, "")
+		numFiles, sizeDiff := t.getQuotaUpdate()
+		partialPath := ""
+		if transferError != nil && len(t.tempPath) == 0 {
+			partialPath, numFiles, sizeDiff = t.handlePartialUpload(numFiles, sizeDiff)
+		}
+		logger.TransferLog(t.getLogSender(), t.path, elapsed, t.bytesReceived, t.user.Username, t.connectionID, transferError)
+		executeAction(operationUpload, t.user.Username, t.path, partialPath, status)
+		if !t.user.IsFileExcludedFromQuota(t.requestPath) && (numFiles != 0 || sizeDiff != 0) {
+			dataprovider.UpdateUserQuota(dataProvider, t.user, numFiles, sizeDiff, false)
+		}
 	}
 	removeTransfer(t)
-	if t.transferType == transferUpload {
-		numFiles := 0
+	return err
+}
+
+// getQuotaUpdate returns the number of files and the size to add to the user quota for an upload
+func (t *Transfer) getQuotaUpdate() (int, int64) {
+	// a failed atomic upload leaves the target path untouched
+	if len(t.tempPath) > 0 && t.getTransferError() != nil {
+		return 0, 0
+	}
+	numFiles := 0
+	if t.isNewFile {
+		numFiles = 1
+	}
+	return numFiles, t.getUploadedSizeDiff() - t.replacedSize
+}
+
+// handlePartialUpload applies the configured partial upload policy to a failed upload.
+// The policy is applied only to the files created or truncated by the upload, resumed uploads keep the existing data.
+// It returns the path of the renamed partial file, if any, and the quota update adjusted for the applied policy
+func (t *Transfer) handlePartialUpload(numFiles int, sizeDiff int64) (string, int, int64) {
+	if t.isResume {
+		logger.Debug(logSender, "upload resume for %#v failed, the partial upload policy is not applied: %v", t.path,
+			t.getTransferError())
+		return "", numFiles, sizeDiff
+	}
+	switch getPartialUploadPolicy() {
+	case partialUploadDelete:
+		if err := t.fs.Remove(t.path); err != nil {
+			logger.Warn(logSender, "unable to remove partial upload %#v: %v", t.path, err)
+			return "", numFiles, sizeDiff
+		}
+		logger.Debug(logSender, "partial upload %#v removed: %v", t.path, t.getTransferError())
 		if t.isNewFile {
-			numFiles = 1
+			return "", 0, 0
+		}
+		// the existing file was truncated, its size was already removed from the quota
+		return "", -1, 0
+	case partialUploadRename:
+		partialPath := t.path + partialUploadSuffix
+		var replacedFiles int
+		var replacedSize int64
+		if info, err := t.fs.Stat(partialPath); err == nil {
+			if !info.Mode().IsRegular() {
+				logger.Warn(logSender, "unable to rename partial upload %#v, %#v is not a regular file", t.path, partialPath)
+				return "", numFiles, sizeDiff
+			}
+			// the previous partial file will be overwritten
+			replacedFiles = 1
+			replacedSize = info.Size()
+		} else if !t.fs.IsNotExist(err) {
+			logger.Warn(logSender, "unable to stat partial upload target %#v: %v", partialPath, err)
+			return "", numFiles, sizeDiff
 		}
-		dataprovider.UpdateUserQuota(dataProvider, t.user, numFiles, t.bytesReceived, false)
+		if err := t.fs.Rename(t.path, partialPath); err != nil {
+			logger.Warn(logSender, "unable to rename partial upload %#v to %#v: %v", t.path, partialPath, err)
+			return "", numFiles, sizeDiff
+		}
+		logger.Debug(logSender, "partial upload %#v renamed to %#v: %v", t.path, partialPath, t.getTransferError())
+		return partialPath, numFiles - replacedFiles, sizeDiff - replacedSize
 	}
-	return err
+	return "", numFiles, sizeDiff
+}
+
+// closeAtomicUpload renames the temporary file to the target path if the upload completed without errors,
+// otherwise the temporary file is removed
+func (t *Transfer) closeAtomicUpload() error {
+	if t.getTransferError() == nil {
+		err := t.fs.Rename(t.tempPath, t.path)
+		if err == nil {
+			logger.Debug(logSender, "atomic upload completed, file %v renamed to %v", t.tempPath, t.path)
+			return nil
+		}
+		logger.Warn(logSender, "unable to rename atomic upload temporary file %v to %v: %v", t.tempPath, t.path, err)
+		t.setTransferError(err)
+	}
+	if err := t.fs.Remove(t.tempPath); err != nil {
+		logger.Warn(logSender, "unable to remove atomic upload temporary file %v: %v", t.tempPath, err)
+	} else {
+		logger.Debug(logSender, "atomic upload failed, temporary file %v removed: %v", t.tempPath, t.getTransferError())
+	}
+	return t.getTransferError()
+}
+
+func (t *Transfer) getLogSender() string {
+	if t.protocol == protocolSCP {
+		if t.transferType == transferDownload {
+			return scpDownloadLogSender
+		}
+		return scpUploadLogSender
+	}
+	if t.transferType == transferDownload {
+		return sftpdDownloadLogSender
+	}
+	return sftpUploadLogSender
+}
+
+// getMaxFileSizeError returns the error for an upload that exceeds its maximum allowed size
+func (t *Transfer) getMaxFileSizeError() error {
+	if t.user.Filters.MaxUploadFileSize > 0 && t.maxFileSize == t.user.Filters.MaxUploadFileSize {
+		return errUploadFileSizeExceeded
+	}
+	return errQuotaExceeded
+}
+
+// getUploadedSizeDiff returns the number of bytes that grew the file, resumed uploads can overwrite existing data
+func (t *Transfer) getUploadedSizeDiff() int64 {
+	if t.maxWriteOffset > t.initialSize {
+		return t.maxWriteOffset - t.initialSize
+	}
+	return 0
 }
 
 func (t *Transfer) handleThrottle() {
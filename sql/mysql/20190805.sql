@@ -0,0 +1,7 @@
+BEGIN;
+--
+-- Rename field public_key on user to public_keys, the public keys are now stored as a JSON list
+--
+ALTER TABLE `users` CHANGE `public_key` `public_keys` longtext NULL;
+UPDATE `users` SET `public_keys` = JSON_ARRAY(`public_keys`) WHERE `public_keys` IS NOT NULL AND `public_keys` <> '';
+COMMIT;
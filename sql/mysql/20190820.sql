@@ -0,0 +1,6 @@
+BEGIN;
+--
+-- Add field totp_config to user, the TOTP configuration is stored as a JSON object
+--
+ALTER TABLE `users` ADD COLUMN `totp_config` longtext NULL;
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+--
+-- Add field virtual_folders to user, the virtual folders are stored as a JSON array
+--
+ALTER TABLE `users` ADD COLUMN `virtual_folders` longtext NULL;
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+--
+-- Add field filesystem to user, the storage backend configuration is stored as a JSON object
+--
+ALTER TABLE `users` ADD COLUMN `filesystem` longtext NULL;
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+--
+-- Add field filters to user, the filters are stored as a JSON object
+--
+ALTER TABLE "users" ADD COLUMN "filters" text NULL;
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+--
+-- Rename field public_key on user to public_keys, the public keys are now stored as a JSON list
+--
+ALTER TABLE "users" RENAME COLUMN "public_key" TO "public_keys";
+UPDATE "users" SET "public_keys" = json_array("public_keys") WHERE "public_keys" IS NOT NULL AND "public_keys" <> '';
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+--
+-- Add field dir_permissions to user, the permissions for specific directories are stored as a JSON object
+--
+ALTER TABLE "users" ADD COLUMN "dir_permissions" text NULL;
+COMMIT;
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import "syscall"
+
+// GetDiskSpace returns the total and the available space, in bytes, for the filesystem containing the given path
+func GetDiskSpace(path string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return uint64(stat.Blocks) * uint64(stat.Bsize), uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
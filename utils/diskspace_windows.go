@@ -0,0 +1,8 @@
+package utils
+
+import "errors"
+
+// GetDiskSpace is not implemented on windows
+func GetDiskSpace(path string) (uint64, uint64, error) {
+	return 0, 0, errors.New("disk space info not available on windows")
+}
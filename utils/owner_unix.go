@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// GetFileOwner returns the uid and gid of the owner of the given file, ok is false if they are not available
+func GetFileOwner(fi os.FileInfo) (uid int, gid int, ok bool) {
+	if stat, isStat := fi.Sys().(*syscall.Stat_t); isStat {
+		return int(stat.Uid), int(stat.Gid), true
+	}
+	return -1, -1, false
+}
@@ -0,0 +1,8 @@
+package utils
+
+import "os"
+
+// GetFileOwner returns false on windows, files have no numeric uid and gid
+func GetFileOwner(fi os.FileInfo) (uid int, gid int, ok bool) {
+	return -1, -1, false
+}
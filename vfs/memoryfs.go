@@ -0,0 +1,638 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxSymlinkHops = 255
+
+var (
+	memoryFsLock      sync.Mutex
+	memoryFilesystems = make(map[string]*MemoryFs)
+	errIsDir          = errors.New("is a directory")
+	errNotDir         = errors.New("not a directory")
+	errDirNotEmpty    = errors.New("directory not empty")
+	errTooManyLinks   = errors.New("too many levels of symbolic links")
+	errNotSymlink     = errors.New("invalid argument, not a symbolic link")
+	errBadDescriptor  = errors.New("bad file descriptor")
+)
+
+type memoryNode struct {
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+	target  string
+	uid     int
+	gid     int
+}
+
+// MemoryFs is a Fs implementation that stores files and directories in memory.
+// It is useful for testing, the contents are lost when the process exits
+type MemoryFs struct {
+	sync.Mutex
+	nodes map[string]*memoryNode
+}
+
+// NewMemoryFs returns a new empty in memory filesystem
+func NewMemoryFs() Fs {
+	return &MemoryFs{
+		nodes: make(map[string]*memoryNode),
+	}
+}
+
+// GetMemoryFs returns the in memory filesystem with the given name, it is created if it does not exist.
+// The same filesystem is returned for the same name so its contents are shared, for example, between the
+// connections of the same user
+func GetMemoryFs(name string) Fs {
+	memoryFsLock.Lock()
+	defer memoryFsLock.Unlock()
+	if fs, ok := memoryFilesystems[name]; ok {
+		return fs
+	}
+	fs := NewMemoryFs().(*MemoryFs)
+	memoryFilesystems[name] = fs
+	return fs
+}
+
+// Name returns the name for the Fs implementation
+func (*MemoryFs) Name() string {
+	return "memoryfs"
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *MemoryFs) Stat(name string) (os.FileInfo, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.evalSymlinks(name, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fs.getFileInfo(p), nil
+}
+
+// Lstat returns a FileInfo describing the named file, symlinks are not followed
+func (fs *MemoryFs) Lstat(name string) (os.FileInfo, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.lookup(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return fs.getFileInfo(p), nil
+}
+
+// Open opens the named file for reading
+func (fs *MemoryFs) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file with the specified flags and permissions
+func (fs *MemoryFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.evalSymlinks(name, 0)
+	if err == nil {
+		node := fs.nodes[p]
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if isDirNode(node) && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+		}
+		if flag&os.O_TRUNC != 0 {
+			node.data = nil
+			node.modTime = time.Now()
+		}
+		return &memoryFile{fs: fs, name: name, path: p, flag: flag}, nil
+	}
+	if flag&os.O_CREATE == 0 || !os.IsNotExist(err) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	p, err = fs.getChildPath(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	fs.nodes[p] = &memoryNode{
+		mode:    perm.Perm(),
+		modTime: time.Now(),
+		uid:     -1,
+		gid:     -1,
+	}
+	return &memoryFile{fs: fs, name: name, path: p, flag: flag}, nil
+}
+
+// Rename renames (moves) source to target, directories are moved with their contents
+func (fs *MemoryFs) Rename(source, target string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	sourcePath, err := fs.lookup(source)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: err}
+	}
+	targetPath, err := fs.getChildPath(target)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: err}
+	}
+	if sourcePath == targetPath {
+		return nil
+	}
+	if isSubPath(targetPath, sourcePath) {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: os.ErrInvalid}
+	}
+	sourceNode := fs.nodes[sourcePath]
+	if targetNode, ok := fs.nodes[targetPath]; ok {
+		if isDirNode(targetNode) != isDirNode(sourceNode) {
+			if isDirNode(targetNode) {
+				return &os.LinkError{Op: "rename", Old: source, New: target, Err: errIsDir}
+			}
+			return &os.LinkError{Op: "rename", Old: source, New: target, Err: errNotDir}
+		}
+		if fs.hasChildren(targetPath) {
+			return &os.LinkError{Op: "rename", Old: source, New: target, Err: errDirNotEmpty}
+		}
+	}
+	var children []string
+	for p := range fs.nodes {
+		if isSubPath(p, sourcePath) {
+			children = append(children, p)
+		}
+	}
+	for _, p := range children {
+		fs.nodes[targetPath+strings.TrimPrefix(p, sourcePath)] = fs.nodes[p]
+		delete(fs.nodes, p)
+	}
+	delete(fs.nodes, sourcePath)
+	fs.nodes[targetPath] = sourceNode
+	return nil
+}
+
+// Remove removes the named file or (empty) directory
+func (fs *MemoryFs) Remove(name string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.lookup(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if fs.hasChildren(p) {
+		return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+	}
+	delete(fs.nodes, p)
+	return nil
+}
+
+// RemoveAll removes the named path and any children it contains
+func (fs *MemoryFs) RemoveAll(name string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.lookup(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return &os.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	for nodePath := range fs.nodes {
+		if isSubPath(nodePath, p) {
+			delete(fs.nodes, nodePath)
+		}
+	}
+	delete(fs.nodes, p)
+	return nil
+}
+
+// Mkdir creates a new directory with the specified name and permissions
+func (fs *MemoryFs) Mkdir(name string, perm os.FileMode) error {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.mkdir(name, perm)
+}
+
+// MkdirAll creates a directory named path, along with any necessary parents
+func (fs *MemoryFs) MkdirAll(name string, perm os.FileMode) error {
+	fs.Lock()
+	defer fs.Unlock()
+	var dirs []string
+	p := filepath.Clean(name)
+	for {
+		resolved, err := fs.evalSymlinks(p, 0)
+		if err == nil {
+			if !isDirNode(fs.nodes[resolved]) {
+				return &os.PathError{Op: "mkdir", Path: p, Err: errNotDir}
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return &os.PathError{Op: "mkdir", Path: p, Err: err}
+		}
+		dirs = append(dirs, p)
+		p = filepath.Dir(p)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := fs.mkdir(dirs[i], perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Symlink creates target as a symbolic link to source
+func (fs *MemoryFs) Symlink(source, target string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.getChildPath(target)
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: source, New: target, Err: err}
+	}
+	if _, ok := fs.nodes[p]; ok {
+		return &os.LinkError{Op: "symlink", Old: source, New: target, Err: os.ErrExist}
+	}
+	fs.nodes[p] = &memoryNode{
+		mode:    os.ModeSymlink | 0777,
+		modTime: time.Now(),
+		target:  source,
+		uid:     -1,
+		gid:     -1,
+	}
+	return nil
+}
+
+// Readlink returns the destination of the named symbolic link
+func (fs *MemoryFs) Readlink(name string) (string, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.lookup(name)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	node, ok := fs.nodes[p]
+	if !ok || node.mode&os.ModeSymlink == 0 {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: errNotSymlink}
+	}
+	return node.target, nil
+}
+
+// Chown changes the numeric uid and gid of the named file, -1 means do not change
+func (fs *MemoryFs) Chown(name string, uid int, gid int) error {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.evalSymlinks(name, 0)
+	if err != nil {
+		return &os.PathError{Op: "chown", Path: name, Err: err}
+	}
+	if node, ok := fs.nodes[p]; ok {
+		if uid != -1 {
+			node.uid = uid
+		}
+		if gid != -1 {
+			node.gid = gid
+		}
+	}
+	return nil
+}
+
+// Chmod changes the permission bits of the named file
+func (fs *MemoryFs) Chmod(name string, mode os.FileMode) error {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.evalSymlinks(name, 0)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	if node, ok := fs.nodes[p]; ok {
+		node.mode = node.mode&^os.ModePerm | mode.Perm()
+	}
+	return nil
+}
+
+// Chtimes changes the modification time of the named file, the access time is not stored
+func (fs *MemoryFs) Chtimes(name string, atime, mtime time.Time) error {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.evalSymlinks(name, 0)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	if node, ok := fs.nodes[p]; ok {
+		node.modTime = mtime
+	}
+	return nil
+}
+
+// ReadDir reads the directory named by dirname and returns a list of directory entries sorted by filename
+func (fs *MemoryFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.evalSymlinks(dirname, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dirname, Err: err}
+	}
+	if !isDirNode(fs.nodes[p]) {
+		return nil, &os.PathError{Op: "readdirent", Path: dirname, Err: errNotDir}
+	}
+	var files []os.FileInfo
+	for nodePath := range fs.nodes {
+		if filepath.Dir(nodePath) == p && nodePath != p {
+			files = append(files, fs.getFileInfo(nodePath))
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+// OpenDir opens the named directory for incremental reading. The contents are kept in memory anyway so
+// they are read when the directory is opened
+func (fs *MemoryFs) OpenDir(dirname string) (DirLister, error) {
+	files, err := fs.ReadDir(dirname)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryDirLister{files: files}, nil
+}
+
+// EvalSymlinks returns the path name after the evaluation of any symbolic links
+func (fs *MemoryFs) EvalSymlinks(name string) (string, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	p, err := fs.evalSymlinks(name, 0)
+	if err != nil {
+		return "", &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return p, nil
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to report that a file or directory does not exist
+func (*MemoryFs) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// IsAtomicUploadSupported returns true if atomic uploads are supported
+func (*MemoryFs) IsAtomicUploadSupported() bool {
+	return true
+}
+
+// evalSymlinks resolves the given path, the root directory always exists. It must be called with the lock held
+func (fs *MemoryFs) evalSymlinks(name string, hops int) (string, error) {
+	p := filepath.Clean(name)
+	if isRootPath(p) {
+		return p, nil
+	}
+	if hops > maxSymlinkHops {
+		return "", errTooManyLinks
+	}
+	parent, err := fs.evalSymlinks(filepath.Dir(p), hops)
+	if err != nil {
+		return "", err
+	}
+	if !isDirNode(fs.nodes[parent]) {
+		return "", errNotDir
+	}
+	p = filepath.Join(parent, filepath.Base(p))
+	node, ok := fs.nodes[p]
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	if node.mode&os.ModeSymlink != 0 {
+		target := node.target
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(parent, target)
+		}
+		return fs.evalSymlinks(target, hops+1)
+	}
+	return p, nil
+}
+
+// lookup resolves the parent directories of the given path, the last element is not followed if it is
+// a symlink. It must be called with the lock held
+func (fs *MemoryFs) lookup(name string) (string, error) {
+	p := filepath.Clean(name)
+	if isRootPath(p) {
+		return p, nil
+	}
+	p, err := fs.getChildPath(p)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := fs.nodes[p]; !ok {
+		return "", os.ErrNotExist
+	}
+	return p, nil
+}
+
+// getChildPath returns the path for a new entry inside an existing directory. It must be called with the lock held
+func (fs *MemoryFs) getChildPath(name string) (string, error) {
+	p := filepath.Clean(name)
+	if isRootPath(p) {
+		return "", os.ErrExist
+	}
+	parent, err := fs.evalSymlinks(filepath.Dir(p), 0)
+	if err != nil {
+		return "", err
+	}
+	if !isDirNode(fs.nodes[parent]) {
+		return "", errNotDir
+	}
+	return filepath.Join(parent, filepath.Base(p)), nil
+}
+
+func (fs *MemoryFs) mkdir(name string, perm os.FileMode) error {
+	p, err := fs.getChildPath(name)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	if _, ok := fs.nodes[p]; ok {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	fs.nodes[p] = &memoryNode{
+		mode:    os.ModeDir | perm.Perm(),
+		modTime: time.Now(),
+		uid:     -1,
+		gid:     -1,
+	}
+	return nil
+}
+
+func (fs *MemoryFs) hasChildren(dirPath string) bool {
+	for p := range fs.nodes {
+		if isSubPath(p, dirPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *MemoryFs) getFileInfo(p string) os.FileInfo {
+	node, ok := fs.nodes[p]
+	if !ok {
+		// the root directory
+		return &fileInfo{name: filepath.Base(p), mode: os.ModeDir | 0755, modTime: time.Now()}
+	}
+	return &fileInfo{
+		name:    filepath.Base(p),
+		size:    int64(len(node.data)),
+		mode:    node.mode,
+		modTime: node.modTime,
+	}
+}
+
+func isDirNode(node *memoryNode) bool {
+	// a nil node is the root directory
+	return node == nil || node.mode.IsDir()
+}
+
+func isRootPath(p string) bool {
+	return filepath.Dir(p) == p
+}
+
+// isSubPath returns true if p is inside dirPath, p and dirPath must be cleaned paths
+func isSubPath(p, dirPath string) bool {
+	if isRootPath(dirPath) {
+		return p != dirPath
+	}
+	return strings.HasPrefix(p, dirPath+string(filepath.Separator))
+}
+
+type memoryFile struct {
+	fs     *MemoryFs
+	name   string
+	path   string
+	flag   int
+	offset int64
+	closed bool
+}
+
+// Name returns the name of the file as presented to Open
+func (f *memoryFile) Name() string {
+	return f.name
+}
+
+// Read reads up to len(b) bytes from the current offset
+func (f *memoryFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(b) bytes starting at byte offset off
+func (f *memoryFile) ReadAt(b []byte, off int64) (int, error) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	node, err := f.getNode()
+	if err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_WRONLY != 0 || isDirNode(node) {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errBadDescriptor}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: os.ErrInvalid}
+	}
+	if off >= int64(len(node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, node.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Write writes len(b) bytes at the current offset
+func (f *memoryFile) Write(b []byte) (int, error) {
+	n, err := f.WriteAt(b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes len(b) bytes starting at byte offset off, the file is extended if needed
+func (f *memoryFile) WriteAt(b []byte, off int64) (int, error) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	node, err := f.getNode()
+	if err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: errBadDescriptor}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: os.ErrInvalid}
+	}
+	end := off + int64(len(b))
+	if end > int64(len(node.data)) {
+		data := make([]byte, end)
+		copy(data, node.data)
+		node.data = data
+	}
+	copy(node.data[off:], b)
+	node.modTime = time.Now()
+	return len(b), nil
+}
+
+// Stat returns the FileInfo structure describing the file
+func (f *memoryFile) Stat() (os.FileInfo, error) {
+	f.fs.Lock()
+	defer f.fs.Unlock()
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	if _, ok := f.fs.nodes[f.path]; !ok && !isRootPath(f.path) {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrNotExist}
+	}
+	return f.fs.getFileInfo(f.path), nil
+}
+
+// Close closes the file, it cannot be used for I/O anymore
+func (f *memoryFile) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memoryFile) getNode() (*memoryNode, error) {
+	if f.closed {
+		return nil, &os.PathError{Op: "read", Path: f.name, Err: os.ErrClosed}
+	}
+	node, ok := f.fs.nodes[f.path]
+	if !ok {
+		// the file was removed, the data are lost
+		return &memoryNode{}, nil
+	}
+	return node, nil
+}
+
+// memoryDirLister returns the directory entries read when the directory was opened
+type memoryDirLister struct {
+	files []os.FileInfo
+}
+
+func (l *memoryDirLister) Readdir(n int) ([]os.FileInfo, error) {
+	if n <= 0 {
+		files := l.files
+		l.files = nil
+		return files, nil
+	}
+	if len(l.files) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(l.files) {
+		n = len(l.files)
+	}
+	files := l.files[:n]
+	l.files = l.files[n:]
+	return files, nil
+}
+
+func (l *memoryDirLister) Close() error {
+	l.files = nil
+	return nil
+}
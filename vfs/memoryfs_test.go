@@ -0,0 +1,262 @@
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testRoot = filepath.Join(os.TempDir(), "memoryfs_test")
+
+func TestMemoryFsReadWrite(t *testing.T) {
+	fs := NewMemoryFs()
+	dirPath := filepath.Join(testRoot, "dir", "sub")
+	err := fs.MkdirAll(dirPath, 0777)
+	if err != nil {
+		t.Errorf("unable to create dirs: %v", err)
+	}
+	filePath := filepath.Join(dirPath, "file")
+	f, err := fs.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	_, err = f.WriteAt([]byte("world"), 6)
+	if err != nil {
+		t.Errorf("unable to write file: %v", err)
+	}
+	_, err = f.WriteAt([]byte("hello "), 0)
+	if err != nil {
+		t.Errorf("unable to write file: %v", err)
+	}
+	_, err = f.ReadAt(make([]byte, 1), 0)
+	if err == nil {
+		t.Errorf("reading a file opened for writing must fail")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Errorf("unable to close file: %v", err)
+	}
+	_, err = f.WriteAt([]byte("data"), 0)
+	if err == nil {
+		t.Errorf("writing a closed file must fail")
+	}
+	fi, err := fs.Stat(filePath)
+	if err != nil || fi.Size() != 11 || fi.IsDir() || fi.Name() != "file" {
+		t.Errorf("unexpected file info: %+v, err: %v", fi, err)
+	}
+	f, err = fs.Open(filePath)
+	if err != nil {
+		t.Fatalf("unable to open file: %v", err)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil || string(content) != "hello world" {
+		t.Errorf("unexpected file content: %#v, err: %v", string(content), err)
+	}
+	buf := make([]byte, 10)
+	n, err := f.ReadAt(buf, 6)
+	if err != io.EOF || string(buf[:n]) != "world" {
+		t.Errorf("unexpected read at result: %#v, err: %v", string(buf[:n]), err)
+	}
+	f.Close()
+	_, err = fs.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if !os.IsExist(err) {
+		t.Errorf("exclusive create of an existing file must fail: %v", err)
+	}
+	_, err = fs.OpenFile(dirPath, os.O_WRONLY, 0666)
+	if err == nil {
+		t.Errorf("opening a directory for writing must fail")
+	}
+	_, err = fs.Open(filepath.Join(testRoot, "missing", "file"))
+	if !fs.IsNotExist(err) {
+		t.Errorf("opening a missing file must fail with not exist: %v", err)
+	}
+	_, err = fs.OpenFile(filepath.Join(testRoot, "missing", "file"), os.O_WRONLY|os.O_CREATE, 0666)
+	if !fs.IsNotExist(err) {
+		t.Errorf("creating a file inside a missing dir must fail with not exist: %v", err)
+	}
+	f, err = fs.OpenFile(filePath, os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Errorf("unable to truncate file: %v", err)
+	} else {
+		f.Close()
+	}
+	fi, err = fs.Stat(filePath)
+	if err != nil || fi.Size() != 0 {
+		t.Errorf("the file must be truncated: %+v, err: %v", fi, err)
+	}
+}
+
+func TestMemoryFsDirs(t *testing.T) {
+	fs := NewMemoryFs()
+	dirPath := filepath.Join(testRoot, "dir")
+	err := fs.Mkdir(dirPath, 0777)
+	if err == nil {
+		t.Errorf("mkdir must fail if the parent dir does not exist")
+	}
+	err = fs.MkdirAll(dirPath, 0777)
+	if err != nil {
+		t.Errorf("unable to create dirs: %v", err)
+	}
+	err = fs.Mkdir(dirPath, 0777)
+	if !os.IsExist(err) {
+		t.Errorf("mkdir must fail if the dir already exists: %v", err)
+	}
+	for _, name := range []string{"b", "a", "c"} {
+		f, err := fs.OpenFile(filepath.Join(dirPath, name), os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			t.Errorf("unable to create file: %v", err)
+			continue
+		}
+		f.WriteAt([]byte(name), 0)
+		f.Close()
+	}
+	err = fs.Mkdir(filepath.Join(dirPath, "subdir"), 0777)
+	if err != nil {
+		t.Errorf("unable to create dir: %v", err)
+	}
+	files, err := fs.ReadDir(dirPath)
+	if err != nil || len(files) != 4 {
+		t.Errorf("unexpected dir contents: %v, err: %v", files, err)
+	} else if files[0].Name() != "a" || files[3].Name() != "subdir" || !files[3].IsDir() {
+		t.Errorf("dir contents must be sorted by name: %v", files)
+	}
+	lister, err := fs.OpenDir(dirPath)
+	if err != nil {
+		t.Errorf("unable to open dir: %v", err)
+	} else {
+		entries, err := lister.Readdir(3)
+		if err != nil || len(entries) != 3 || entries[0].Name() != "a" {
+			t.Errorf("unexpected incremental dir contents: %v, err: %v", entries, err)
+		}
+		entries, err = lister.Readdir(3)
+		if err != nil || len(entries) != 1 {
+			t.Errorf("unexpected incremental dir contents: %v, err: %v", entries, err)
+		}
+		_, err = lister.Readdir(3)
+		if err != io.EOF {
+			t.Errorf("io.EOF expected at the end of the directory: %v", err)
+		}
+		lister.Close()
+	}
+	err = fs.Chmod(filepath.Join(dirPath, "a"), os.ModeDir|0600)
+	if err != nil {
+		t.Errorf("unable to chmod file: %v", err)
+	}
+	if fi, err := fs.Stat(filepath.Join(dirPath, "a")); err != nil || fi.Mode() != 0600 {
+		t.Errorf("only the permission bits must be changed: %+v, err: %v", fi, err)
+	}
+	numFiles, size, fileList, err := ScanDirContents(fs, testRoot)
+	if err != nil || numFiles != 3 || size != 3 || len(fileList) != 3 {
+		t.Errorf("unexpected scan results, files: %v size: %v err: %v", numFiles, size, err)
+	}
+	err = fs.Remove(dirPath)
+	if err == nil {
+		t.Errorf("removing a non empty dir must fail")
+	}
+	renamedPath := filepath.Join(testRoot, "renamed")
+	err = fs.Rename(dirPath, renamedPath)
+	if err != nil {
+		t.Errorf("unable to rename dir: %v", err)
+	}
+	err = fs.Rename(renamedPath, filepath.Join(renamedPath, "subdir", "dir"))
+	if err == nil {
+		t.Errorf("renaming a dir inside itself must fail")
+	}
+	if _, err = fs.Stat(filepath.Join(renamedPath, "a")); err != nil {
+		t.Errorf("dir contents must be renamed: %v", err)
+	}
+	if _, err = fs.Stat(filepath.Join(dirPath, "a")); !fs.IsNotExist(err) {
+		t.Errorf("the source dir contents must not exist after rename: %v", err)
+	}
+	err = fs.RemoveAll(renamedPath)
+	if err != nil {
+		t.Errorf("unable to remove dir: %v", err)
+	}
+	files, err = fs.ReadDir(testRoot)
+	if err != nil || len(files) != 0 {
+		t.Errorf("unexpected dir contents after remove: %v, err: %v", files, err)
+	}
+	err = fs.RemoveAll(renamedPath)
+	if err != nil {
+		t.Errorf("removing a missing path must succeed: %v", err)
+	}
+}
+
+func TestMemoryFsSymlinks(t *testing.T) {
+	fs := NewMemoryFs()
+	dirPath := filepath.Join(testRoot, "dir")
+	err := fs.MkdirAll(dirPath, 0777)
+	if err != nil {
+		t.Errorf("unable to create dirs: %v", err)
+	}
+	linkPath := filepath.Join(testRoot, "link")
+	err = fs.Symlink(dirPath, linkPath)
+	if err != nil {
+		t.Errorf("unable to create symlink: %v", err)
+	}
+	err = fs.Symlink(dirPath, linkPath)
+	if err == nil {
+		t.Errorf("creating an existing symlink must fail")
+	}
+	p, err := fs.EvalSymlinks(linkPath)
+	if err != nil || p != dirPath {
+		t.Errorf("unexpected symlink resolution: %v, err: %v", p, err)
+	}
+	fi, err := fs.Lstat(linkPath)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("lstat must not follow symlinks: %+v, err: %v", fi, err)
+	}
+	fi, err = fs.Stat(linkPath)
+	if err != nil || !fi.IsDir() {
+		t.Errorf("stat must follow symlinks: %+v, err: %v", fi, err)
+	}
+	target, err := fs.Readlink(linkPath)
+	if err != nil || target != dirPath {
+		t.Errorf("unexpected symlink target: %v, err: %v", target, err)
+	}
+	_, err = fs.Readlink(dirPath)
+	if err == nil {
+		t.Errorf("readlink must fail for a directory")
+	}
+	f, err := fs.OpenFile(filepath.Join(linkPath, "file"), os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		t.Errorf("unable to create a file using a symlinked dir: %v", err)
+	} else {
+		f.Close()
+	}
+	if _, err = fs.Stat(filepath.Join(dirPath, "file")); err != nil {
+		t.Errorf("the file must be created inside the symlink target: %v", err)
+	}
+	loopPath := filepath.Join(testRoot, "loop")
+	err = fs.Symlink(loopPath, loopPath)
+	if err != nil {
+		t.Errorf("unable to create symlink: %v", err)
+	}
+	_, err = fs.EvalSymlinks(loopPath)
+	if err == nil {
+		t.Errorf("resolving a symlink loop must fail")
+	}
+	err = fs.Remove(linkPath)
+	if err != nil {
+		t.Errorf("unable to remove symlink: %v", err)
+	}
+	if _, err = fs.Stat(dirPath); err != nil {
+		t.Errorf("removing a symlink must not remove its target: %v", err)
+	}
+}
+
+func TestGetMemoryFs(t *testing.T) {
+	fs := GetMemoryFs("user1")
+	err := fs.MkdirAll(testRoot, 0777)
+	if err != nil {
+		t.Errorf("unable to create dirs: %v", err)
+	}
+	if _, err = GetMemoryFs("user1").Stat(testRoot); err != nil {
+		t.Errorf("the same filesystem must be returned for the same name: %v", err)
+	}
+	if _, err = GetMemoryFs("user2").Stat(testRoot); err == nil {
+		t.Errorf("a different filesystem must be returned for a different name")
+	}
+}
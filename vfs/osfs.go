@@ -0,0 +1,128 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// OsFs is a Fs implementation that uses functions provided by the os package
+type OsFs struct{}
+
+// NewOsFs returns an OsFs object that allows to interact with the local filesystem
+func NewOsFs() Fs {
+	return &OsFs{}
+}
+
+// Name returns the name for the Fs implementation
+func (OsFs) Name() string {
+	return "osfs"
+}
+
+// Stat returns a FileInfo describing the named file
+func (OsFs) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Lstat returns a FileInfo describing the named file, symlinks are not followed
+func (OsFs) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// Open opens the named file for reading
+func (OsFs) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenFile opens the named file with the specified flags and permissions
+func (OsFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Rename renames (moves) source to target
+func (OsFs) Rename(source, target string) error {
+	return os.Rename(source, target)
+}
+
+// Remove removes the named file or (empty) directory
+func (OsFs) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// RemoveAll removes the named path and any children it contains
+func (OsFs) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+// Mkdir creates a new directory with the specified name and permissions
+func (OsFs) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+// MkdirAll creates a directory named path, along with any necessary parents
+func (OsFs) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+
+// Symlink creates target as a symbolic link to source
+func (OsFs) Symlink(source, target string) error {
+	return os.Symlink(source, target)
+}
+
+// Readlink returns the destination of the named symbolic link
+func (OsFs) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+// Chown changes the numeric uid and gid of the named file, it does nothing on windows
+func (OsFs) Chown(name string, uid int, gid int) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	return os.Chown(name, uid, gid)
+}
+
+// Chmod changes the mode of the named file to mode
+func (OsFs) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file
+func (OsFs) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// ReadDir reads the directory named by dirname and returns a list of directory entries sorted by filename
+func (OsFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+// OpenDir opens the named directory for incremental reading, the entries are returned in directory order
+func (OsFs) OpenDir(dirname string) (DirLister, error) {
+	return os.Open(dirname)
+}
+
+// EvalSymlinks returns the path name after the evaluation of any symbolic links
+func (OsFs) EvalSymlinks(name string) (string, error) {
+	return filepath.EvalSymlinks(name)
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to report that a file or directory does not exist
+func (OsFs) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// IsAtomicUploadSupported returns true if atomic uploads are supported, renaming a file is cheap on the local filesystem
+func (OsFs) IsAtomicUploadSupported() bool {
+	return true
+}
@@ -0,0 +1,746 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+// maxS3PendingWrites is the maximum number of out of order writes buffered for an upload
+const maxS3PendingWrites = 64
+
+var (
+	errS3Unsupported        = errors.New("operation not supported by S3")
+	errS3NonSequentialWrite = errors.New("non sequential writes are not supported by S3")
+	errS3Overwrite          = errors.New("existing objects cannot be modified on S3, they can only be replaced")
+)
+
+// S3FsConfig defines the configuration for an S3 compatible object storage
+type S3FsConfig struct {
+	Bucket string `json:"bucket,omitempty"`
+	// KeyPrefix is similar to a chroot directory for the local filesystem.
+	// If specified the user will only see the objects starting with this prefix.
+	// It must not start with "/" and must end with "/"
+	KeyPrefix    string `json:"key_prefix,omitempty"`
+	Region       string `json:"region,omitempty"`
+	AccessKey    string `json:"access_key,omitempty"`
+	AccessSecret string `json:"access_secret,omitempty"`
+	// Endpoint is required for S3 compatible servers, it must be empty for AWS S3
+	Endpoint     string `json:"endpoint,omitempty"`
+	StorageClass string `json:"storage_class,omitempty"`
+	// UploadPartSize is the part size, in MB, for multipart uploads. 0 means the default (5 MB)
+	UploadPartSize int64 `json:"upload_part_size,omitempty"`
+}
+
+// S3Fs is a Fs implementation for Amazon S3 compatible object storages.
+// Directories are emulated using key prefixes and the "/" delimiter
+type S3Fs struct {
+	rootDir string
+	config  S3FsConfig
+	svc     *s3.S3
+}
+
+// NewS3Fs returns an S3Fs object that allows to interact with an S3 compatible object storage.
+// The paths inside rootDir are mapped to object keys with the configured key prefix
+func NewS3Fs(rootDir string, config S3FsConfig) (Fs, error) {
+	awsConfig := aws.NewConfig().WithRegion(config.Region)
+	if config.AccessKey != "" {
+		awsConfig.WithCredentials(credentials.NewStaticCredentials(config.AccessKey, config.AccessSecret, ""))
+	}
+	if config.Endpoint != "" {
+		awsConfig.WithEndpoint(config.Endpoint).WithS3ForcePathStyle(true)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Fs{
+		rootDir: filepath.Clean(rootDir),
+		config:  config,
+		svc:     s3.New(sess),
+	}, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs *S3Fs) Name() string {
+	return fmt.Sprintf("s3fs bucket: %#v", fs.config.Bucket)
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs *S3Fs) Stat(name string) (os.FileInfo, error) {
+	key, err := fs.getKey(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if fs.isRootKey(key) {
+		return &fileInfo{name: filepath.Base(name), mode: os.ModeDir | 0755, modTime: time.Now()}, nil
+	}
+	obj, err := fs.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(fs.config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return &fileInfo{
+			name:    filepath.Base(name),
+			size:    aws.Int64Value(obj.ContentLength),
+			mode:    0644,
+			modTime: aws.TimeValue(obj.LastModified),
+		}, nil
+	}
+	if !fs.IsNotExist(err) {
+		return nil, err
+	}
+	// a directory exists if there is at least an object with its prefix, the directory marker included
+	out, err := fs.svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(fs.config.Bucket),
+		Prefix:  aws.String(key + "/"),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Contents) == 0 && len(out.CommonPrefixes) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return &fileInfo{name: filepath.Base(name), mode: os.ModeDir | 0755, modTime: time.Now()}, nil
+}
+
+// Lstat returns a FileInfo describing the named file, symlinks are not supported so it is the same as Stat
+func (fs *S3Fs) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+// Open opens the named file for reading, the contents are downloaded using ranged requests
+func (fs *S3Fs) Open(name string) (File, error) {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	key, _ := fs.getKey(name)
+	return &s3File{
+		fs:   fs,
+		name: name,
+		key:  key,
+		size: fi.Size(),
+	}, nil
+}
+
+// OpenFile opens the named file with the specified flags.
+// Files opened for writing are uploaded while they are written, using a multipart upload if needed.
+// Existing objects can only be replaced so the O_TRUNC flag is required to write to them
+func (fs *S3Fs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fs.Open(name)
+	}
+	key, err := fs.getKey(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	fi, err := fs.Stat(name)
+	if err == nil {
+		if fi.IsDir() {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+		}
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+		}
+		if flag&os.O_TRUNC == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errS3Overwrite}
+		}
+	} else if !fs.IsNotExist(err) || flag&os.O_CREATE == 0 {
+		return nil, err
+	}
+	return fs.newUpload(name, key), nil
+}
+
+// Rename renames (moves) source to target.
+// Objects cannot be renamed on S3 so they are copied to the new key and then removed
+func (fs *S3Fs) Rename(source, target string) error {
+	fi, err := fs.Stat(source)
+	if err != nil {
+		return err
+	}
+	sourceKey, _ := fs.getKey(source)
+	targetKey, err := fs.getKey(target)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: err}
+	}
+	if !fi.IsDir() {
+		if err = fs.copyObject(sourceKey, targetKey); err != nil {
+			return err
+		}
+		return fs.deleteObject(sourceKey)
+	}
+	if fs.isRootKey(sourceKey) || strings.HasPrefix(targetKey, sourceKey+"/") {
+		return &os.LinkError{Op: "rename", Old: source, New: target, Err: os.ErrInvalid}
+	}
+	keys, err := fs.listKeys(sourceKey + "/")
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = fs.copyObject(k, targetKey+strings.TrimPrefix(k, sourceKey)); err != nil {
+			return err
+		}
+	}
+	for _, k := range keys {
+		if err = fs.deleteObject(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes the named file or (empty) directory
+func (fs *S3Fs) Remove(name string) error {
+	fi, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	key, _ := fs.getKey(name)
+	if !fi.IsDir() {
+		return fs.deleteObject(key)
+	}
+	dirPrefix := fs.getDirPrefix(key)
+	out, err := fs.svc.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(fs.config.Bucket),
+		Prefix:  aws.String(dirPrefix),
+		MaxKeys: aws.Int64(2),
+	})
+	if err != nil {
+		return err
+	}
+	for _, obj := range out.Contents {
+		if aws.StringValue(obj.Key) != dirPrefix {
+			return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+		}
+	}
+	if fs.isRootKey(key) {
+		return nil
+	}
+	return fs.deleteObject(dirPrefix)
+}
+
+// RemoveAll removes the named path and any children it contains
+func (fs *S3Fs) RemoveAll(name string) error {
+	key, err := fs.getKey(name)
+	if err != nil {
+		return &os.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	keys, err := fs.listKeys(fs.getDirPrefix(key))
+	if err != nil {
+		return err
+	}
+	if !fs.isRootKey(key) {
+		keys = append(keys, key)
+	}
+	for _, k := range keys {
+		if err = fs.deleteObject(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mkdir creates a new directory with the specified name.
+// An empty object with a key ending with "/" is used as directory marker
+func (fs *S3Fs) Mkdir(name string, perm os.FileMode) error {
+	if _, err := fs.Stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	} else if !fs.IsNotExist(err) {
+		return err
+	}
+	fi, err := fs.Stat(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+	}
+	key, _ := fs.getKey(name)
+	_, err = fs.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(fs.config.Bucket),
+		Key:    aws.String(key + "/"),
+		Body:   strings.NewReader(""),
+	})
+	return err
+}
+
+// MkdirAll creates a directory named path, along with any necessary parents
+func (fs *S3Fs) MkdirAll(name string, perm os.FileMode) error {
+	fi, err := fs.Stat(name)
+	if err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+		}
+		return nil
+	}
+	if !fs.IsNotExist(err) {
+		return err
+	}
+	if err = fs.MkdirAll(filepath.Dir(name), perm); err != nil {
+		return err
+	}
+	err = fs.Mkdir(name, perm)
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Symlink is not supported
+func (*S3Fs) Symlink(source, target string) error {
+	return &os.LinkError{Op: "symlink", Old: source, New: target, Err: errS3Unsupported}
+}
+
+// Readlink is not supported, symlinks cannot be created
+func (*S3Fs) Readlink(name string) (string, error) {
+	return "", &os.PathError{Op: "readlink", Path: name, Err: errS3Unsupported}
+}
+
+// Chown does nothing, objects have no owner
+func (*S3Fs) Chown(name string, uid int, gid int) error {
+	return nil
+}
+
+// Chmod is not supported, objects have no permission bits
+func (*S3Fs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: errS3Unsupported}
+}
+
+// Chtimes is not supported, the modification time is set by the server
+func (*S3Fs) Chtimes(name string, atime, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: errS3Unsupported}
+}
+
+// ReadDir reads the directory named by dirname and returns a list of directory entries sorted by filename.
+// The objects are listed using the directory prefix and the "/" delimiter
+func (fs *S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	key, err := fs.getKey(dirname)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: err}
+	}
+	dirPrefix := fs.getDirPrefix(key)
+	var result []os.FileInfo
+	found := fs.isRootKey(key)
+	err = fs.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(fs.config.Bucket),
+		Prefix:    aws.String(dirPrefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.CommonPrefixes) > 0 || len(page.Contents) > 0 {
+			found = true
+		}
+		result = append(result, getS3PageEntries(page, dirPrefix)...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if _, err = fs.Stat(dirname); err != nil {
+			return nil, err
+		}
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: errNotDir}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
+}
+
+// OpenDir opens the named directory for incremental reading, the objects are listed a page at a time
+func (fs *S3Fs) OpenDir(dirname string) (DirLister, error) {
+	fi, err := fs.Stat(dirname)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: errNotDir}
+	}
+	key, err := fs.getKey(dirname)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: dirname, Err: err}
+	}
+	return &s3DirLister{fs: fs, prefix: fs.getDirPrefix(key)}, nil
+}
+
+// EvalSymlinks returns the cleaned path name if it exists, symlinks are not supported
+func (fs *S3Fs) EvalSymlinks(name string) (string, error) {
+	if _, err := fs.Stat(name); err != nil {
+		return "", err
+	}
+	return filepath.Clean(name), nil
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to report that a file or directory does not exist
+func (*S3Fs) IsNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound"
+	}
+	return os.IsNotExist(err)
+}
+
+// IsAtomicUploadSupported returns false: the uploaded objects are visible only when the upload completes
+// and renaming them requires a copy
+func (*S3Fs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// getKey returns the object key for the given filesystem path
+func (fs *S3Fs) getKey(name string) (string, error) {
+	rel, err := filepath.Rel(fs.rootDir, filepath.Clean(name))
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return fs.config.KeyPrefix, nil
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", os.ErrPermission
+	}
+	return fs.config.KeyPrefix + filepath.ToSlash(rel), nil
+}
+
+func (fs *S3Fs) isRootKey(key string) bool {
+	return key == fs.config.KeyPrefix
+}
+
+// getDirPrefix returns the prefix shared by the keys of the objects inside the given directory key
+func (fs *S3Fs) getDirPrefix(key string) string {
+	if fs.isRootKey(key) {
+		return key
+	}
+	return key + "/"
+}
+
+// getS3PageEntries returns the directory entries for a listing page of the directory with the given prefix
+func getS3PageEntries(page *s3.ListObjectsV2Output, dirPrefix string) []os.FileInfo {
+	var result []os.FileInfo
+	for _, p := range page.CommonPrefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(p.Prefix), dirPrefix), "/")
+		result = append(result, &fileInfo{name: name, mode: os.ModeDir | 0755, modTime: time.Now()})
+	}
+	for _, obj := range page.Contents {
+		name := strings.TrimPrefix(aws.StringValue(obj.Key), dirPrefix)
+		if name == "" {
+			// the directory marker
+			continue
+		}
+		result = append(result, &fileInfo{
+			name:    name,
+			size:    aws.Int64Value(obj.Size),
+			mode:    0644,
+			modTime: aws.TimeValue(obj.LastModified),
+		})
+	}
+	return result
+}
+
+// listKeys returns the keys of all the objects with the given prefix, recursively
+func (fs *S3Fs) listKeys(prefix string) ([]string, error) {
+	var keys []string
+	err := fs.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(fs.config.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	return keys, err
+}
+
+func (fs *S3Fs) copyObject(sourceKey, targetKey string) error {
+	copySource := strings.Replace(url.PathEscape(fs.config.Bucket+"/"+sourceKey), "%2F", "/", -1)
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(fs.config.Bucket),
+		CopySource: aws.String(copySource),
+		Key:        aws.String(targetKey),
+	}
+	if fs.config.StorageClass != "" {
+		input.StorageClass = aws.String(fs.config.StorageClass)
+	}
+	_, err := fs.svc.CopyObject(input)
+	return err
+}
+
+func (fs *S3Fs) deleteObject(key string) error {
+	_, err := fs.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(fs.config.Bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// newUpload starts an upload in a separate goroutine, the data written to the returned file are streamed
+// to the uploader using a pipe
+func (fs *S3Fs) newUpload(name, key string) *s3File {
+	r, w := io.Pipe()
+	f := &s3File{
+		fs:         fs,
+		name:       name,
+		key:        key,
+		writer:     w,
+		pending:    make(map[int64][]byte),
+		uploadDone: make(chan error, 1),
+	}
+	uploader := s3manager.NewUploaderWithClient(fs.svc, func(u *s3manager.Uploader) {
+		if fs.config.UploadPartSize > 0 {
+			u.PartSize = fs.config.UploadPartSize * 1024 * 1024
+		}
+	})
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(fs.config.Bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	}
+	if fs.config.StorageClass != "" {
+		input.StorageClass = aws.String(fs.config.StorageClass)
+	}
+	go func() {
+		_, err := uploader.Upload(input)
+		// unblock the writer if the upload fails
+		r.CloseWithError(err)
+		if err != nil {
+			logger.Warn(logSender, "upload error for key %#v: %v", key, err)
+		}
+		f.uploadDone <- err
+	}()
+	return f
+}
+
+type s3File struct {
+	sync.Mutex
+	fs     *S3Fs
+	name   string
+	key    string
+	size   int64
+	offset int64
+	closed bool
+	// the following fields are only used for uploads
+	writer     *io.PipeWriter
+	written    int64
+	pending    map[int64][]byte
+	uploadDone chan error
+}
+
+// Name returns the name of the file as presented to Open
+func (f *s3File) Name() string {
+	return f.name
+}
+
+// Read reads up to len(b) bytes from the current offset
+func (f *s3File) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// ReadAt reads len(b) bytes starting at byte offset off using a ranged request
+func (f *s3File) ReadAt(b []byte, off int64) (int, error) {
+	if f.isClosed() {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.writer != nil {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: errBadDescriptor}
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: os.ErrInvalid}
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	end := off + int64(len(b))
+	if end > f.size {
+		end = f.size
+	}
+	out, err := f.fs.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(f.fs.config.Bucket),
+		Key:    aws.String(f.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%v-%v", off, end-1)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
+	n, err := io.ReadFull(out.Body, b[:end-off])
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err == nil && n < len(b) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Write writes len(b) bytes at the current offset
+func (f *s3File) Write(b []byte) (int, error) {
+	n, err := f.WriteAt(b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes len(b) bytes starting at byte offset off.
+// Objects are uploaded sequentially: SFTP clients can send concurrent write requests so writes
+// received out of order are buffered until the missing data are received
+func (f *s3File) WriteAt(b []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.writer == nil {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: errBadDescriptor}
+	}
+	if off < f.written {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: errS3NonSequentialWrite}
+	}
+	if off > f.written {
+		if len(f.pending) >= maxS3PendingWrites {
+			return 0, &os.PathError{Op: "writeat", Path: f.name, Err: errS3NonSequentialWrite}
+		}
+		data := make([]byte, len(b))
+		copy(data, b)
+		f.pending[off] = data
+		return len(b), nil
+	}
+	if err := f.write(b); err != nil {
+		return 0, err
+	}
+	for {
+		data, ok := f.pending[f.written]
+		if !ok {
+			break
+		}
+		delete(f.pending, f.written)
+		if err := f.write(data); err != nil {
+			return len(b), err
+		}
+	}
+	return len(b), nil
+}
+
+// Stat returns the FileInfo structure describing the file, for uploads the size is the number of bytes written
+func (f *s3File) Stat() (os.FileInfo, error) {
+	if f.isClosed() {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	if f.writer != nil {
+		f.Lock()
+		defer f.Unlock()
+		return &fileInfo{name: filepath.Base(f.name), size: f.written, mode: 0644, modTime: time.Now()}, nil
+	}
+	return f.fs.Stat(f.name)
+}
+
+// Close closes the file, for uploads it waits for the upload to complete
+func (f *s3File) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	if f.writer == nil {
+		return nil
+	}
+	var err error
+	if len(f.pending) > 0 {
+		// some data are missing, the upload must be aborted
+		err = &os.PathError{Op: "close", Path: f.name, Err: errS3NonSequentialWrite}
+		f.writer.CloseWithError(err)
+	} else {
+		f.writer.Close()
+	}
+	uploadErr := <-f.uploadDone
+	if err == nil {
+		err = uploadErr
+	}
+	return err
+}
+
+func (f *s3File) write(b []byte) error {
+	n, err := f.writer.Write(b)
+	f.written += int64(n)
+	return err
+}
+
+func (f *s3File) isClosed() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.closed
+}
+
+// s3DirLister lists a directory a page at a time, the next page is requested only when the entries
+// already received are not enough
+type s3DirLister struct {
+	fs      *S3Fs
+	prefix  string
+	token   *string
+	entries []os.FileInfo
+	done    bool
+}
+
+func (l *s3DirLister) Readdir(n int) ([]os.FileInfo, error) {
+	for !l.done && (n <= 0 || len(l.entries) < n) {
+		page, err := l.fs.svc.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:            aws.String(l.fs.config.Bucket),
+			Prefix:            aws.String(l.prefix),
+			Delimiter:         aws.String("/"),
+			ContinuationToken: l.token,
+		})
+		if err != nil {
+			return nil, err
+		}
+		l.entries = append(l.entries, getS3PageEntries(page, l.prefix)...)
+		l.token = page.NextContinuationToken
+		l.done = !aws.BoolValue(page.IsTruncated)
+	}
+	if n <= 0 {
+		entries := l.entries
+		l.entries = nil
+		return entries, nil
+	}
+	if len(l.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(l.entries) {
+		n = len(l.entries)
+	}
+	entries := l.entries[:n]
+	l.entries = l.entries[n:]
+	return entries, nil
+}
+
+func (l *s3DirLister) Close() error {
+	l.entries = nil
+	l.done = true
+	return nil
+}
@@ -0,0 +1,531 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBucket = "sftpgo"
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+// fakeS3Server is a minimal S3 compatible server, it supports only the requests used by S3Fs
+// and path style addressing
+type fakeS3Server struct {
+	sync.Mutex
+	objects  map[string]fakeS3Object
+	uploads  map[string]map[int][]byte
+	pageSize int
+	requests []string
+}
+
+func newFakeS3Server() *fakeS3Server {
+	return &fakeS3Server{
+		objects:  make(map[string]fakeS3Object),
+		uploads:  make(map[string]map[int][]byte),
+		pageSize: 1000,
+	}
+}
+
+func (s *fakeS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != testBucket {
+		s.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method == http.MethodGet && query.Get("list-type") == "2" {
+			s.listObjects(w, query)
+			return
+		}
+		s.writeError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	key := parts[1]
+	s.requests = append(s.requests, fmt.Sprintf("%v %v", r.Method, key))
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		s.getObject(w, r, key)
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			s.copyObject(w, source, key)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			upload, ok := s.uploads[uploadID]
+			if !ok {
+				s.writeError(w, http.StatusNotFound, "NoSuchUpload")
+				return
+			}
+			partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+			upload[partNumber] = data
+		} else {
+			s.objects[key] = fakeS3Object{data: data, modTime: time.Now()}
+		}
+		w.Header().Set("ETag", getETag(data))
+	case http.MethodPost:
+		if _, ok := query["uploads"]; ok {
+			uploadID := fmt.Sprintf("upload%v", len(s.uploads)+1)
+			s.uploads[uploadID] = make(map[int][]byte)
+			s.writeXML(w, fmt.Sprintf("<InitiateMultipartUploadResult><Bucket>%v</Bucket><Key>%v</Key>"+
+				"<UploadId>%v</UploadId></InitiateMultipartUploadResult>", testBucket, escapeXML(key), uploadID))
+			return
+		}
+		upload, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var partNumbers []int
+		for n := range upload {
+			partNumbers = append(partNumbers, n)
+		}
+		sort.Ints(partNumbers)
+		var data []byte
+		for _, n := range partNumbers {
+			data = append(data, upload[n]...)
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		s.objects[key] = fakeS3Object{data: data, modTime: time.Now()}
+		s.writeXML(w, fmt.Sprintf("<CompleteMultipartUploadResult><Bucket>%v</Bucket><Key>%v</Key>"+
+			"<ETag>%v</ETag></CompleteMultipartUploadResult>", testBucket, escapeXML(key), getETag(data)))
+	case http.MethodDelete:
+		if uploadID := query.Get("uploadId"); uploadID != "" {
+			delete(s.uploads, uploadID)
+		} else {
+			delete(s.objects, key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3Server) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj, ok := s.objects[key]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	data := obj.data
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end); err != nil || start >= len(data) {
+			s.writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", getETag(obj.data))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (s *fakeS3Server) copyObject(w http.ResponseWriter, source, key string) {
+	source, _ = url.PathUnescape(source)
+	source = strings.TrimPrefix(strings.TrimPrefix(source, "/"), testBucket+"/")
+	obj, ok := s.objects[source]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	s.objects[key] = fakeS3Object{data: obj.data, modTime: time.Now()}
+	s.writeXML(w, fmt.Sprintf("<CopyObjectResult><ETag>%v</ETag><LastModified>%v</LastModified></CopyObjectResult>",
+		getETag(obj.data), time.Now().UTC().Format(time.RFC3339)))
+}
+
+func (s *fakeS3Server) listObjects(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	token := query.Get("continuation-token")
+	maxKeys := s.pageSize
+	if m, err := strconv.Atoi(query.Get("max-keys")); err == nil && m < maxKeys {
+		maxKeys = m
+	}
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var contents, commonPrefixes []string
+	lastPrefix := ""
+	count := 0
+	truncated := false
+	nextToken := ""
+	for _, k := range keys {
+		if token != "" && (k <= token || (delimiter != "" && strings.HasSuffix(token, delimiter) && strings.HasPrefix(k, token))) {
+			continue
+		}
+		entry := k
+		isPrefix := false
+		if delimiter != "" {
+			if idx := strings.Index(k[len(prefix):], delimiter); idx >= 0 {
+				entry = k[:len(prefix)+idx+len(delimiter)]
+				isPrefix = true
+			}
+		}
+		if isPrefix && entry == lastPrefix {
+			continue
+		}
+		if count >= maxKeys {
+			truncated = true
+			break
+		}
+		count++
+		nextToken = entry
+		if isPrefix {
+			lastPrefix = entry
+			commonPrefixes = append(commonPrefixes, fmt.Sprintf("<CommonPrefixes><Prefix>%v</Prefix></CommonPrefixes>",
+				escapeXML(entry)))
+		} else {
+			obj := s.objects[k]
+			contents = append(contents, fmt.Sprintf("<Contents><Key>%v</Key><LastModified>%v</LastModified>"+
+				"<ETag>%v</ETag><Size>%v</Size><StorageClass>STANDARD</StorageClass></Contents>", escapeXML(k),
+				obj.modTime.UTC().Format(time.RFC3339), getETag(obj.data), len(obj.data)))
+		}
+	}
+	result := fmt.Sprintf("<ListBucketResult><Name>%v</Name><Prefix>%v</Prefix><KeyCount>%v</KeyCount>"+
+		"<MaxKeys>%v</MaxKeys><IsTruncated>%v</IsTruncated>", testBucket, escapeXML(prefix), count, maxKeys, truncated)
+	if truncated {
+		result += fmt.Sprintf("<NextContinuationToken>%v</NextContinuationToken>", escapeXML(nextToken))
+	}
+	result += strings.Join(contents, "") + strings.Join(commonPrefixes, "") + "</ListBucketResult>"
+	s.writeXML(w, result)
+}
+
+func (s *fakeS3Server) writeXML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header+body)
+}
+
+func (s *fakeS3Server) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, fmt.Sprintf("%v<Error><Code>%v</Code><Message>%v</Message></Error>", xml.Header, code, code))
+}
+
+func (s *fakeS3Server) getRequests(prefix string) []string {
+	s.Lock()
+	defer s.Unlock()
+	var result []string
+	for _, r := range s.requests {
+		if strings.HasPrefix(r, prefix) {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func getETag(data []byte) string {
+	h := md5.Sum(data)
+	return "\"" + hex.EncodeToString(h[:]) + "\""
+}
+
+func escapeXML(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func newTestS3Fs(t *testing.T, ts *httptest.Server, keyPrefix string) Fs {
+	fs, err := NewS3Fs(testRoot, S3FsConfig{
+		Bucket:         testBucket,
+		KeyPrefix:      keyPrefix,
+		Region:         "us-east-1",
+		AccessKey:      "access-key",
+		AccessSecret:   "access-secret",
+		Endpoint:       ts.URL,
+		UploadPartSize: 5,
+	})
+	if err != nil {
+		t.Fatalf("unable to create S3 fs: %v", err)
+	}
+	return fs
+}
+
+func TestS3FsReadWrite(t *testing.T) {
+	server := newFakeS3Server()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	fs := newTestS3Fs(t, ts, "users/user1/")
+	filePath := filepath.Join(testRoot, "dir", "file")
+	f, err := fs.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	// writes received out of order must be reordered
+	_, err = f.WriteAt([]byte("world"), 6)
+	if err != nil {
+		t.Errorf("unable to write file: %v", err)
+	}
+	_, err = f.WriteAt([]byte("hello "), 0)
+	if err != nil {
+		t.Errorf("unable to write file: %v", err)
+	}
+	_, err = f.WriteAt([]byte("data"), 0)
+	if err == nil {
+		t.Errorf("overwriting already uploaded data must fail")
+	}
+	_, err = f.ReadAt(make([]byte, 1), 0)
+	if err == nil {
+		t.Errorf("reading a file opened for writing must fail")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Errorf("unable to close file: %v", err)
+	}
+	if _, ok := server.objects["users/user1/dir/file"]; !ok {
+		t.Errorf("the object key must include the key prefix: %v", server.getRequests(""))
+	}
+	fi, err := fs.Stat(filePath)
+	if err != nil || fi.Size() != 11 || fi.IsDir() || fi.Name() != "file" {
+		t.Errorf("unexpected file info: %+v, err: %v", fi, err)
+	}
+	fi, err = fs.Stat(filepath.Dir(filePath))
+	if err != nil || !fi.IsDir() {
+		t.Errorf("the parent prefix must be a directory: %+v, err: %v", fi, err)
+	}
+	f, err = fs.Open(filePath)
+	if err != nil {
+		t.Fatalf("unable to open file: %v", err)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil || string(content) != "hello world" {
+		t.Errorf("unexpected file content: %#v, err: %v", string(content), err)
+	}
+	buf := make([]byte, 10)
+	n, err := f.ReadAt(buf, 6)
+	if err != io.EOF || string(buf[:n]) != "world" {
+		t.Errorf("unexpected read at result: %#v, err: %v", string(buf[:n]), err)
+	}
+	n, err = f.ReadAt(buf[:3], 2)
+	if err != nil || string(buf[:n]) != "llo" {
+		t.Errorf("unexpected read at result: %#v, err: %v", string(buf[:n]), err)
+	}
+	_, err = f.ReadAt(buf, 11)
+	if err != io.EOF {
+		t.Errorf("reading after the end of the file must return EOF: %v", err)
+	}
+	f.Close()
+	_, err = fs.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if !os.IsExist(err) {
+		t.Errorf("exclusive create of an existing file must fail: %v", err)
+	}
+	_, err = fs.OpenFile(filePath, os.O_WRONLY, 0666)
+	if err == nil {
+		t.Errorf("writing to an existing object without truncating it must fail")
+	}
+	_, err = fs.Open(filepath.Join(testRoot, "missing"))
+	if !fs.IsNotExist(err) {
+		t.Errorf("opening a missing file must fail with not exist: %v", err)
+	}
+	_, err = fs.OpenFile(filepath.Dir(filePath), os.O_WRONLY|os.O_TRUNC, 0666)
+	if err == nil {
+		t.Errorf("opening a directory for writing must fail")
+	}
+	_, err = fs.Stat(filepath.Join(testRoot, ".."))
+	if err == nil {
+		t.Errorf("paths outside the root dir must not be mapped to keys")
+	}
+}
+
+func TestS3FsMultipartUpload(t *testing.T) {
+	server := newFakeS3Server()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	fs := newTestS3Fs(t, ts, "")
+	filePath := filepath.Join(testRoot, "bigfile")
+	f, err := fs.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	data := bytes.Repeat([]byte("0123456789abcdef"), 6*1024*1024/16+100)
+	chunkSize := 32768
+	for off := 0; off < len(data); off += chunkSize {
+		end := off + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err = f.Write(data[off:end]); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		t.Errorf("unable to close file: %v", err)
+	}
+	if len(server.getRequests("POST bigfile")) != 2 {
+		t.Errorf("a multipart upload is expected, requests: %v", server.getRequests("POST"))
+	}
+	if !bytes.Equal(server.objects["bigfile"].data, data) {
+		t.Errorf("the uploaded data does not match")
+	}
+	f, err = fs.Open(filePath)
+	if err != nil {
+		t.Fatalf("unable to open file: %v", err)
+	}
+	buf := make([]byte, 100)
+	offset := int64(5*1024*1024 - 50)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil || !bytes.Equal(buf[:n], data[offset:offset+100]) {
+		t.Errorf("unexpected ranged read result, n: %v, err: %v", n, err)
+	}
+	f.Close()
+}
+
+func TestS3FsDirs(t *testing.T) {
+	server := newFakeS3Server()
+	server.pageSize = 2
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	fs := newTestS3Fs(t, ts, "prefix/")
+	dirPath := filepath.Join(testRoot, "dir")
+	err := fs.Mkdir(filepath.Join(dirPath, "sub"), 0777)
+	if err == nil {
+		t.Errorf("mkdir must fail if the parent dir does not exist")
+	}
+	err = fs.MkdirAll(dirPath, 0777)
+	if err != nil {
+		t.Errorf("unable to create dirs: %v", err)
+	}
+	err = fs.Mkdir(dirPath, 0777)
+	if !os.IsExist(err) {
+		t.Errorf("mkdir must fail if the dir already exists: %v", err)
+	}
+	files, err := fs.ReadDir(dirPath)
+	if err != nil || len(files) != 0 {
+		t.Errorf("unexpected empty dir contents: %v, err: %v", files, err)
+	}
+	for _, name := range []string{"b", "a", "c"} {
+		f, err := fs.OpenFile(filepath.Join(dirPath, name), os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			t.Errorf("unable to create file: %v", err)
+			continue
+		}
+		f.Write([]byte(name))
+		f.Close()
+	}
+	err = fs.MkdirAll(filepath.Join(dirPath, "subdir", "nested"), 0777)
+	if err != nil {
+		t.Errorf("unable to create dirs: %v", err)
+	}
+	files, err = fs.ReadDir(dirPath)
+	if err != nil || len(files) != 4 {
+		t.Errorf("unexpected dir contents: %v, err: %v", files, err)
+	} else if files[0].Name() != "a" || files[0].Size() != 1 || files[3].Name() != "subdir" || !files[3].IsDir() {
+		t.Errorf("dir contents must be sorted by name: %v", files)
+	}
+	_, err = fs.ReadDir(filepath.Join(testRoot, "missing"))
+	if !fs.IsNotExist(err) {
+		t.Errorf("listing a missing dir must fail with not exist: %v", err)
+	}
+	lister, err := fs.OpenDir(dirPath)
+	if err != nil {
+		t.Errorf("unable to open dir: %v", err)
+	} else {
+		var names []string
+		for {
+			entries, err := lister.Readdir(3)
+			if err == io.EOF {
+				break
+			}
+			if err != nil || len(entries) > 3 {
+				t.Errorf("unexpected incremental listing: %v, err: %v", entries, err)
+				break
+			}
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+		}
+		lister.Close()
+		if len(names) != 4 {
+			t.Errorf("unexpected incremental dir contents: %v", names)
+		}
+	}
+	_, err = fs.OpenDir(filepath.Join(dirPath, "a"))
+	if err == nil {
+		t.Errorf("opening a file as dir must fail")
+	}
+	numFiles, size, fileList, err := ScanDirContents(fs, testRoot)
+	if err != nil || numFiles != 3 || size != 3 || len(fileList) != 3 {
+		t.Errorf("unexpected scan results, files: %v size: %v err: %v", numFiles, size, err)
+	}
+	err = fs.Remove(dirPath)
+	if err == nil {
+		t.Errorf("removing a non empty dir must fail")
+	}
+	err = fs.Remove(filepath.Join(dirPath, "subdir", "nested"))
+	if err != nil {
+		t.Errorf("unable to remove empty dir: %v", err)
+	}
+	renamedPath := filepath.Join(testRoot, "renamed")
+	err = fs.Rename(dirPath, filepath.Join(dirPath, "subdir", "dir"))
+	if err == nil {
+		t.Errorf("renaming a dir inside itself must fail")
+	}
+	err = fs.Rename(dirPath, renamedPath)
+	if err != nil {
+		t.Errorf("unable to rename dir: %v", err)
+	}
+	if _, err = fs.Stat(filepath.Join(renamedPath, "a")); err != nil {
+		t.Errorf("dir contents must be renamed: %v", err)
+	}
+	if _, err = fs.Stat(filepath.Join(dirPath, "a")); !fs.IsNotExist(err) {
+		t.Errorf("the source dir contents must not exist after rename: %v", err)
+	}
+	err = fs.Rename(filepath.Join(renamedPath, "a"), filepath.Join(renamedPath, "subdir", "a"))
+	if err != nil {
+		t.Errorf("unable to rename file: %v", err)
+	}
+	err = fs.Symlink(renamedPath, filepath.Join(testRoot, "link"))
+	if err == nil {
+		t.Errorf("symlinks must not be supported")
+	}
+	err = fs.RemoveAll(renamedPath)
+	if err != nil {
+		t.Errorf("unable to remove dir: %v", err)
+	}
+	files, err = fs.ReadDir(testRoot)
+	if err != nil || len(files) != 0 {
+		t.Errorf("unexpected dir contents after remove: %v, err: %v", files, err)
+	}
+	if len(server.objects) != 0 {
+		t.Errorf("all the objects must be removed: %v", server.objects)
+	}
+}
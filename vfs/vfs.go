@@ -0,0 +1,134 @@
+// Package vfs provides the filesystem abstraction used by the SFTP server.
+// The local filesystem and an in memory filesystem are supported
+package vfs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const logSender = "vfs"
+
+// File defines the interface for an open file
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+}
+
+// DirLister reads the contents of a directory incrementally
+type DirLister interface {
+	// Readdir returns the next n directory entries, or all the remaining entries if n <= 0.
+	// If n > 0 and there are no more entries io.EOF is returned
+	Readdir(n int) ([]os.FileInfo, error)
+	Close() error
+}
+
+// Fs defines the interface for the filesystem backends.
+// The paths are absolute filesystem paths, they are already resolved and validated by the caller
+type Fs interface {
+	Name() string
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(source, target string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Symlink(source, target string) error
+	Readlink(name string) (string, error)
+	Chown(name string, uid int, gid int) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	OpenDir(dirname string) (DirLister, error)
+	EvalSymlinks(name string) (string, error)
+	IsNotExist(err error) bool
+	IsAtomicUploadSupported() bool
+}
+
+// ScanDirContents returns the number of files contained in a directory, their size and a slice with the file paths
+func ScanDirContents(fs Fs, dirPath string) (int, int64, []string, error) {
+	var numFiles int
+	var size int64
+	var fileList []string
+	fi, err := fs.Stat(dirPath)
+	if err != nil || !fi.IsDir() {
+		return numFiles, size, fileList, err
+	}
+	err = walkDir(fs, dirPath, func(filePath string, info os.FileInfo) {
+		if info.Mode().IsRegular() {
+			size += info.Size()
+			numFiles++
+			fileList = append(fileList, filePath)
+		}
+	})
+	return numFiles, size, fileList, err
+}
+
+// SetPathPermissions changes the owner of the given path, errors are logged and ignored
+func SetPathPermissions(fs Fs, path string, uid int, gid int) {
+	if err := fs.Chown(path, uid, gid); err != nil {
+		logger.Warn(logSender, "error chowning path %v: %v", path, err)
+	}
+}
+
+// walkDir walks the given directory recursively, symlinks are not followed
+func walkDir(fs Fs, dirPath string, walkFn func(string, os.FileInfo)) error {
+	files, err := fs.ReadDir(dirPath)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		p := filepath.Join(dirPath, fi.Name())
+		walkFn(p, fi)
+		if fi.IsDir() {
+			if err = walkDir(fs, p, walkFn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fileInfo implements os.FileInfo for the filesystems that are not backed by the os package
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	return fi.mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}